@@ -0,0 +1,63 @@
+// Command clientsecret hashes client secrets for the authz configuration.
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/amsterdam/authz/oauth2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func main() {
+	// Flags
+	generate := flag.Bool("generate", false, "Generate a random secret instead of reading one from stdin")
+	useBcrypt := flag.Bool("bcrypt", false, "Create a bcrypt hash instead of an argon2id hash")
+	flag.Parse()
+
+	// Grab the secret from stdin or create a new one
+	var secret string
+	if *generate {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatalf("Error creating secret: %v", err)
+		}
+		secret = base64.RawURLEncoding.EncodeToString(b)
+		fmt.Fprintf(os.Stderr, "Secret: %s\n", secret)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatalf("Error reading stdin: %v", err)
+		}
+		secret = strings.TrimRight(line, "\r\n")
+	}
+	if secret == "" {
+		log.Fatal("Secret is empty")
+	}
+
+	// Hash it
+	var hash string
+	if *useBcrypt {
+		b, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatalf("Error hashing secret: %v", err)
+		}
+		hash = string(b)
+	} else if *generate {
+		// Random secrets can't be guessed, so don't need a slow hash
+		hash = oauth2.HashRandomSecret(secret)
+	} else {
+		h, err := oauth2.HashSecret(secret)
+		if err != nil {
+			log.Fatalf("Error hashing secret: %v", err)
+		}
+		hash = h
+	}
+	fmt.Printf("%s\n", hash)
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/amsterdam/authz/oauth2"
@@ -13,6 +15,7 @@ const (
 	defaultBindPort            = 8080
 	defaultAuthnTimeout        = 600
 	defaultAuthzUpdateInterval = 60
+	defaultDPoPNonceLifetime   = 300
 )
 
 // Config represents the configuration format for the server.
@@ -22,30 +25,106 @@ type config struct {
 	BaseURL      string            `toml:"base-url"`
 	PprofEnabled bool              `toml:"pprof-enabled"`
 	AuthnTimeout int               `toml:"authn-timeout"`
+	MaxAuthnReqs int               `toml:"max-pending-authn-requests"`
 	TraceHeader  string            `toml:"trace-header-name"`
 	LogJSON      bool              `toml:"log-json-output"`
+	TLS          tlsConfig         `toml:"tls"`
 	Roles        rolesConfig       `toml:"roles"`
 	DatapuntIDP  datapuntIDPConfig `toml:"idp-datapunt"`
 	GoogleIDP    googleIDPConfig   `toml:"idp-google"`
 	GripIDP      gripIDPConfig     `toml:"idp-grip"`
 	Clients      clientMap         `toml:"clients"`
+	ClientsAPI   clientsAPIConfig  `toml:"clients-api"`
+	ClientReg    clientRegConfig   `toml:"client-registration"`
+	Resources    []resourceConfig  `toml:"resource-servers"`
 	Authz        authzConfig       `toml:"authorization"`
 	Redis        redisConfig       `toml:"redis"`
+	StateCookies stateCookieConfig `toml:"state-cookies"`
+	StateEncrypt stateCryptConfig  `toml:"state-encryption"`
+	DPoP         dpopConfig        `toml:"dpop"`
+	Pairwise     pairwiseConfig    `toml:"pairwise-subjects"`
+	Database     databaseConfig    `toml:"database"`
 	Accesstoken  accessTokenConfig `toml:"accesstoken"`
 }
 
+// TLS configuration
+type tlsConfig struct {
+	CertFile     string `toml:"cert-file"`
+	KeyFile      string `toml:"key-file"`
+	ClientCerts  bool   `toml:"request-client-certs"`
+	ClientCAFile string `toml:"client-ca-file"`
+}
+
 // accessToken configuration
 type accessTokenConfig struct {
-	JWKS     string `toml:"jwk-set"`
-	KID      string `toml:"jwk-id"`
-	Lifetime int64  `toml:"lifetime"`
-	Issuer   string `toml:"issuer"`
+	JWKS     string             `toml:"jwk-set"`
+	KID      string             `toml:"jwk-id"`
+	Lifetime int64              `toml:"lifetime"`
+	Issuer   string             `toml:"issuer"`
+	Profile  string             `toml:"profile"`
+	Audience string             `toml:"audience"`
+	Vault    vaultTransitConfig `toml:"vault-transit"`
+}
+
+// Vault transit signing key configuration
+type vaultTransitConfig struct {
+	Address string `toml:"address"`
+	Token   string `toml:"token"`
+	Mount   string `toml:"mount"`
+	Key     string `toml:"key"`
+	KID     string `toml:"jwk-id"`
 }
 
 // Redis configuration
 type redisConfig struct {
-	Address  string `toml:"address"`
-	Password string `toml:"password"`
+	Address           string   `toml:"address"`
+	Username          string   `toml:"username"`
+	Password          string   `toml:"password"`
+	KeyPrefix         string   `toml:"key-prefix"`
+	SentinelAddresses []string `toml:"sentinel-addresses"`
+	SentinelMaster    string   `toml:"sentinel-master"`
+	SentinelPassword  string   `toml:"sentinel-password"`
+	SentinelTLS       bool     `toml:"sentinel-tls"`
+	SentinelTLSCAFile string   `toml:"sentinel-tls-ca-file"`
+	SentinelTLSName   string   `toml:"sentinel-tls-server-name"`
+	ClusterAddresses  []string `toml:"cluster-addresses"`
+	TLS               bool     `toml:"tls"`
+	TLSCAFile         string   `toml:"tls-ca-file"`
+	TLSServerName     string   `toml:"tls-server-name"`
+	MaxIdle           int      `toml:"max-idle"`
+	MaxActive         int      `toml:"max-active"`
+	IdleTimeout       int      `toml:"idle-timeout"`
+	ConnectTimeout    int      `toml:"connect-timeout"`
+	ReadTimeout       int      `toml:"read-timeout"`
+	WriteTimeout      int      `toml:"write-timeout"`
+}
+
+// State storage encryption configuration
+type stateCryptConfig struct {
+	Keys []string `toml:"keys"`
+}
+
+// DPoP proof configuration
+type dpopConfig struct {
+	NonceKey      string `toml:"nonce-key"`
+	NonceLifetime int    `toml:"nonce-lifetime"`
+}
+
+// Pairwise subject identifier configuration
+type pairwiseConfig struct {
+	Key string `toml:"key"`
+}
+
+// SQL database configuration
+type databaseConfig struct {
+	Driver       string `toml:"driver"`
+	DSN          string `toml:"dsn"`
+	ReapInterval int    `toml:"reap-interval"`
+}
+
+// Authorization state cookie configuration
+type stateCookieConfig struct {
+	Keys []string `toml:"keys"`
 }
 
 // Datapunt authorization config
@@ -54,6 +133,17 @@ type authzConfig struct {
 	UpdateInterval int    `toml:"update-interval"`
 }
 
+// Datapunt clients config
+type clientsAPIConfig struct {
+	URL            string `toml:"url"`
+	UpdateInterval int    `toml:"update-interval"`
+}
+
+// Dynamic client registration config
+type clientRegConfig struct {
+	InitialTokens []string `toml:"initial-access-tokens"`
+}
+
 // Datapunt user roles config
 type rolesConfig struct {
 	AccountsURL string `toml:"accounts-url"`
@@ -80,9 +170,36 @@ type gripIDPConfig struct {
 
 // Client configuration
 type clientConfig struct {
-	Redirects []string `toml:"redirects"`
-	Secret    string   `toml:"secret"`
-	GrantType string   `toml:"granttype"`
+	Redirects []string             `toml:"redirects"`
+	Secret    string               `toml:"secret"`
+	Secrets   []clientSecretConfig `toml:"secrets"`
+	GrantType string               `toml:"granttype"`
+	JWKS      string               `toml:"jwks"`
+	JWKSURI   string               `toml:"jwks-uri"`
+	SubjectDN string               `toml:"tls-subject-dn"`
+	TLSCerts  []string             `toml:"tls-cert-thumbprints"`
+	Grants    []string             `toml:"grant-types"`
+	Responses []string             `toml:"response-types"`
+	Scopes    []string             `toml:"scopes"`
+	ScopeMode string               `toml:"scope-mode"`
+	IDPs      []string             `toml:"idps"`
+	Lifetime  int64                `toml:"token-lifetime"`
+	PKCE      bool                 `toml:"require-pkce"`
+	Consent   bool                 `toml:"require-consent"`
+	Pairwise  bool                 `toml:"pairwise-subject"`
+	Sector    string               `toml:"sector"`
+}
+
+// Resource server configuration
+type resourceConfig struct {
+	URI    string   `toml:"uri"`
+	Scopes []string `toml:"scopes"`
+}
+
+// Hashed client secret configuration
+type clientSecretConfig struct {
+	Hash    string    `toml:"hash"`
+	Expires time.Time `toml:"expires"`
 }
 
 // Client lookup
@@ -91,9 +208,21 @@ type clientMap map[string]clientConfig
 // Implements oauth2.ClientMap
 func (m clientMap) Get(id string) (*oauth2.Client, error) {
 	if c, ok := m[id]; ok {
-		return &oauth2.Client{
+		client := &oauth2.Client{
 			ID: id, Redirects: c.Redirects, Secret: c.Secret, GrantType: c.GrantType,
-		}, nil
+			JWKS: c.JWKS, JWKSURI: c.JWKSURI,
+			TLSSubjectDN: c.SubjectDN, TLSCertThumbprints: c.TLSCerts,
+			GrantTypes: c.Grants, ResponseTypes: c.Responses,
+			Scopes: c.Scopes, ScopeMode: c.ScopeMode, IDPs: c.IDPs, TokenLifetime: c.Lifetime,
+			RequirePKCE: c.PKCE, RequireConsent: c.Consent,
+			PairwiseSubject: c.Pairwise, Sector: c.Sector,
+		}
+		for _, secret := range c.Secrets {
+			client.Secrets = append(client.Secrets, oauth2.ClientSecret{
+				Hash: secret.Hash, Expires: secret.Expires,
+			})
+		}
+		return client, nil
 	}
 	return nil, errors.New("Unknown client id")
 }
@@ -113,6 +242,24 @@ func loadConfig(configPath string) (*config, error) {
 	if config.Authz.UpdateInterval == 0 {
 		config.Authz.UpdateInterval = defaultAuthzUpdateInterval
 	}
+	if config.ClientsAPI.UpdateInterval == 0 {
+		config.ClientsAPI.UpdateInterval = defaultAuthzUpdateInterval
+	}
+	switch config.Accesstoken.Profile {
+	case "", "legacy", "rfc9068":
+	default:
+		return nil, fmt.Errorf("Invalid accesstoken profile: %s", config.Accesstoken.Profile)
+	}
+	for id, client := range config.Clients {
+		switch client.ScopeMode {
+		case "", oauth2.ScopeModeReject, oauth2.ScopeModeDrop:
+		default:
+			return nil, fmt.Errorf("Invalid scope-mode of client %s: %s", id, client.ScopeMode)
+		}
+		if client.Pairwise && config.Pairwise.Key == "" {
+			return nil, fmt.Errorf("Client %s requires pairwise subjects, but pairwise-subjects key is not set", id)
+		}
+	}
 	return config, nil
 }
 
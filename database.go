@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+)
+
+// migrations holds the schema migrations per dialect. Migrations are named
+// <version>_<description>.sql and applied in order of their version.
+//
+//go:embed migrations
+var migrations embed.FS
+
+// sqlDialect holds the differences between the supported databases.
+type sqlDialect struct {
+	// driver is the database/sql driver name, and the name of the directory
+	// holding the dialect's migrations.
+	driver string
+	// migrationLock is executed in the transaction of each migration to keep
+	// concurrently starting nodes from applying it twice.
+	migrationLock string
+	// positional placeholders: $1 or ?1
+	numberedPlaceholders bool
+}
+
+var sqlDialects = map[string]*sqlDialect{
+	"postgres": &sqlDialect{
+		driver:               "postgres",
+		migrationLock:        "SELECT pg_advisory_xact_lock(7423011)",
+		numberedPlaceholders: true,
+	},
+	"sqlite3": &sqlDialect{
+		driver: "sqlite3",
+	},
+}
+
+// sqlPlaceholder matches the numbered placeholders of a query.
+var sqlPlaceholder = regexp.MustCompile(`\$([0-9]+)`)
+
+// query rewrites the placeholders in a query that uses $1, $2... for the
+// dialect. Placeholders become ?1, ?2... so, as with $n, they can be used in
+// any order and more than once.
+func (d *sqlDialect) query(q string) string {
+	if d.numberedPlaceholders {
+		return q
+	}
+	return sqlPlaceholder.ReplaceAllString(q, "?$1")
+}
+
+// openDatabase opens the configured database and applies the migrations that
+// haven't been applied yet.
+func openDatabase(conf *databaseConfig) (*sql.DB, *sqlDialect, error) {
+	dialect, ok := sqlDialects[conf.Driver]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unsupported database driver: %s", conf.Driver)
+	}
+	db, err := sql.Open(dialect.driver, conf.DSN)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := migrate(db, dialect); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, dialect, nil
+}
+
+// migrate applies the dialect's migrations that haven't been applied yet.
+func migrate(db *sql.DB, dialect *sqlDialect) error {
+	if _, err := db.Exec(
+		"CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)",
+	); err != nil {
+		return err
+	}
+	dir := path.Join("migrations", dialect.driver)
+	entries, err := migrations.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	versions := make(map[int]string)
+	var order []int
+	for _, entry := range entries {
+		name := entry.Name()
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil || !strings.HasSuffix(name, ".sql") {
+			return fmt.Errorf("Invalid migration name: %s", name)
+		}
+		versions[version] = path.Join(dir, name)
+		order = append(order, version)
+	}
+	sort.Ints(order)
+	for _, version := range order {
+		if err := applyMigration(db, dialect, version, versions[version]); err != nil {
+			return fmt.Errorf("Migration %s failed: %v", versions[version], err)
+		}
+	}
+	return nil
+}
+
+// applyMigration applies the migration in the given file, unless the version
+// has been applied already.
+func applyMigration(db *sql.DB, dialect *sqlDialect, version int, file string) error {
+	stmts, err := migrations.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if dialect.migrationLock != "" {
+		if _, err := tx.Exec(dialect.migrationLock); err != nil {
+			return err
+		}
+	}
+	var applied int
+	if err := tx.QueryRow(
+		dialect.query("SELECT COUNT(*) FROM schema_migrations WHERE version = $1"), version,
+	).Scan(&applied); err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+	for _, stmt := range strings.Split(string(stmts), ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(
+		dialect.query("INSERT INTO schema_migrations (version) VALUES ($1)"), version,
+	); err != nil {
+		return err
+	}
+	log.Infof("Applied database migration %s", file)
+	return tx.Commit()
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestSQLDialectQuery(t *testing.T) {
+	q := "SELECT $2 || $1 || $10 || $1"
+	if rewritten := sqlDialects["sqlite3"].query(q); rewritten != "SELECT ?2 || ?1 || ?10 || ?1" {
+		t.Fatalf("Unexpected query: %s", rewritten)
+	}
+	if rewritten := sqlDialects["postgres"].query(q); rewritten != q {
+		t.Fatalf("Unexpected query: %s", rewritten)
+	}
+	// Placeholders bind by number when used out of order and repeated
+	s := testSQLStorage(t)
+	var result string
+	err := s.db.QueryRow(s.dialect.query("SELECT $2 || $1 || $2"), "a", "b").Scan(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "bab" {
+		t.Fatalf("Unexpected result: %s", result)
+	}
+}
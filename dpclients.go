@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/amsterdam/authz/oauth2"
+	log "github.com/sirupsen/logrus"
+)
+
+type clientHalObject struct {
+	Embedded clientHalEmbedded `json:"_embedded"`
+}
+
+type clientHalEmbedded struct {
+	Item []clientHalItem `json:"item"`
+}
+
+// clientHalItem is a client as returned by authz_admin. The client identifier
+// is the name of its self link.
+type clientHalItem struct {
+	Links struct {
+		Self authzHalLinkItem `json:"self"`
+	} `json:"_links"`
+	Redirects []string `json:"redirects"`
+	Secret    string   `json:"secret"`
+	GrantType string   `json:"granttype"`
+}
+
+// datapuntClients is a ClientMap that polls a HAL endpoint (authz_admin's
+// clients collection) for clients. It keeps the last snapshot it received, so
+// clients keep working when the endpoint is down.
+type datapuntClients struct {
+	clientsURL     string
+	client         http.Client
+	updateInterval int
+	etag           string
+	lock           sync.RWMutex
+	clients        clientMap
+}
+
+// newDatapuntClients creates the client map and fetches the clients. If the
+// endpoint is down it starts without clients, and the updater tries again.
+func newDatapuntClients(conf *clientsAPIConfig) *datapuntClients {
+	m := &datapuntClients{
+		clientsURL:     conf.URL,
+		client:         http.Client{Timeout: 850 * time.Millisecond},
+		updateInterval: conf.UpdateInterval,
+		clients:        make(clientMap),
+	}
+	if err := m.runUpdate(); err != nil {
+		log.WithError(err).Errorln("Couldn't get Datapunt clients, starting without them")
+	}
+	go m.updater()
+	log.Infoln("Created datapunt client map")
+	return m
+}
+
+// Get implements oauth2.ClientMap.
+func (m *datapuntClients) Get(id string) (*oauth2.Client, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.clients.Get(id)
+}
+
+func (m *datapuntClients) updater() {
+	for range time.Tick(time.Duration(m.updateInterval) * time.Second) {
+		if err := m.runUpdate(); err != nil {
+			log.WithError(err).Errorln("Couldn't update client map, using last snapshot")
+		}
+	}
+}
+
+// runUpdate fetches the clients if they've changed and replaces the snapshot.
+// The snapshot is left alone on errors.
+func (m *datapuntClients) runUpdate() error {
+	log.Infoln("Updating Datapunt clients")
+	req, err := http.NewRequest("GET", m.clientsURL, nil)
+	if err != nil {
+		return err
+	}
+	if m.etag != "" {
+		req.Header.Set("If-None-Match", m.etag)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 304 {
+		log.Infoln("Datapunt clients have not changed")
+		return nil
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Unexpected response from Datapunt clients: %s", resp.Status)
+	}
+	var data clientHalObject
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return err
+	}
+	clients := make(clientMap)
+	for _, item := range data.Embedded.Item {
+		id := item.Links.Self.Name
+		if id == "" {
+			return errors.New("Datapunt client without name")
+		}
+		clients[id] = clientConfig{
+			Redirects: item.Redirects, Secret: item.Secret, GrantType: item.GrantType,
+		}
+	}
+	m.lock.Lock()
+	m.clients = clients
+	m.lock.Unlock()
+	m.etag = resp.Header.Get("ETag")
+	log.Infof("Updated Datapunt clients (%d clients)", len(clients))
+	return nil
+}
+
+// clientMaps is a ClientMap that looks up clients in each of its maps in
+// turn, returning the first match.
+type clientMaps []oauth2.ClientMap
+
+// Implements oauth2.ClientMap
+func (maps clientMaps) Get(id string) (*oauth2.Client, error) {
+	for _, m := range maps {
+		if c, err := m.Get(id); err == nil {
+			return c, nil
+		}
+	}
+	return nil, errors.New("Unknown client id")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testClientsHAL = `{"_embedded": {"item": [{
+	"_links": {"self": {"href": "/clients/citydata", "name": "citydata"}},
+	"redirects": ["http://localhost/"],
+	"granttype": "token"
+}]}}`
+
+func TestDatapuntClients(t *testing.T) {
+	var requests []string
+	down := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Get("If-None-Match"))
+		switch {
+		case down:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.Header.Get("If-None-Match") == `"1"`:
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", `"1"`)
+			w.Write([]byte(testClientsHAL))
+		}
+	}))
+	defer server.Close()
+	m := &datapuntClients{clientsURL: server.URL, clients: make(clientMap)}
+	if err := m.runUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	// Not modified
+	if err := m.runUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if requests[1] != `"1"` {
+		t.Fatalf("ETag not sent: %q", requests)
+	}
+	// Endpoint down, keep last snapshot
+	down = true
+	if err := m.runUpdate(); err == nil {
+		t.Fatal("Expected an error")
+	}
+	c, err := m.Get("citydata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.GrantType != "token" || len(c.Redirects) != 1 || c.Redirects[0] != "http://localhost/" {
+		t.Fatalf("Unexpected client: %+v", c)
+	}
+	if _, err := m.Get("unknown"); err == nil {
+		t.Fatal("Got unknown client")
+	}
+}
+
+func TestDatapuntClientsUnavailable(t *testing.T) {
+	down := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(testClientsHAL))
+	}))
+	defer server.Close()
+	// Starts without clients while the endpoint is down
+	m := newDatapuntClients(&clientsAPIConfig{URL: server.URL, UpdateInterval: 3600})
+	if _, err := m.Get("citydata"); err == nil {
+		t.Fatal("Got client from unavailable endpoint")
+	}
+	down = false
+	if err := m.runUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get("citydata"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -106,7 +106,7 @@ func (d *datapuntIDP) AuthnCallback(r *http.Request) (string, *oauth2.User, erro
 			}).Warn("Couldn't decode datapunt IdP token / jwt")
 			return token[0], nil, nil
 		}
-		roles, err := d.dpRoles.Get(credentialsPayload.Subject)
+		roles, err := d.dpRoles.Get(r.Context(), credentialsPayload.Subject)
 		if err != nil {
 			return token[0], nil, err
 		}
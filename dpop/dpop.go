@@ -0,0 +1,257 @@
+// Package dpop verifies DPoP proofs (RFC 9449), which show that the sender of
+// a request holds the private key that an access token is bound to. It is used
+// by the token endpoint, and by resource servers that accept DPoP-bound access
+// tokens.
+package dpop
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amsterdam/authz/jose"
+)
+
+const (
+	// ProofHeader is the request header that carries DPoP proofs.
+	ProofHeader = "DPoP"
+	// NonceHeader is the response header that carries server nonces.
+	NonceHeader = "DPoP-Nonce"
+	// proofType is the typ header of DPoP proofs
+	proofType = "dpop+jwt"
+	// defaultMaxAge is how old (or how far in the future) proofs may be
+	defaultMaxAge = time.Minute
+)
+
+// ErrUseNonce is returned for proofs without a valid server nonce, if nonces
+// are required. The request should be retried with the nonce in the
+// DPoP-Nonce response header.
+var ErrUseNonce = errors.New("DPoP proof must contain a valid server nonce")
+
+// Proof holds the claims of a verified DPoP proof (RFC 9449 section 4.2).
+type Proof struct {
+	JWTId           string `json:"jti"`
+	Method          string `json:"htm"`
+	URI             string `json:"htu"`
+	IssuedAt        int64  `json:"iat"`
+	AccessTokenHash string `json:"ath,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+	// RFC 7638 thumbprint of the key the proof is signed with, which is the
+	// cnf.jkt of access tokens bound to the key
+	Thumbprint string `json:"-"`
+}
+
+// ReplayCache remembers the proofs that were used.
+type ReplayCache interface {
+	// Claim returns false if key was claimed before and hasn't expired.
+	Claim(ctx context.Context, key string, expires time.Time) (bool, error)
+}
+
+// Verifier verifies DPoP proofs.
+type Verifier struct {
+	// MaxAge is how old proofs may be. Proofs may be issued up to MaxAge in
+	// the future as well, to allow for clock skew.
+	MaxAge time.Duration
+
+	cache         ReplayCache
+	nonceKey      []byte
+	nonceLifetime time.Duration
+}
+
+// NewVerifier returns a Verifier that remembers used proofs in the given
+// cache. If cache is nil, used proofs are remembered in memory, which only
+// works when running a single node.
+func NewVerifier(cache ReplayCache) *Verifier {
+	if cache == nil {
+		cache = NewMemoryCache()
+	}
+	return &Verifier{MaxAge: defaultMaxAge, cache: cache}
+}
+
+// RequireNonces makes the verifier require proofs to contain a nonce issued
+// by Nonce (RFC 9449 section 8). Nonces are authenticated using key, which
+// must be shared by all nodes, and are valid for the given lifetime.
+func (v *Verifier) RequireNonces(key []byte, lifetime time.Duration) {
+	v.nonceKey = key
+	v.nonceLifetime = lifetime
+}
+
+// Nonce returns a new server nonce, or an empty string if nonces aren't
+// required.
+func (v *Verifier) Nonce() string {
+	if v.nonceKey == nil {
+		return ""
+	}
+	issued := make([]byte, 8)
+	binary.BigEndian.PutUint64(issued, uint64(time.Now().Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(issued, v.nonceMAC(issued)...))
+}
+
+// validNonce returns true if nonce was issued by this verifier and hasn't
+// expired.
+func (v *Verifier) validNonce(nonce string) bool {
+	data, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(data) <= 8 {
+		return false
+	}
+	issued, mac := data[:8], data[8:]
+	if !hmac.Equal(mac, v.nonceMAC(issued)) {
+		return false
+	}
+	issuedAt := time.Unix(int64(binary.BigEndian.Uint64(issued)), 0)
+	return time.Since(issuedAt) < v.nonceLifetime
+}
+
+func (v *Verifier) nonceMAC(issued []byte) []byte {
+	mac := hmac.New(sha256.New, v.nonceKey)
+	mac.Write(issued)
+	return mac.Sum(nil)[:16]
+}
+
+// Verify verifies a DPoP proof for a request with the given method to the
+// given URI. If the request carries an access token, the proof must contain
+// its hash. Each proof is only accepted once.
+func (v *Verifier) Verify(ctx context.Context, proof string, method string, uri string, accessToken string) (*Proof, error) {
+	var p Proof
+	typ, thumbprint, err := jose.DecodeEmbedded(proof, &p)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DPoP proof: %v", err)
+	}
+	p.Thumbprint = thumbprint
+	issuedAt := time.Unix(p.IssuedAt, 0)
+	switch {
+	case typ != proofType:
+		return nil, errors.New("DPoP proof has invalid typ")
+	case p.Method != method:
+		return nil, errors.New("DPoP proof has invalid htm")
+	case !sameURI(p.URI, uri):
+		return nil, errors.New("DPoP proof has invalid htu")
+	case time.Since(issuedAt) > v.MaxAge || time.Until(issuedAt) > v.MaxAge:
+		return nil, errors.New("DPoP proof has invalid iat")
+	case p.JWTId == "":
+		return nil, errors.New("DPoP proof has no jti")
+	}
+	if accessToken != "" {
+		hash := sha256.Sum256([]byte(accessToken))
+		ath := base64.RawURLEncoding.EncodeToString(hash[:])
+		if subtle.ConstantTimeCompare([]byte(p.AccessTokenHash), []byte(ath)) != 1 {
+			return nil, errors.New("DPoP proof has invalid ath")
+		}
+	}
+	if v.nonceKey != nil && !v.validNonce(p.Nonce) {
+		return nil, ErrUseNonce
+	}
+	ok, err := v.cache.Claim(ctx, "dpop:"+thumbprint+":"+p.JWTId, issuedAt.Add(v.MaxAge))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("DPoP proof replayed")
+	}
+	return &p, nil
+}
+
+// VerifyRequest verifies the DPoP proof of a request to a resource server that
+// carries an access token bound to the key with thumbprint jkt. The caller
+// gets the access token using AccessToken, and jkt from its cnf claim. uri is
+// the URI of the request as sent by the client.
+func (v *Verifier) VerifyRequest(r *http.Request, uri string, jkt string) (*Proof, error) {
+	proofs := r.Header[http.CanonicalHeaderKey(ProofHeader)]
+	if len(proofs) != 1 {
+		return nil, errors.New("Request must have exactly one DPoP proof")
+	}
+	accessToken := AccessToken(r)
+	if accessToken == "" {
+		return nil, errors.New("Request has no DPoP access token")
+	}
+	p, err := v.Verify(r.Context(), proofs[0], r.Method, uri, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(p.Thumbprint), []byte(jkt)) != 1 {
+		return nil, errors.New("DPoP proof isn't signed with the key of the access token")
+	}
+	return p, nil
+}
+
+// WriteError writes the response to a request to a resource server that
+// failed verification (RFC 9449 section 7.1), including a new nonce if nonces
+// are required.
+func (v *Verifier) WriteError(w http.ResponseWriter, err error) {
+	code := "invalid_dpop_proof"
+	if err == ErrUseNonce {
+		code = "use_dpop_nonce"
+	}
+	if nonce := v.Nonce(); nonce != "" {
+		w.Header().Set(NonceHeader, nonce)
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+		`DPoP error="%s", error_description="%s", algs="ES256 ES384 ES512"`,
+		code, strings.Replace(err.Error(), `"`, "'", -1),
+	))
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// AccessToken returns the DPoP-bound access token in the Authorization header
+// of a request, if any.
+func AccessToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 5 && strings.EqualFold(auth[:5], "DPoP ") {
+		return auth[5:]
+	}
+	return ""
+}
+
+// sameURI returns true if the URIs are equal, ignoring their query and
+// fragment (RFC 9449 section 4.3).
+func sameURI(htu string, uri string) bool {
+	u1, err1 := url.Parse(htu)
+	u2, err2 := url.Parse(uri)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return strings.EqualFold(u1.Scheme, u2.Scheme) && strings.EqualFold(u1.Host, u2.Host) &&
+		u1.EscapedPath() == u2.EscapedPath()
+}
+
+// memoryCache is an in-memory ReplayCache.
+type memoryCache struct {
+	mutex     sync.Mutex
+	entries   map[string]time.Time
+	nextSweep time.Time
+}
+
+// NewMemoryCache returns a ReplayCache that keeps used proofs in memory.
+func NewMemoryCache() ReplayCache {
+	return &memoryCache{entries: make(map[string]time.Time)}
+}
+
+// Claim implements ReplayCache.
+func (c *memoryCache) Claim(ctx context.Context, key string, expires time.Time) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if now.After(c.nextSweep) {
+		for k, e := range c.entries {
+			if now.After(e) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextSweep = now.Add(time.Minute)
+	}
+	if e, ok := c.entries[key]; ok && now.Before(e) {
+		return false, nil
+	}
+	c.entries[key] = expires
+	return true, nil
+}
@@ -0,0 +1,124 @@
+package dpop
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amsterdam/authz/jose"
+)
+
+var testKeys, _ = jose.LoadJWKSet([]byte(`{ "keys": [
+	{ "kty": "EC", "key_ops": ["sign"], "kid": "1", "crv": "P-256", "x": "g9IULlEyYGp3i2IZ1STiuDQ0rcrt3r3o-01f7_wOM_o=", "y": "8QfpzSUvN4UAI4PliUXpeOv8RwLU8P8qLXqhTCc4w1M=", "d": "dIz2ALAunAxB5ajQVx3fAdbttNX4WazEyvXLyi6BFBc=" }
+]}`))
+
+var testJTI int
+
+func testProof(t *testing.T, claims map[string]interface{}) string {
+	testJTI++
+	p := map[string]interface{}{
+		"jti": strconv.Itoa(testJTI), "htm": "GET", "htu": "https://api/resource",
+		"iat": time.Now().Unix(),
+	}
+	for k, v := range claims {
+		p[k] = v
+	}
+	proof, err := testKeys.EncodeEmbedded("1", proofType, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+func TestVerify(t *testing.T) {
+	v := NewVerifier(nil)
+	ctx := context.Background()
+	jkt, _ := testKeys.Thumbprint("1")
+	valid := testProof(t, map[string]interface{}{"htu": "https://API/resource?query"})
+	p, err := v.Verify(ctx, valid, "GET", "https://api/resource", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Thumbprint != jkt {
+		t.Errorf("Unexpected thumbprint: %s != %s", p.Thumbprint, jkt)
+	}
+	if _, err := v.Verify(ctx, valid, "GET", "https://api/resource", ""); err == nil {
+		t.Error("Replayed proof accepted")
+	}
+	for description, claims := range map[string]map[string]interface{}{
+		"wrong method": {"htm": "POST"},
+		"wrong uri":    {"htu": "https://api/other"},
+		"old proof":    {"iat": time.Now().Add(-2 * time.Minute).Unix()},
+		"future proof": {"iat": time.Now().Add(2 * time.Minute).Unix()},
+		"no jti":       {"jti": ""},
+	} {
+		if _, err := v.Verify(ctx, testProof(t, claims), "GET", "https://api/resource", ""); err == nil {
+			t.Errorf("%s: proof accepted", description)
+		}
+	}
+	// Access token hash
+	hash := sha256.Sum256([]byte("token"))
+	ath := base64.RawURLEncoding.EncodeToString(hash[:])
+	if _, err := v.Verify(ctx, testProof(t, map[string]interface{}{"ath": ath}), "GET", "https://api/resource", "token"); err != nil {
+		t.Error(err)
+	}
+	if _, err := v.Verify(ctx, testProof(t, map[string]interface{}{"ath": ath}), "GET", "https://api/resource", "other"); err == nil {
+		t.Error("Proof for other access token accepted")
+	}
+}
+
+func TestNonces(t *testing.T) {
+	v := NewVerifier(nil)
+	v.RequireNonces([]byte("0123456789abcdef"), time.Minute)
+	ctx := context.Background()
+	if _, err := v.Verify(ctx, testProof(t, nil), "GET", "https://api/resource", ""); err != ErrUseNonce {
+		t.Fatalf("Expected ErrUseNonce, got %v", err)
+	}
+	other := NewVerifier(nil)
+	other.RequireNonces([]byte("fedcba9876543210"), time.Minute)
+	if _, err := v.Verify(ctx, testProof(t, map[string]interface{}{"nonce": other.Nonce()}), "GET", "https://api/resource", ""); err != ErrUseNonce {
+		t.Fatalf("Nonce of other verifier accepted: %v", err)
+	}
+	if _, err := v.Verify(ctx, testProof(t, map[string]interface{}{"nonce": v.Nonce()}), "GET", "https://api/resource", ""); err != nil {
+		t.Fatal(err)
+	}
+	v.nonceLifetime = 0
+	if _, err := v.Verify(ctx, testProof(t, map[string]interface{}{"nonce": v.Nonce()}), "GET", "https://api/resource", ""); err != ErrUseNonce {
+		t.Fatalf("Expired nonce accepted: %v", err)
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	v := NewVerifier(nil)
+	v.RequireNonces([]byte("0123456789abcdef"), time.Minute)
+	jkt, _ := testKeys.Thumbprint("1")
+	hash := sha256.Sum256([]byte("token"))
+	ath := base64.RawURLEncoding.EncodeToString(hash[:])
+	r := httptest.NewRequest("GET", "/resource", nil)
+	r.Header.Set("Authorization", "DPoP token")
+	r.Header.Set(ProofHeader, testProof(t, map[string]interface{}{"ath": ath}))
+	_, err := v.VerifyRequest(r, "https://api/resource", jkt)
+	if err != ErrUseNonce {
+		t.Fatalf("Expected ErrUseNonce, got %v", err)
+	}
+	w := httptest.NewRecorder()
+	v.WriteError(w, err)
+	nonce := w.Result().Header.Get(NonceHeader)
+	if w.Result().StatusCode != 401 || nonce == "" ||
+		!strings.HasPrefix(w.Result().Header.Get("WWW-Authenticate"), `DPoP error="use_dpop_nonce"`) {
+		t.Fatalf("Unexpected error response: %v", w.Result().Header)
+	}
+	r.Header.Set(ProofHeader, testProof(t, map[string]interface{}{"ath": ath, "nonce": nonce}))
+	if _, err := v.VerifyRequest(r, "https://api/resource", "other"); err == nil {
+		t.Fatal("Proof signed with other key accepted")
+	}
+	r.Header.Set(ProofHeader, testProof(t, map[string]interface{}{"ath": ath, "nonce": nonce}))
+	if _, err := v.VerifyRequest(r, "https://api/resource", jkt); err != nil {
+		t.Fatal(err)
+	}
+}
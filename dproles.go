@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -40,12 +41,12 @@ func newDatapuntRoles(accountsURL string, apiKey string) (*datapuntRoles, error)
 	return &datapuntRoles{url, apiKey, client}, nil
 }
 
-func (d *datapuntRoles) Get(uid string) ([]string, error) {
+func (d *datapuntRoles) Get(ctx context.Context, uid string) ([]string, error) {
 	accountURL, err := d.accountsURL.Parse(uid)
 	if err != nil {
 		return nil, err
 	}
-	request, err := http.NewRequest("GET", accountURL.String(), nil)
+	request, err := newRequest(ctx, "GET", accountURL.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -109,7 +109,12 @@ func (g *googleIDP) AuthnCallback(r *http.Request) (string, *oauth2.User, error)
 	data.Set("redirect_uri", g.oauth2CallbackURL())
 	data.Set("grant_type", googleGrantType)
 	// Get token
-	resp, err := g.client.PostForm(googleTokenURL, data)
+	req, err := newRequest(r.Context(), "POST", googleTokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := g.client.Do(req)
 	if err != nil {
 		return "", nil, err
 	}
@@ -140,7 +145,7 @@ func (g *googleIDP) AuthnCallback(r *http.Request) (string, *oauth2.User, error)
 		return authzRef, nil, nil
 	}
 	// Get roles
-	roles, err := g.roles.Get(idToken.Email)
+	roles, err := g.roles.Get(r.Context(), idToken.Email)
 	if err != nil {
 		return authzRef, nil, nil
 	}
@@ -3,6 +3,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -61,9 +62,9 @@ func (g *gripAuthzData) idToken() (*gripIDToken, error) {
 	return &idToken, nil
 }
 
-func (g *gripAuthzData) userInfo() (*gripUserInfo, error) {
+func (g *gripAuthzData) userInfo(ctx context.Context) (*gripUserInfo, error) {
 	// Create UserInfo request
-	req, err := http.NewRequest("GET", g.gripUserInfoURL, nil)
+	req, err := newRequest(ctx, "GET", g.gripUserInfoURL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -275,14 +276,14 @@ func (g *gripIDP) AuthnCallback(r *http.Request) (string, *oauth2.User, error) {
 	}
 
 	// Get the ID token
-	authzData, err := g.authzData(authzCode[0])
+	authzData, err := g.authzData(r.Context(), authzCode[0])
 	if err != nil {
 		logger.Warnf("Error getting authorization data: %v", err)
 		return authzRef, nil, nil
 	}
 
 	// Get UserInfo
-	userInfo, err := authzData.userInfo()
+	userInfo, err := authzData.userInfo(r.Context())
 	if err != nil {
 		logger.Warnf("Error getting authorization userinfo: %v", err)
 		return authzRef, nil, nil
@@ -363,7 +364,7 @@ func (g *gripIDP) AuthnCallback(r *http.Request) (string, *oauth2.User, error) {
 	 */
 
 	// Get roles
-	roles, err := g.roles.Get(strings.ToLower(userInfo.Email))
+	roles, err := g.roles.Get(r.Context(), strings.ToLower(userInfo.Email))
 	if err != nil {
 		// Always return SIG_ADM for Grip IDP
 		roles = []string{"SIG_ADM"}
@@ -376,7 +377,7 @@ func (g *gripIDP) AuthnCallback(r *http.Request) (string, *oauth2.User, error) {
 	return authzRef, &oauth2.User{UID: userInfo.Email, Data: roles}, nil
 }
 
-func (g *gripIDP) authzData(authzCode string) (*gripAuthzData, error) {
+func (g *gripIDP) authzData(ctx context.Context, authzCode string) (*gripAuthzData, error) {
 	// Create context logger
 	logFields := log.Fields{
 		"type": "authzData request",
@@ -388,8 +389,8 @@ func (g *gripIDP) authzData(authzCode string) (*gripAuthzData, error) {
 	data.Set("code", authzCode)
 	data.Set("redirect_uri", g.oauth2CallbackURL())
 	data.Set("grant_type", gripGrantType)
-	req, err := http.NewRequest(
-		"POST", g.tokenURL, strings.NewReader(data.Encode()),
+	req, err := newRequest(
+		ctx, "POST", g.tokenURL, strings.NewReader(data.Encode()),
 	)
 	if err != nil {
 		logger.Warnf("Error NewRequest")
@@ -0,0 +1,91 @@
+package jose
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// embeddedHeader is the header of a JWT that is signed using the public key
+// in its jwk header parameter (RFC 7515 section 4.1.3).
+type embeddedHeader struct {
+	Alg string          `json:"alg"`
+	Typ string          `json:"typ,omitempty"`
+	JWK json.RawMessage `json:"jwk"`
+}
+
+// EncodeEmbedded creates a JWT with the given type from the given data, signed
+// using the EC key at the given key id, with the public key in its header. This
+// is how DPoP proofs are created (RFC 9449 section 4.2).
+func (s *JWKSet) EncodeEmbedded(kid string, typ string, v interface{}) (string, error) {
+	signer, ok := s.signers[kid].(*jwkECPriv)
+	if !ok {
+		return "", fmt.Errorf("Cannot use kid %v to encode with embedded key", kid)
+	}
+	l := (signer.PublicKey.Curve.Params().BitSize + 7) / 8
+	jwk, err := json.Marshal(map[string]string{
+		"kty": "EC",
+		"crv": signer.Curve,
+		"x":   base64.RawURLEncoding.EncodeToString(fixedLengthBytes(signer.PublicKey.X.Bytes(), l)),
+		"y":   base64.RawURLEncoding.EncodeToString(fixedLengthBytes(signer.PublicKey.Y.Bytes(), l)),
+	})
+	if err != nil {
+		return "", err
+	}
+	headerJSON, err := json.Marshal(&embeddedHeader{Alg: signer.Algorithm(), Typ: typ, JWK: jwk})
+	if err != nil {
+		return "", err
+	}
+	payloadJSON, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	b64header := base64.RawURLEncoding.EncodeToString(headerJSON)
+	b64payload := base64.RawURLEncoding.EncodeToString(payloadJSON)
+	digest, err := signer.Sign([]byte(fmt.Sprintf("%s.%s", b64header, b64payload)))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.%s.%s", b64header, b64payload, base64.RawURLEncoding.EncodeToString(digest)), nil
+}
+
+// DecodeEmbedded verifies a JWT using the public key in its header and decodes
+// it into v. It returns the type of the JWT and the RFC 7638 thumbprint of the
+// key, which identifies the signer. Only EC keys are supported.
+func DecodeEmbedded(data string, v interface{}) (typ string, thumbprint string, err error) {
+	parts := strings.Split(data, ".")
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("JWT shoud have 3 parts, has %d: ", len(parts))
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", err
+	}
+	var jwtHeader embeddedHeader
+	if err := json.Unmarshal(rawHeader, &jwtHeader); err != nil {
+		return "", "", err
+	}
+	var params struct {
+		KeyType string `json:"kty"`
+		D       string `json:"d"`
+	}
+	if err := json.Unmarshal(jwtHeader.JWK, &params); err != nil {
+		return "", "", errors.New("JWT has no valid jwk header")
+	}
+	if params.KeyType != "EC" || params.D != "" {
+		return "", "", errors.New("JWT jwk header must hold a public EC key")
+	}
+	jwk, err := unmarshalJWKECPub(jwtHeader.JWK)
+	if err != nil {
+		return "", "", err
+	}
+	if jwtHeader.Alg != jwk.Algorithm() || !jwk.Verify(parts[0], parts[1], parts[2]) {
+		return "", "", errors.New("Couldn't verify JWT")
+	}
+	if err := decodePayload(parts[1], v); err != nil {
+		return "", "", err
+	}
+	return jwtHeader.Typ, jwk.thumbprint(), nil
+}
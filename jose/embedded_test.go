@@ -0,0 +1,52 @@
+package jose
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeEmbedded(t *testing.T) {
+	jwks, err := LoadJWKSet([]byte(`
+		{ "keys": [
+			{ "kty": "EC", "key_ops": ["sign"], "kid": "1", "crv": "P-256", "x": "g9IULlEyYGp3i2IZ1STiuDQ0rcrt3r3o-01f7_wOM_o=", "y": "8QfpzSUvN4UAI4PliUXpeOv8RwLU8P8qLXqhTCc4w1M=", "d": "dIz2ALAunAxB5ajQVx3fAdbttNX4WazEyvXLyi6BFBc=" },
+			{ "kty": "oct", "key_ops": ["sign"], "kid": "2", "alg": "HS256", "k": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4=" }
+		]}
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := TestToken{Stringvalue: "test", Intvalue: 1, Listvalue: []int{0, 1}}
+	jwt, err := jwks.EncodeEmbedded("1", "dpop+jwt", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded TestToken
+	typ, thumbprint, err := DecodeEmbedded(jwt, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, _ := jwks.Thumbprint("1"); thumbprint != expected {
+		t.Errorf("Unexpected thumbprint: %s != %s", thumbprint, expected)
+	}
+	if typ != "dpop+jwt" || !reflect.DeepEqual(data, decoded) {
+		t.Errorf("Unexpected JWT: %s %+v", typ, decoded)
+	}
+	// Tampered payload
+	parts := strings.Split(jwt, ".")
+	other, err := jwks.EncodeEmbedded("1", "dpop+jwt", TestToken{Stringvalue: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2]
+	if _, _, err := DecodeEmbedded(tampered, &decoded); err == nil {
+		t.Error("Decoded tampered JWT")
+	}
+	// Symmetric keys can't be embedded
+	if _, err := jwks.EncodeEmbedded("2", "dpop+jwt", data); err == nil {
+		t.Error("Encoded JWT with embedded symmetric key")
+	}
+	if _, _, err := DecodeEmbedded(encode(t, data, jwks, "2"), &decoded); err == nil {
+		t.Error("Decoded JWT without embedded key")
+	}
+}
@@ -1,6 +1,7 @@
 package jose
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/hmac"
@@ -21,6 +22,7 @@ import (
 type header struct {
 	Alg string `json:"alg"`
 	Kid string `json:"kid"`
+	Typ string `json:"typ,omitempty"`
 }
 
 // jwks represents a JSON Web Key Set (RFC 7517 section 5). Used for unmarshalling.
@@ -28,24 +30,37 @@ type jwks struct {
 	Keys []json.RawMessage `json:"keys"`
 }
 
+// Decoder verifies JWTs and decodes their payload. It is implemented by
+// JWKSet and RemoteJWKSet.
+type Decoder interface {
+	Decode(data string, v interface{}, options ...DecodeOption) error
+}
+
 type jwtVerifier interface {
 	Algorithm() string
 	Verify(b64header, b64payload, b64digest string) bool
 }
 
-type jwtSigner interface {
-	jwtVerifier
+// Signer creates JWS signatures for a key in a JWKSet. Signers can be added
+// to a JWKSet using AddSigner, which allows signing to be delegated to an
+// external service such as a KMS, so the private key doesn't have to be in
+// memory.
+type Signer interface {
+	// Algorithm returns the JWS algorithm (alg) of the signatures.
+	Algorithm() string
+	// Sign returns the signature over the JWS signing input msg.
 	Sign(msg []byte) ([]byte, error)
 }
 
 // JWKSet manages keys and allows encoding and decoding JWTs.
 type JWKSet struct {
-	signers   map[string]jwtSigner
+	signers   map[string]Signer
 	verifiers map[string]jwtVerifier
 	kids      []string
 }
 
-// LoadJWKSet creates a JWKSet using the given json-encoded data
+// LoadJWKSet creates a JWKSet using the given json-encoded data. Keys without a
+// key id get their RFC 7638 thumbprint as key id.
 //EXPORT LoadJWKSet
 func LoadJWKSet(data []byte) (*JWKSet, error) {
 	var keyset jwks
@@ -53,7 +68,7 @@ func LoadJWKSet(data []byte) (*JWKSet, error) {
 		return nil, err
 	}
 	jwkSet := &JWKSet{
-		signers:   make(map[string]jwtSigner),
+		signers:   make(map[string]Signer),
 		verifiers: make(map[string]jwtVerifier),
 	}
 	for i, key := range keyset.Keys {
@@ -64,12 +79,21 @@ func LoadJWKSet(data []byte) (*JWKSet, error) {
 		if len(jwkParams.KeyOps) == 0 {
 			return nil, fmt.Errorf("Configuration error: key (kid: %s) has no key_ops", jwkParams.KeyID)
 		}
+		// Derive the key id from the key's thumbprint if it has none
+		keyID := jwkParams.KeyID
+		if keyID == "" {
+			thumbprint, err := Thumbprint(key)
+			if err != nil {
+				return nil, fmt.Errorf("Can't use key at index %d: %v", i, err)
+			}
+			keyID = thumbprint
+		}
 		for _, kid := range jwkSet.kids {
-			if kid == jwkParams.KeyID {
+			if kid == keyID {
 				return nil, fmt.Errorf("Duplicate key ID in JKWSet: %s", kid)
 			}
 		}
-		jwkSet.kids = append(jwkSet.kids, jwkParams.KeyID)
+		jwkSet.kids = append(jwkSet.kids, keyID)
 		if jwkParams.KeyType == "EC" {
 			for _, op := range jwkParams.KeyOps {
 				if op == "sign" {
@@ -77,13 +101,15 @@ func LoadJWKSet(data []byte) (*JWKSet, error) {
 					if err != nil {
 						return nil, err
 					}
-					jwkSet.signers[jwk.KeyID] = jwk
+					jwk.KeyID = keyID
+					jwkSet.signers[keyID] = jwk
 				} else if op == "verify" {
 					jwk, err := unmarshalJWKECPub(key)
 					if err != nil {
 						return nil, err
 					}
-					jwkSet.verifiers[jwk.KeyID] = jwk
+					jwk.KeyID = keyID
+					jwkSet.verifiers[keyID] = jwk
 				} else {
 					return nil, fmt.Errorf("Unsupported key operation: %s", op)
 				}
@@ -93,17 +119,22 @@ func LoadJWKSet(data []byte) (*JWKSet, error) {
 			if err != nil {
 				return nil, err
 			}
+			jwk.KeyID = keyID
 			for _, op := range jwkParams.KeyOps {
 				if op == "sign" {
-					jwkSet.signers[jwk.KeyID] = jwk
+					jwkSet.signers[keyID] = jwk
 				} else if op == "verify" {
-					jwkSet.verifiers[jwk.KeyID] = jwk
+					jwkSet.verifiers[keyID] = jwk
 				}
 			}
 		} else {
 			return nil, fmt.Errorf("Can't use key at index %d (%s)", i, key)
 		}
 	}
+	// The same key shouldn't be configured under multiple key ids
+	if err := jwkSet.checkUniqueKeys(); err != nil {
+		return nil, err
+	}
 	return jwkSet, nil
 }
 
@@ -112,6 +143,87 @@ func (s *JWKSet) KeyIDs() []string {
 	return s.kids
 }
 
+// CanSign returns true if the key with the given key id can be used to encode.
+func (s *JWKSet) CanSign(kid string) bool {
+	_, ok := s.signers[kid]
+	return ok
+}
+
+// AddSigner adds an (external) signer for the given key id. If the set holds
+// a verification key with this id, the signer must use the same algorithm.
+// Otherwise the signer must implement crypto.Signer's Public() method,
+// returning the ECDSA public key that will be used for verification.
+func (s *JWKSet) AddSigner(kid string, signer Signer) error {
+	if s.CanSign(kid) {
+		return fmt.Errorf("Duplicate signer for kid %s", kid)
+	}
+	if verifier, ok := s.verifiers[kid]; ok {
+		if verifier.Algorithm() != signer.Algorithm() {
+			return fmt.Errorf(
+				"Signer algorithm %s doesn't match key %s (%s)", signer.Algorithm(),
+				kid, verifier.Algorithm(),
+			)
+		}
+		s.signers[kid] = signer
+		return nil
+	}
+	for _, k := range s.kids {
+		if k == kid {
+			return fmt.Errorf("Duplicate key ID in JKWSet: %s", kid)
+		}
+	}
+	pubSigner, ok := signer.(interface {
+		Public() crypto.PublicKey
+	})
+	if !ok {
+		return fmt.Errorf("No verification key for signer %s", kid)
+	}
+	pubKey, ok := pubSigner.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("Unsupported public key type for signer %s", kid)
+	}
+	verifier, err := newJWKECPub(kid, pubKey)
+	if err != nil {
+		return err
+	}
+	if verifier.Algorithm() != signer.Algorithm() {
+		return fmt.Errorf(
+			"Signer algorithm %s doesn't match its public key (%s)",
+			signer.Algorithm(), verifier.Algorithm(),
+		)
+	}
+	s.kids = append(s.kids, kid)
+	s.verifiers[kid] = verifier
+	s.signers[kid] = signer
+	return nil
+}
+
+// AddSymmetricKey adds a symmetric key for the given HMAC algorithm (HS256,
+// HS384 or HS512) to the set, for signing and verification.
+func (s *JWKSet) AddSymmetricKey(kid string, alg string, key []byte) error {
+	for _, k := range s.kids {
+		if k == kid {
+			return fmt.Errorf("Duplicate key ID in JKWSet: %s", kid)
+		}
+	}
+	jwk := &jwkSymmetric{Alg: alg, Key: key}
+	jwk.KeyID = kid
+	switch alg {
+	case "HS256":
+		jwk.HashFunc = sha256.New
+	case "HS384":
+		jwk.HashFunc = sha512.New384
+	case "HS512":
+		jwk.HashFunc = sha512.New
+	default:
+		return fmt.Errorf("Invalid Alg for symmetric key: %s", alg)
+	}
+	s.kids = append(s.kids, kid)
+	s.signers[kid] = jwk
+	s.verifiers[kid] = jwk
+	return nil
+}
+
 // VerifiersJSON returns the JSON encoded JWK set containing all asymmetric verifiers.
 func (s *JWKSet) VerifiersJSON() []byte {
 	var keys []json.RawMessage
@@ -142,69 +254,158 @@ func (s *JWKSet) VerifiersJSON() []byte {
 
 // Encode creates a JWT from the given data, signed using the key at the given key id.
 func (s *JWKSet) Encode(kid string, v interface{}) (string, error) {
-	signer, ok := s.signers[kid]
-	if !ok {
-		return "", fmt.Errorf("Cannot use kid %v to encode", kid)
-	}
-	jwtHeader := &header{Alg: signer.Algorithm(), Kid: kid}
-	headerJSON, err := json.Marshal(jwtHeader)
-	if err != nil {
-		return "", err
-	}
+	return s.EncodeTyped(kid, "", v)
+}
+
+// EncodeTyped creates a JWT with the given typ header (RFC 7519 section 5.1),
+// such as "at+jwt", from the given data, signed using the key at the given
+// key id.
+func (s *JWKSet) EncodeTyped(kid string, typ string, v interface{}) (string, error) {
 	payloadJSON, err := json.Marshal(v)
 	if err != nil {
 		return "", err
 	}
-	b64header := base64.RawURLEncoding.EncodeToString(headerJSON)
 	b64payload := base64.RawURLEncoding.EncodeToString(payloadJSON)
-	digest, err := signer.Sign([]byte(fmt.Sprintf("%s.%s", b64header, b64payload)))
+	b64header, b64digest, err := s.sign(kid, typ, b64payload)
 	if err != nil {
 		return "", err
 	}
-	b64digest := base64.RawURLEncoding.EncodeToString(digest)
 	return fmt.Sprintf("%s.%s.%s", b64header, b64payload, b64digest), nil
 }
 
-// Decode verifies the given data (JWT) and decodes it into v.
-func (s *JWKSet) Decode(data string, v interface{}) error {
-	// split the JWT
-	parts := strings.Split(data, ".")
-	if len(parts) != 3 {
-		return fmt.Errorf("JWT shoud have 3 parts, has %d: ", len(parts))
+// Decode verifies the given data (JWT) and decodes it into v. The data may use
+// the compact or the JSON serialization (see EncodeMulti).
+func (s *JWKSet) Decode(data string, v interface{}, options ...DecodeOption) error {
+	var opts decodeOptions
+	for _, option := range options {
+		option(&opts)
 	}
-	b64header, b64payload, b64digest := parts[0], parts[1], parts[2]
-	// decode the header
-	rawHeader, err := base64.RawURLEncoding.DecodeString(b64header)
+	if isJSONSerialization(data) {
+		return s.decodeJSON(data, opts.detachedPayload, v)
+	}
+	if opts.detachedPayload != nil {
+		return s.decodeCompactDetached(data, *opts.detachedPayload, v)
+	}
+	// split the JWT and decode the header
+	parts, jwtHeader, err := splitJWT(data)
 	if err != nil {
 		return err
 	}
-	jwtHeader := header{}
-	if err = json.Unmarshal(rawHeader, &jwtHeader); err != nil {
+	b64header, b64payload, b64digest := parts[0], parts[1], parts[2]
+	if err := s.verify(jwtHeader.Kid, b64header, b64payload, b64digest); err != nil {
+		return err
+	}
+	return decodePayload(b64payload, v)
+}
+
+// ParseHeader returns the algorithm and key id in the header of the given JWT,
+// without verifying it.
+func ParseHeader(data string) (alg string, kid string, err error) {
+	_, jwtHeader, err := splitJWT(data)
+	if err != nil {
+		return "", "", err
+	}
+	return jwtHeader.Alg, jwtHeader.Kid, nil
+}
+
+// ParseType returns the typ in the header of the given JWT, without verifying
+// it.
+func ParseType(data string) (string, error) {
+	_, jwtHeader, err := splitJWT(data)
+	if err != nil {
+		return "", err
+	}
+	return jwtHeader.Typ, nil
+}
+
+// DecodeUnverified decodes the payload of the given JWT into v without
+// verifying its signature. Use it only to find out which key to verify the
+// JWT with, e.g. using the issuer, and don't trust the payload.
+func DecodeUnverified(data string, v interface{}) error {
+	parts, _, err := splitJWT(data)
+	if err != nil {
 		return err
 	}
+	return decodePayload(parts[1], v)
+}
+
+// sign creates the encoded protected header with the given typ, if any, and
+// signature for the encoded payload, using the key at the given key id.
+func (s *JWKSet) sign(kid string, typ string, b64payload string) (string, string, error) {
+	signer, ok := s.signers[kid]
+	if !ok {
+		return "", "", fmt.Errorf("Cannot use kid %v to encode", kid)
+	}
+	jwtHeader := &header{Alg: signer.Algorithm(), Kid: kid, Typ: typ}
+	headerJSON, err := json.Marshal(jwtHeader)
+	if err != nil {
+		return "", "", err
+	}
+	b64header := base64.RawURLEncoding.EncodeToString(headerJSON)
+	digest, err := signer.Sign([]byte(fmt.Sprintf("%s.%s", b64header, b64payload)))
+	if err != nil {
+		return "", "", err
+	}
+	return b64header, base64.RawURLEncoding.EncodeToString(digest), nil
+}
+
+// verify verifies the signature using the key at the given key id.
+func (s *JWKSet) verify(kid, b64header, b64payload, b64digest string) error {
 	// Grab the correct verifier
-	verifier, ok := s.verifiers[jwtHeader.Kid]
+	verifier, ok := s.verifiers[kid]
 	if !ok {
-		return fmt.Errorf("No key with ID %v available in keyset for verification", jwtHeader.Kid)
+		return fmt.Errorf("No key with ID %v available in keyset for verification", kid)
 	}
 	// Verify
 	if ok := verifier.Verify(b64header, b64payload, b64digest); !ok {
 		return errors.New("Couldn't verify JWT")
 	}
-	// Decode payload into v
+	return nil
+}
+
+// decodePayload decodes the encoded payload into v.
+func decodePayload(b64payload string, v interface{}) error {
 	rawPayload, err := base64.RawURLEncoding.DecodeString(b64payload)
 	if err != nil {
 		return err
 	}
-	if err := json.Unmarshal(rawPayload, v); err != nil {
-		return err
+	return json.Unmarshal(rawPayload, v)
+}
+
+// canVerify returns true if this set holds a verifier for the given key id.
+func (s *JWKSet) canVerify(kid string) bool {
+	_, ok := s.verifiers[kid]
+	return ok
+}
+
+// splitJWT splits a compact serialized JWT in its three parts and decodes its
+// header.
+func splitJWT(data string) ([]string, *header, error) {
+	parts := strings.Split(data, ".")
+	if len(parts) != 3 {
+		return nil, nil, fmt.Errorf("JWT shoud have 3 parts, has %d: ", len(parts))
 	}
-	return nil
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	jwtHeader := &header{}
+	if err = json.Unmarshal(rawHeader, jwtHeader); err != nil {
+		return nil, nil, err
+	}
+	return parts, jwtHeader, nil
+}
+
+// decodeBase64URL decodes base64url data with or without padding. RFC 7515
+// requires padding to be omitted, but keys in our configuration have it.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
 }
 
 // jwkData holds data common to all JWKs (RFC 7517 section 4)
 type jwkData struct {
 	KeyType string   `json:"kty"`
+	Use     string   `json:"use,omitempty"`
 	KeyOps  []string `json:"key_ops"`
 	KeyID   string   `json:"kid"`
 }
@@ -215,6 +416,8 @@ type jwkECPub struct {
 	Curve     string                `json:"crv"`
 	X         string                `json:"x"`
 	Y         string                `json:"y"`
+	X5C       []string              `json:"x5c,omitempty"`
+	X5TS256   string                `json:"x5t#S256,omitempty"`
 	PublicKey *ecdsa.PublicKey      `json:"-"`
 	HashFunc  func() hash.Hash      `json:"-"`
 	CurveFunc func() elliptic.Curve `json:"-"`
@@ -235,6 +438,9 @@ func unmarshalJWKECPub(data []byte) (*jwkECPub, error) {
 		return nil, err
 	}
 	jwk.PublicKey = pk
+	if err := jwk.checkCertificates(); err != nil {
+		return nil, err
+	}
 	return &jwk, nil
 }
 
@@ -290,11 +496,11 @@ func (j *jwkECPub) Verify(b64header, b64payload, b64digest string) bool {
 }
 
 func (j *jwkECPub) publicKey() (*ecdsa.PublicKey, error) {
-	bx, err := base64.URLEncoding.DecodeString(j.X)
+	bx, err := decodeBase64URL(j.X)
 	if err != nil {
 		return nil, err
 	}
-	by, err := base64.URLEncoding.DecodeString(j.Y)
+	by, err := decodeBase64URL(j.Y)
 	if err != nil {
 		return nil, err
 	}
@@ -326,6 +532,9 @@ func unmarshalJWKECPriv(data []byte) (*jwkECPriv, error) {
 	}
 	jwk.PrivateKey = pk
 	jwk.PublicKey = &pk.PublicKey
+	if err := jwk.checkCertificates(); err != nil {
+		return nil, err
+	}
 	return &jwk, nil
 }
 
@@ -352,7 +561,7 @@ func (j *jwkECPriv) Sign(msg []byte) ([]byte, error) {
 }
 
 func (j *jwkECPriv) privateKey() (*ecdsa.PrivateKey, error) {
-	bd, err := base64.URLEncoding.DecodeString(j.D)
+	bd, err := decodeBase64URL(j.D)
 	if err != nil {
 		return nil, err
 	}
@@ -391,7 +600,7 @@ func unmarshalJWKSymmetric(data []byte) (*jwkSymmetric, error) {
 	default:
 		return nil, fmt.Errorf("Invalid Alg for symmetric key: %s", jwk.Alg)
 	}
-	k, err := base64.URLEncoding.DecodeString(jwk.K)
+	k, err := decodeBase64URL(jwk.K)
 	if err != nil {
 		return nil, err
 	}
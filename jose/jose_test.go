@@ -15,8 +15,8 @@ func TestJWKHMAC(t *testing.T) {
 	var jwkSet = []byte(`
 		{ "keys": [
 			{ "kty": "oct", "use": "sig", "key_ops": ["sign", "verify"], "kid": "1", "alg": "HS256", "k": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4=" },
-			{ "kty": "oct", "use": "sig", "key_ops": ["sign", "verify"], "kid": "2", "alg": "HS384", "k": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4=" },
-			{ "kty": "oct", "use": "sig", "key_ops": ["sign", "verify"], "kid": "3", "alg": "HS512", "k": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4=" }
+			{ "kty": "oct", "use": "sig", "key_ops": ["sign", "verify"], "kid": "2", "alg": "HS384", "k": "ank6KA34vv24HZLXlChVs85NEGlpg2sbqNmR_BcgyJU=" },
+			{ "kty": "oct", "use": "sig", "key_ops": ["sign", "verify"], "kid": "3", "alg": "HS512", "k": "9GJquUJf57a9sev-u8-PoYlIezIPqI_vGpIaiu4zyZk=" }
 		]}
 	`)
 	jwks, err := LoadJWKSet(jwkSet)
@@ -77,7 +77,7 @@ func encode(t *testing.T, data interface{}, jwks *JWKSet, kid string) string {
 	return token
 }
 
-func decode(t *testing.T, token string, v interface{}, jwks *JWKSet) {
+func decode(t *testing.T, token string, v interface{}, jwks Decoder) {
 	if err := jwks.Decode(token, v); err != nil {
 		t.Fatal(err)
 	}
@@ -104,3 +104,41 @@ func TestSetWithInvalidJWK(t *testing.T) {
 		t.Fatal("Should not succeed")
 	}
 }
+
+func TestSymmetricKeyAndHeader(t *testing.T) {
+	jwks := NewJWKSet()
+	if err := jwks.AddSymmetricKey("", "HS256", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := jwks.AddSymmetricKey("", "HS384", []byte("other")); err == nil {
+		t.Fatal("Added duplicate key id")
+	}
+	if err := jwks.AddSymmetricKey("1", "none", []byte("secret")); err == nil {
+		t.Fatal("Added key with invalid algorithm")
+	}
+	data := TestToken{Stringvalue: "test"}
+	token := encode(t, data, jwks, "")
+	if alg, kid, err := ParseHeader(token); err != nil || alg != "HS256" || kid != "" {
+		t.Fatalf("Unexpected header: %s %s %v", alg, kid, err)
+	}
+	if typ, err := ParseType(token); err != nil || typ != "" {
+		t.Fatalf("Unexpected typ: %s %v", typ, err)
+	}
+	typed, err := jwks.EncodeTyped("", "at+jwt", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ, err := ParseType(typed); err != nil || typ != "at+jwt" {
+		t.Fatalf("Unexpected typ: %s %v", typ, err)
+	}
+	var unverified, decoded TestToken
+	if err := DecodeUnverified(token, &unverified); err != nil || unverified.Stringvalue != "test" {
+		t.Fatalf("Unexpected payload: %v %v", unverified, err)
+	}
+	decode(t, token, &decoded, jwks)
+	other := NewJWKSet()
+	other.AddSymmetricKey("", "HS256", []byte("wrong"))
+	if err := other.Decode(token, &decoded); err == nil {
+		t.Fatal("Decoded token using the wrong key")
+	}
+}
@@ -0,0 +1,202 @@
+package jose
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// jwsJSON is a JWS using the general or flattened JSON serialization (RFC 7515
+// section 7.2). A nil payload means the payload is detached.
+type jwsJSON struct {
+	Payload    *string        `json:"payload,omitempty"`
+	Signatures []jwsSignature `json:"signatures,omitempty"`
+	jwsSignature
+}
+
+// jwsSignature is one of the signatures of a JWS in JSON serialization.
+type jwsSignature struct {
+	Protected string  `json:"protected,omitempty"`
+	Header    *header `json:"header,omitempty"`
+	Signature string  `json:"signature,omitempty"`
+}
+
+// EncodeOption configures EncodeMulti.
+type EncodeOption func(*encodeOptions)
+
+type encodeOptions struct {
+	detached bool
+}
+
+// Detached leaves the payload out of the JWS (RFC 7515 appendix F). The JSON
+// encoding of the data, as returned by json.Marshal, must be given to Decode
+// using DetachedPayload.
+func Detached() EncodeOption {
+	return func(o *encodeOptions) {
+		o.detached = true
+	}
+}
+
+// DecodeOption configures Decode.
+type DecodeOption func(*decodeOptions)
+
+type decodeOptions struct {
+	// detachedPayload is the base64url encoded detached payload, if any
+	detachedPayload *string
+}
+
+// DetachedPayload verifies a JWS with a detached payload (RFC 7515 appendix
+// F) using the given payload. The JWS may use the compact serialization, with
+// an empty payload part, or the JSON serialization without payload.
+func DetachedPayload(payload []byte) DecodeOption {
+	b64payload := base64.RawURLEncoding.EncodeToString(payload)
+	return func(o *decodeOptions) {
+		o.detachedPayload = &b64payload
+	}
+}
+
+// EncodeMulti creates a JWS from the given data using the general JSON
+// serialization, with one signature per given key id. This allows a token to
+// be verified by parties that each know only one of the keys, for example
+// while migrating to another algorithm.
+func (s *JWKSet) EncodeMulti(kids []string, v interface{}, options ...EncodeOption) (string, error) {
+	var opts encodeOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	payloadJSON, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	b64payload := base64.RawURLEncoding.EncodeToString(payloadJSON)
+	return s.encodeJSON(kids, b64payload, !opts.detached)
+}
+
+func (s *JWKSet) encodeJSON(kids []string, b64payload string, includePayload bool) (string, error) {
+	if len(kids) == 0 {
+		return "", errors.New("Need at least one kid to encode")
+	}
+	jws := &jwsJSON{}
+	if includePayload {
+		jws.Payload = &b64payload
+	}
+	for _, kid := range kids {
+		b64header, b64digest, err := s.sign(kid, "", b64payload)
+		if err != nil {
+			return "", err
+		}
+		jws.Signatures = append(jws.Signatures, jwsSignature{
+			Protected: b64header, Signature: b64digest,
+		})
+	}
+	encoded, err := json.Marshal(jws)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// decodeCompactDetached verifies a JWS in compact serialization with an empty
+// payload part, using the given detached payload, and decodes it into v.
+func (s *JWKSet) decodeCompactDetached(data string, b64payload string, v interface{}) error {
+	parts, jwtHeader, err := splitJWT(data)
+	if err != nil {
+		return err
+	}
+	if parts[1] != "" {
+		return errors.New("JWS payload isn't detached")
+	}
+	if err := s.verify(jwtHeader.Kid, parts[0], b64payload, parts[2]); err != nil {
+		return err
+	}
+	return decodePayload(b64payload, v)
+}
+
+// decodeJSON verifies a JWS in JSON serialization and decodes its payload
+// into v. If detachedPayload is given, the JWS must not contain a payload. The
+// JWS is valid if any of its signatures can be verified.
+func (s *JWKSet) decodeJSON(data string, detachedPayload *string, v interface{}) error {
+	var jws jwsJSON
+	if err := json.Unmarshal([]byte(data), &jws); err != nil {
+		return err
+	}
+	if detachedPayload != nil {
+		if jws.Payload != nil && *jws.Payload != "" {
+			return errors.New("JWS payload isn't detached")
+		}
+		jws.Payload = detachedPayload
+	} else if jws.Payload == nil {
+		return errors.New("JWS has a detached payload")
+	}
+	signatures := jws.Signatures
+	if len(signatures) == 0 && jws.Signature != "" {
+		// flattened serialization
+		signatures = []jwsSignature{jws.jwsSignature}
+	}
+	err := errors.New("JWS has no signatures")
+	for _, sig := range signatures {
+		kid, kidErr := sig.keyID()
+		if kidErr != nil {
+			err = kidErr
+			continue
+		}
+		if err = s.verify(kid, sig.Protected, *jws.Payload, sig.Signature); err == nil {
+			return decodePayload(*jws.Payload, v)
+		}
+	}
+	return err
+}
+
+// keyID returns the key id from the protected or unprotected header.
+func (sig *jwsSignature) keyID() (string, error) {
+	rawHeader, err := base64.RawURLEncoding.DecodeString(sig.Protected)
+	if err != nil {
+		return "", err
+	}
+	var protected header
+	if err := json.Unmarshal(rawHeader, &protected); err != nil {
+		return "", err
+	}
+	if protected.Kid == "" && sig.Header != nil {
+		return sig.Header.Kid, nil
+	}
+	return protected.Kid, nil
+}
+
+// isJSONSerialization returns true if data looks like a JWS in JSON
+// serialization rather than compact serialization.
+func isJSONSerialization(data string) bool {
+	return strings.HasPrefix(strings.TrimSpace(data), "{")
+}
+
+// keyIDs returns the key ids of the signatures of a JWS in any serialization.
+func keyIDs(data string) ([]string, error) {
+	if !isJSONSerialization(data) {
+		_, jwtHeader, err := splitJWT(data)
+		if err != nil {
+			return nil, err
+		}
+		return []string{jwtHeader.Kid}, nil
+	}
+	var jws jwsJSON
+	if err := json.Unmarshal([]byte(data), &jws); err != nil {
+		return nil, err
+	}
+	signatures := jws.Signatures
+	if len(signatures) == 0 {
+		signatures = []jwsSignature{jws.jwsSignature}
+	}
+	var kids []string
+	for _, sig := range signatures {
+		kid, err := sig.keyID()
+		if err != nil {
+			return nil, err
+		}
+		kids = append(kids, kid)
+	}
+	if len(kids) == 0 {
+		return nil, errors.New("JWS has no signatures")
+	}
+	return kids, nil
+}
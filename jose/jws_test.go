@@ -0,0 +1,119 @@
+package jose
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var jwsTestKeys = []byte(`
+	{ "keys": [
+		{ "kty": "oct", "use": "sig", "key_ops": ["sign", "verify"], "kid": "hmac", "alg": "HS256", "k": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4=" },
+		{ "kty": "EC", "use": "sig", "key_ops": ["sign", "verify"], "kid": "ec", "crv": "P-256", "x": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4=", "y": "ank6KA34vv24HZLXlChVs85NEGlpg2sbqNmR_BcgyJU=", "d":"9GJquUJf57a9sev-u8-PoYlIezIPqI_vGpIaiu4zyZk=" }
+	]}
+`)
+
+func TestEncodeMulti(t *testing.T) {
+	jwks, err := LoadJWKSet(jwsTestKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := TestToken{Stringvalue: "multi", Listvalue: []int{1, 2}}
+	token, err := jwks.EncodeMulti([]string{"hmac", "ec"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jws struct {
+		Payload    string            `json:"payload"`
+		Signatures []json.RawMessage `json:"signatures"`
+	}
+	if err := json.Unmarshal([]byte(token), &jws); err != nil {
+		t.Fatal(err)
+	}
+	if jws.Payload == "" || len(jws.Signatures) != 2 {
+		t.Fatalf("Unexpected general JSON serialization: %s", token)
+	}
+	// A party knowing only the EC public key can verify the token
+	ecOnly, err := LoadJWKSet(jwks.VerifiersJSON())
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(ecOnly.verifiers, "hmac")
+	for _, verifier := range []*JWKSet{jwks, ecOnly} {
+		var decoded TestToken
+		decode(t, token, &decoded, verifier)
+		if !reflect.DeepEqual(data, decoded) {
+			t.Fatalf("Decoded token not equal to original: %v != %v", decoded, data)
+		}
+	}
+	// Tampered signatures should not verify
+	tampered := strings.Replace(token, jws.Payload, jws.Payload[:len(jws.Payload)-2]+"fQ", 1)
+	var decoded TestToken
+	if err := jwks.Decode(tampered, &decoded); err == nil {
+		t.Fatal("Tampered token should not verify")
+	}
+	if _, err := jwks.EncodeMulti(nil, data); err == nil {
+		t.Fatal("Encoding without key ids should not succeed")
+	}
+}
+
+func TestDecodeFlattened(t *testing.T) {
+	jwks, err := LoadJWKSet(jwsTestKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact := encode(t, TestToken{Intvalue: 7}, jwks, "ec")
+	parts := strings.Split(compact, ".")
+	flattened := `{"payload":"` + parts[1] + `","protected":"` + parts[0] + `","signature":"` + parts[2] + `"}`
+	var decoded TestToken
+	decode(t, flattened, &decoded, jwks)
+	if decoded.Intvalue != 7 {
+		t.Fatalf("Unexpected decoded token: %v", decoded)
+	}
+}
+
+func TestDetached(t *testing.T) {
+	jwks, err := LoadJWKSet(jwsTestKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := TestToken{Stringvalue: "detached"}
+	token, err := jwks.EncodeMulti([]string{"ec"}, data, Detached())
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(token, `"payload"`) {
+		t.Fatalf("Payload not detached: %s", token)
+	}
+	var decoded TestToken
+	if err := jwks.Decode(token, &decoded, DetachedPayload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, decoded) {
+		t.Fatalf("Decoded token not equal to original: %v != %v", decoded, data)
+	}
+	if err := jwks.Decode(token, &decoded, DetachedPayload([]byte(`{"Stringvalue":"other"}`))); err == nil {
+		t.Fatal("Other payload should not verify")
+	}
+	if err := jwks.Decode(token, &decoded); err == nil {
+		t.Fatal("Detached JWS should not decode without payload")
+	}
+	// Compact serialization with an empty payload part
+	compact := strings.Split(encode(t, data, jwks, "hmac"), ".")
+	detached := compact[0] + ".." + compact[2]
+	decoded = TestToken{}
+	if err := jwks.Decode(detached, &decoded, DetachedPayload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, decoded) {
+		t.Fatalf("Decoded token not equal to original: %v != %v", decoded, data)
+	}
+	if err := jwks.Decode(strings.Join(compact, "."), &decoded, DetachedPayload(payload)); err == nil {
+		t.Fatal("Attached payload should not be accepted as detached")
+	}
+}
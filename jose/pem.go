@@ -0,0 +1,186 @@
+package jose
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// NewJWKSet creates an empty JWKSet. Keys can be added using AddPEM.
+func NewJWKSet() *JWKSet {
+	return &JWKSet{
+		signers:   make(map[string]Signer),
+		verifiers: make(map[string]jwtVerifier),
+	}
+}
+
+// AddPEM adds the key in the given PEM encoded data to the set, using the
+// given key id or the key's RFC 7638 thumbprint if kid is empty. The data must
+// hold either an ECDSA private key (SEC 1 or PKCS #8), a public key (PKIX) or a
+// certificate, optionally followed by the rest of its X.509 certificate chain.
+// The certificates are published as the key's x5c and x5t#S256 parameters.
+// Private keys are used for signing and verification, public keys for
+// verification only.
+func (s *JWKSet) AddPEM(kid string, data []byte) error {
+	privKey, pubKey, certs, err := ParsePEM(data)
+	if err != nil {
+		return fmt.Errorf("%v (kid: %s)", err, kid)
+	}
+	pub, err := newJWKECPub(kid, pubKey)
+	if err != nil {
+		return err
+	}
+	if kid == "" {
+		kid = pub.thumbprint()
+		pub.KeyID = kid
+	}
+	for _, k := range s.kids {
+		if k == kid {
+			return fmt.Errorf("Duplicate key ID in JKWSet: %s", kid)
+		}
+		if thumbprint, err := s.Thumbprint(k); err == nil && thumbprint == pub.thumbprint() {
+			return fmt.Errorf("Keys %s and %s in JWKSet are the same key", k, kid)
+		}
+	}
+	for _, cert := range certs {
+		pub.X5C = append(pub.X5C, base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+	if err := pub.checkCertificates(); err != nil {
+		return err
+	}
+	s.kids = append(s.kids, kid)
+	s.verifiers[kid] = pub
+	if privKey != nil {
+		priv := &jwkECPriv{jwkECPub: *pub, PrivateKey: privKey}
+		priv.KeyOps = []string{"sign", "verify"}
+		s.signers[kid] = priv
+	}
+	return nil
+}
+
+// ParsePEM parses PEM encoded data holding either an ECDSA private key (SEC 1
+// or PKCS #8), a public key (PKIX) or a certificate, optionally followed by
+// the rest of its X.509 certificate chain. It returns the private key, which
+// is nil if the data holds no private key, the public key and the
+// certificates. The first certificate must belong to the key.
+func ParsePEM(data []byte) (*ecdsa.PrivateKey, *ecdsa.PublicKey, []*x509.Certificate, error) {
+	var (
+		privKey *ecdsa.PrivateKey
+		pubKey  interface{}
+		certs   []*x509.Certificate
+	)
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			key, err := x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			privKey = key
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			ecKey, ok := key.(*ecdsa.PrivateKey)
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("Unsupported private key type %T", key)
+			}
+			privKey = ecKey
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			pubKey = key
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+	if privKey != nil {
+		pubKey = &privKey.PublicKey
+	} else if pubKey == nil && len(certs) > 0 {
+		pubKey = certs[0].PublicKey
+	}
+	ecPubKey, ok := pubKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, nil, nil, errors.New("No supported key found in PEM data")
+	}
+	if len(certs) > 0 && !ecPubKey.Equal(certs[0].PublicKey) {
+		return nil, nil, nil, errors.New("Certificate doesn't match key")
+	}
+	return privKey, ecPubKey, certs, nil
+}
+
+// newJWKECPub creates a verification JWK for the given public key.
+func newJWKECPub(kid string, key *ecdsa.PublicKey) (*jwkECPub, error) {
+	jwk := &jwkECPub{Curve: key.Curve.Params().Name}
+	if err := jwk.setParams(); err != nil {
+		return nil, err
+	}
+	l := (key.Curve.Params().BitSize + 7) / 8
+	jwk.KeyType = "EC"
+	jwk.KeyID = kid
+	jwk.KeyOps = []string{"verify"}
+	jwk.X = base64.RawURLEncoding.EncodeToString(fixedLengthBytes(key.X.Bytes(), l))
+	jwk.Y = base64.RawURLEncoding.EncodeToString(fixedLengthBytes(key.Y.Bytes(), l))
+	jwk.PublicKey = key
+	return jwk, nil
+}
+
+// fixedLengthBytes left-pads b with zeroes to length l.
+func fixedLengthBytes(b []byte, l int) []byte {
+	if len(b) >= l {
+		return b
+	}
+	fixed := make([]byte, l)
+	copy(fixed[l-len(b):], b)
+	return fixed
+}
+
+// checkCertificates verifies that the key's certificate chain (x5c) belongs
+// to the key and matches its thumbprint (x5t#S256). The thumbprint is set if
+// it's missing.
+func (j *jwkECPub) checkCertificates() error {
+	if len(j.X5C) == 0 {
+		if j.X5TS256 != "" {
+			return fmt.Errorf("Key (kid: %s) has x5t#S256 but no x5c", j.KeyID)
+		}
+		return nil
+	}
+	der, err := base64.StdEncoding.DecodeString(j.X5C[0])
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	certKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || certKey.Curve != j.PublicKey.Curve ||
+		certKey.X.Cmp(j.PublicKey.X) != 0 || certKey.Y.Cmp(j.PublicKey.Y) != 0 {
+		return fmt.Errorf("Certificate doesn't match key (kid: %s)", j.KeyID)
+	}
+	thumbprint := certificateThumbprint(cert)
+	if j.X5TS256 == "" {
+		j.X5TS256 = thumbprint
+	} else if j.X5TS256 != thumbprint {
+		return errors.New("x5t#S256 doesn't match certificate")
+	}
+	return nil
+}
+
+// certificateThumbprint returns the base64url encoded SHA-256 digest of the
+// DER encoded certificate (RFC 7517 section 4.9).
+func certificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,142 @@
+package jose
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func pemTestKey(t *testing.T) (*ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "authz test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	return key, keyPEM, certPEM
+}
+
+func TestAddPEM(t *testing.T) {
+	_, keyPEM, certPEM := pemTestKey(t)
+	key, _, _ := pemTestKey(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8PEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+	jwks := NewJWKSet()
+	if err := jwks.AddPEM("sec1", append(keyPEM, certPEM...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := jwks.AddPEM("pkcs8", pkcs8PEM); err != nil {
+		t.Fatal(err)
+	}
+	if err := jwks.AddPEM("pkcs8", pkcs8PEM); err == nil {
+		t.Fatal("Duplicate key id should not succeed")
+	}
+	for _, kid := range []string{"sec1", "pkcs8"} {
+		var decoded TestToken
+		decode(t, encode(t, TestToken{Stringvalue: kid}, jwks, kid), &decoded, jwks)
+		if decoded.Stringvalue != kid {
+			t.Fatalf("Unexpected decoded token: %v", decoded)
+		}
+	}
+	// Certificates should be published and verifiable
+	var published struct {
+		Keys []struct {
+			KeyID   string   `json:"kid"`
+			X5C     []string `json:"x5c"`
+			X5TS256 string   `json:"x5t#S256"`
+			D       string   `json:"d"`
+		} `json:"keys"`
+	}
+	verifiers := jwks.VerifiersJSON()
+	if err := json.Unmarshal(verifiers, &published); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range published.Keys {
+		if k.D != "" {
+			t.Fatalf("Private key published for kid %s", k.KeyID)
+		}
+		if k.KeyID == "sec1" && (len(k.X5C) != 1 || k.X5TS256 == "") {
+			t.Fatalf("Expected certificate parameters in published key: %+v", k)
+		}
+	}
+	if _, err := LoadJWKSet(verifiers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddPEMCertificateOnly(t *testing.T) {
+	signer := NewJWKSet()
+	_, keyPEM, certPEM := pemTestKey(t)
+	if err := signer.AddPEM("1", keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewJWKSet()
+	if err := verifier.AddPEM("1", certPEM); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Encode("1", TestToken{}); err == nil {
+		t.Fatal("Certificate should not be usable for signing")
+	}
+	var decoded TestToken
+	decode(t, encode(t, TestToken{Intvalue: 1}, signer, "1"), &decoded, verifier)
+}
+
+func TestAddPEMMismatchedCertificate(t *testing.T) {
+	_, keyPEM, _ := pemTestKey(t)
+	_, _, otherCertPEM := pemTestKey(t)
+	if err := NewJWKSet().AddPEM("1", append(keyPEM, otherCertPEM...)); err == nil {
+		t.Fatal("Should not succeed")
+	}
+	if err := NewJWKSet().AddPEM("1", []byte("no pem")); err == nil {
+		t.Fatal("Should not succeed")
+	}
+}
+
+func TestParsePEM(t *testing.T) {
+	key, keyPEM, certPEM := pemTestKey(t)
+	privKey, pubKey, certs, err := ParsePEM(append(keyPEM, certPEM...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.Equal(key) || !pubKey.Equal(&key.PublicKey) || len(certs) != 1 {
+		t.Fatalf("Unexpected key or certificates: %v", certs)
+	}
+	privKey, pubKey, certs, err = ParsePEM(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privKey != nil || !pubKey.Equal(&key.PublicKey) || len(certs) != 1 {
+		t.Fatal("Unexpected key from certificate")
+	}
+	_, _, otherCertPEM := pemTestKey(t)
+	if _, _, _, err := ParsePEM(append(keyPEM, otherCertPEM...)); err == nil {
+		t.Fatal("Certificate of another key should not be accepted")
+	}
+	if _, _, _, err := ParsePEM([]byte("no PEM")); err == nil {
+		t.Fatal("Data without key should not be accepted")
+	}
+}
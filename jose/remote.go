@@ -0,0 +1,212 @@
+package jose
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRemoteMaxAge             = 5 * time.Minute
+	defaultRemoteMinRefreshInterval = 30 * time.Second
+)
+
+// RemoteJWKSet is a JWK set that is fetched from a URL, such as an identity
+// provider's jwks_uri. The set is cached for as long as the Cache-Control
+// header of the response allows and revalidated using its ETag. A token that
+// was signed using an unknown key id causes the set to be refreshed, but no
+// more than once every MinRefreshInterval.
+type RemoteJWKSet struct {
+	// DefaultMaxAge is the cache lifetime used when the response doesn't
+	// specify one.
+	DefaultMaxAge time.Duration
+	// MinRefreshInterval is the minimum time between two fetches.
+	MinRefreshInterval time.Duration
+
+	url        string
+	client     *http.Client
+	fetchMutex sync.Mutex
+	mutex      sync.RWMutex
+	jwks       *JWKSet
+	etag       string
+	expires    time.Time
+	fetched    time.Time
+}
+
+// NewRemoteJWKSet creates a RemoteJWKSet for the given URL. If client is nil
+// a client with a five second timeout is used. The set isn't fetched until it
+// is needed; use Refresh to fetch it eagerly.
+func NewRemoteJWKSet(jwksURL string, client *http.Client) *RemoteJWKSet {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	return &RemoteJWKSet{
+		DefaultMaxAge:      defaultRemoteMaxAge,
+		MinRefreshInterval: defaultRemoteMinRefreshInterval,
+		url:                jwksURL,
+		client:             client,
+	}
+}
+
+// Decode verifies the given data (JWT, or JWS in JSON serialization) and
+// decodes it into v.
+func (s *RemoteJWKSet) Decode(data string, v interface{}, options ...DecodeOption) error {
+	kids, err := keyIDs(data)
+	if err != nil {
+		return err
+	}
+	jwks, err := s.keySet(kids)
+	if err != nil {
+		return err
+	}
+	return jwks.Decode(data, v, options...)
+}
+
+// Refresh fetches the key set, unless it has been fetched less than
+// MinRefreshInterval ago.
+func (s *RemoteJWKSet) Refresh() error {
+	s.fetchMutex.Lock()
+	defer s.fetchMutex.Unlock()
+	s.mutex.RLock()
+	fetched, etag := s.fetched, s.etag
+	s.mutex.RUnlock()
+	if !fetched.IsZero() && time.Since(fetched) < s.MinRefreshInterval {
+		return nil
+	}
+	return s.fetch(etag)
+}
+
+// keySet returns the cached key set, after refreshing it if it has expired or
+// doesn't contain any of the given key ids. If the refresh fails a stale set
+// is returned when available.
+func (s *RemoteJWKSet) keySet(kids []string) (*JWKSet, error) {
+	s.mutex.RLock()
+	jwks, expires := s.jwks, s.expires
+	s.mutex.RUnlock()
+	if jwks != nil && time.Now().Before(expires) {
+		for _, kid := range kids {
+			if jwks.canVerify(kid) {
+				return jwks, nil
+			}
+		}
+	}
+	if err := s.Refresh(); err != nil && jwks == nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.jwks == nil {
+		return nil, fmt.Errorf("JWK set at %s not available", s.url)
+	}
+	return s.jwks, nil
+}
+
+// fetch gets the key set, revalidating the cached set if an etag is given.
+func (s *RemoteJWKSet) fetch(etag string) error {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := s.client.Do(req)
+	now := time.Now()
+	// Also count failed attempts, so an unavailable server isn't hammered
+	s.mutex.Lock()
+	s.fetched = now
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	expires := now.Add(cacheMaxAge(resp.Header, s.DefaultMaxAge))
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		s.mutex.Lock()
+		s.expires = expires
+		s.mutex.Unlock()
+		return nil
+	case http.StatusOK:
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		jwks, err := loadPublicJWKSet(body)
+		if err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		s.jwks = jwks
+		s.etag = resp.Header.Get("ETag")
+		s.expires = expires
+		s.mutex.Unlock()
+		return nil
+	default:
+		return fmt.Errorf("Unexpected response fetching JWK set from %s: %s", s.url, resp.Status)
+	}
+}
+
+// cacheMaxAge returns the lifetime a response may be cached for according to
+// its Cache-Control header.
+func cacheMaxAge(h http.Header, defaultMaxAge time.Duration) time.Duration {
+	cacheControl := h.Get("Cache-Control")
+	if cacheControl == "" {
+		return defaultMaxAge
+	}
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-cache" || directive == "no-store" {
+			return 0
+		}
+		if strings.HasPrefix(directive, "max-age=") {
+			if seconds, err := strconv.Atoi(directive[8:]); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return defaultMaxAge
+}
+
+// LoadPublicJWKSet creates a JWKSet holding the verification keys in the
+// given json-encoded data, such as a key set published by a client. Unlike
+// LoadJWKSet, keys don't need key_ops, and keys of unsupported types or for
+// other uses than signatures are skipped.
+func LoadPublicJWKSet(data []byte) (*JWKSet, error) {
+	return loadPublicJWKSet(data)
+}
+
+// loadPublicJWKSet creates a JWKSet holding the verification keys in the
+// given json-encoded data. Published key sets commonly hold keys we can't use,
+// so keys of unsupported types or for other uses than signatures are skipped.
+func loadPublicJWKSet(data []byte) (*JWKSet, error) {
+	var keyset jwks
+	if err := json.Unmarshal(data, &keyset); err != nil {
+		return nil, err
+	}
+	jwkSet := NewJWKSet()
+	for _, key := range keyset.Keys {
+		var jwkParams jwkData
+		if err := json.Unmarshal(key, &jwkParams); err != nil {
+			return nil, err
+		}
+		if jwkParams.KeyType != "EC" || (jwkParams.Use != "" && jwkParams.Use != "sig") {
+			continue
+		}
+		if jwkSet.canVerify(jwkParams.KeyID) {
+			return nil, fmt.Errorf("Duplicate key ID in JKWSet: %s", jwkParams.KeyID)
+		}
+		jwk, err := unmarshalJWKECPub(key)
+		if err != nil {
+			return nil, err
+		}
+		jwkSet.kids = append(jwkSet.kids, jwk.KeyID)
+		jwkSet.verifiers[jwk.KeyID] = jwk
+	}
+	return jwkSet, nil
+}
@@ -0,0 +1,138 @@
+package jose
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var remoteTestSigners = []byte(`
+	{ "keys": [
+		{ "kty": "EC", "key_ops": ["sign"], "kid": "1", "crv": "P-256", "x": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4=", "y": "ank6KA34vv24HZLXlChVs85NEGlpg2sbqNmR_BcgyJU=", "d":"9GJquUJf57a9sev-u8-PoYlIezIPqI_vGpIaiu4zyZk=" },
+		{ "kty": "EC", "key_ops": ["sign"], "kid": "2", "crv": "P-256", "x": "g9IULlEyYGp3i2IZ1STiuDQ0rcrt3r3o-01f7_wOM_o=", "y": "8QfpzSUvN4UAI4PliUXpeOv8RwLU8P8qLXqhTCc4w1M=", "d": "dIz2ALAunAxB5ajQVx3fAdbttNX4WazEyvXLyi6BFBc=" }
+	]}
+`)
+
+const (
+	remoteTestKey1 = `{ "kty": "EC", "use": "sig", "kid": "1", "crv": "P-256", "x": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4", "y": "ank6KA34vv24HZLXlChVs85NEGlpg2sbqNmR_BcgyJU" }`
+	remoteTestKey2 = `{ "kty": "EC", "use": "sig", "kid": "2", "crv": "P-256", "x": "g9IULlEyYGp3i2IZ1STiuDQ0rcrt3r3o-01f7_wOM_o", "y": "8QfpzSUvN4UAI4PliUXpeOv8RwLU8P8qLXqhTCc4w1M" }`
+	remoteTestRSA  = `{ "kty": "RSA", "use": "sig", "kid": "rsa", "n": "AQAB", "e": "AQAB" }`
+)
+
+// remoteTestServer serves a JWK set and counts requests.
+type remoteTestServer struct {
+	sync.Mutex
+	keys         string
+	etag         string
+	cacheControl string
+	requests     int
+	notModified  int
+}
+
+func (s *remoteTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests++
+	if s.cacheControl != "" {
+		w.Header().Set("Cache-Control", s.cacheControl)
+	}
+	if s.etag != "" && r.Header.Get("If-None-Match") == s.etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	fmt.Fprintf(w, `{ "keys": [ %s ] }`, s.keys)
+}
+
+func (s *remoteTestServer) counts() (int, int) {
+	s.Lock()
+	defer s.Unlock()
+	return s.requests, s.notModified
+}
+
+func remoteTestTokens(t *testing.T) (string, string) {
+	signers, err := LoadJWKSet(remoteTestSigners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := TestToken{Stringvalue: "test", Intvalue: 1}
+	return encode(t, data, signers, "1"), encode(t, data, signers, "2")
+}
+
+func TestRemoteJWKSetCache(t *testing.T) {
+	token, _ := remoteTestTokens(t)
+	srv := &remoteTestServer{
+		keys: remoteTestKey1 + "," + remoteTestRSA, cacheControl: "public, max-age=60",
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	jwks := NewRemoteJWKSet(ts.URL, nil)
+	for i := 0; i < 3; i++ {
+		var decoded TestToken
+		decode(t, token, &decoded, jwks)
+		if decoded.Stringvalue != "test" {
+			t.Fatalf("Unexpected decoded token: %v", decoded)
+		}
+	}
+	if requests, _ := srv.counts(); requests != 1 {
+		t.Fatalf("Expected the set to be fetched once, got %d requests", requests)
+	}
+}
+
+func TestRemoteJWKSetETag(t *testing.T) {
+	token, _ := remoteTestTokens(t)
+	srv := &remoteTestServer{keys: remoteTestKey1, etag: `"v1"`, cacheControl: "no-cache"}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	jwks := NewRemoteJWKSet(ts.URL, nil)
+	jwks.MinRefreshInterval = 0
+	for i := 0; i < 2; i++ {
+		var decoded TestToken
+		decode(t, token, &decoded, jwks)
+	}
+	if requests, notModified := srv.counts(); requests != 2 || notModified != 1 {
+		t.Fatalf("Expected a revalidation (requests: %d, not modified: %d)", requests, notModified)
+	}
+}
+
+func TestRemoteJWKSetUnknownKeyID(t *testing.T) {
+	token1, token2 := remoteTestTokens(t)
+	srv := &remoteTestServer{keys: remoteTestKey1, cacheControl: "max-age=3600"}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	jwks := NewRemoteJWKSet(ts.URL, nil)
+	jwks.MinRefreshInterval = time.Hour
+	var decoded TestToken
+	decode(t, token1, &decoded, jwks)
+	// Key 2 is published, but the set may not be refetched yet
+	srv.Lock()
+	srv.keys = remoteTestKey1 + "," + remoteTestKey2
+	srv.Unlock()
+	if err := jwks.Decode(token2, &decoded); err == nil {
+		t.Fatal("Expected rate limited refresh to fail decoding")
+	}
+	if requests, _ := srv.counts(); requests != 1 {
+		t.Fatalf("Refresh wasn't rate limited: %d requests", requests)
+	}
+	// Without rate limit the unknown kid triggers a refresh
+	jwks.MinRefreshInterval = 0
+	decode(t, token2, &decoded, jwks)
+	if requests, _ := srv.counts(); requests != 2 {
+		t.Fatalf("Expected a refresh for unknown kid, got %d requests", requests)
+	}
+}
+
+func TestRemoteJWKSetUnavailable(t *testing.T) {
+	token, _ := remoteTestTokens(t)
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	jwks := NewRemoteJWKSet(ts.URL, nil)
+	var decoded TestToken
+	if err := jwks.Decode(token, &decoded); err == nil {
+		t.Fatal("Should not succeed")
+	}
+}
@@ -0,0 +1,108 @@
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+// testSigner is an external signer holding its own private key.
+type testSigner struct {
+	key   *ecdsa.PrivateKey
+	calls int
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{key: key}
+}
+
+func (s *testSigner) Algorithm() string {
+	return "ES256"
+}
+
+func (s *testSigner) Sign(msg []byte) ([]byte, error) {
+	s.calls++
+	sum := sha256.Sum256(msg)
+	r, sig, err := ecdsa.Sign(rand.Reader, s.key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return append(fixedLengthBytes(r.Bytes(), 32), fixedLengthBytes(sig.Bytes(), 32)...), nil
+}
+
+func (s *testSigner) Public() crypto.PublicKey {
+	return &s.key.PublicKey
+}
+
+// testSignerWithoutKey doesn't expose its public key.
+type testSignerWithoutKey struct {
+	*testSigner
+}
+
+func (s testSignerWithoutKey) Public() {}
+
+func TestAddSigner(t *testing.T) {
+	signer := newTestSigner(t)
+	jwks := NewJWKSet()
+	if err := jwks.AddSigner("external", signer); err != nil {
+		t.Fatal(err)
+	}
+	var decoded TestToken
+	decode(t, encode(t, TestToken{Stringvalue: "signed"}, jwks, "external"), &decoded, jwks)
+	if signer.calls != 1 || decoded.Stringvalue != "signed" {
+		t.Fatalf("Token not signed by external signer (calls: %d)", signer.calls)
+	}
+	if !strings.Contains(string(jwks.VerifiersJSON()), `"kid":"external"`) {
+		t.Fatal("Verification key of external signer not published")
+	}
+	if err := jwks.AddSigner("external", signer); err == nil {
+		t.Fatal("Duplicate signer should not succeed")
+	}
+}
+
+func TestAddSignerForVerifier(t *testing.T) {
+	signer := newTestSigner(t)
+	published := NewJWKSet()
+	if err := published.AddSigner("1", signer); err != nil {
+		t.Fatal(err)
+	}
+	// Load the published verification key and add the signer to it
+	jwks, err := LoadJWKSet(published.VerifiersJSON())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jwks.CanSign("1") {
+		t.Fatal("Verification key should not be able to sign")
+	}
+	if err := jwks.AddSigner("1", signer); err != nil {
+		t.Fatal(err)
+	}
+	var decoded TestToken
+	decode(t, encode(t, TestToken{Intvalue: 1}, jwks, "1"), &decoded, jwks)
+}
+
+func TestAddSignerErrors(t *testing.T) {
+	jwks, err := LoadJWKSet([]byte(`
+		{ "keys": [
+			{ "kty": "oct", "key_ops": ["verify"], "kid": "hmac", "alg": "HS256", "k": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4=" }
+		]}
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := newTestSigner(t)
+	if err := jwks.AddSigner("hmac", signer); err == nil {
+		t.Fatal("Signer with different algorithm should not succeed")
+	}
+	if err := jwks.AddSigner("unknown", testSignerWithoutKey{signer}); err == nil {
+		t.Fatal("Signer without verification key should not succeed")
+	}
+}
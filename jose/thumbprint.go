@@ -0,0 +1,119 @@
+package jose
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// thumbprinter is implemented by keys that can compute their thumbprint.
+type thumbprinter interface {
+	thumbprint() string
+}
+
+// Thumbprint computes the RFC 7638 thumbprint of the given json-encoded JWK,
+// using SHA-256. EC and symmetric (oct) keys are supported.
+func Thumbprint(jwk []byte) (string, error) {
+	var key struct {
+		KeyType string `json:"kty"`
+		Curve   string `json:"crv"`
+		X       string `json:"x"`
+		Y       string `json:"y"`
+		K       string `json:"k"`
+	}
+	if err := json.Unmarshal(jwk, &key); err != nil {
+		return "", err
+	}
+	switch key.KeyType {
+	case "EC":
+		switch key.Curve {
+		case "P-256", "P-384", "P-521":
+		default:
+			return "", fmt.Errorf("Unsupported EC curve: %v", key.Curve)
+		}
+		x, err := decodeBase64URL(key.X)
+		if err != nil {
+			return "", err
+		}
+		y, err := decodeBase64URL(key.Y)
+		if err != nil {
+			return "", err
+		}
+		return ecThumbprint(key.Curve, x, y), nil
+	case "oct":
+		k, err := decodeBase64URL(key.K)
+		if err != nil {
+			return "", err
+		}
+		return octThumbprint(k), nil
+	default:
+		return "", fmt.Errorf("Can't compute thumbprint for key type %s", key.KeyType)
+	}
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the key with the given key id.
+func (s *JWKSet) Thumbprint(kid string) (string, error) {
+	var key interface{}
+	if k, ok := s.verifiers[kid]; ok {
+		key = k
+	} else if k, ok := s.signers[kid]; ok {
+		key = k
+	}
+	if t, ok := key.(thumbprinter); ok {
+		return t.thumbprint(), nil
+	}
+	return "", fmt.Errorf("Can't compute thumbprint for kid %s", kid)
+}
+
+// checkUniqueKeys returns an error if two key ids in the set refer to the
+// same key material.
+func (s *JWKSet) checkUniqueKeys() error {
+	seen := make(map[string]string)
+	for _, kid := range s.kids {
+		thumbprint, err := s.Thumbprint(kid)
+		if err != nil {
+			continue
+		}
+		if other, ok := seen[thumbprint]; ok {
+			return fmt.Errorf("Keys %s and %s in JWKSet are the same key", other, kid)
+		}
+		seen[thumbprint] = kid
+	}
+	return nil
+}
+
+func (j *jwkECPub) thumbprint() string {
+	l := (j.PublicKey.Curve.Params().BitSize + 7) / 8
+	return ecThumbprint(
+		j.Curve,
+		fixedLengthBytes(j.PublicKey.X.Bytes(), l),
+		fixedLengthBytes(j.PublicKey.Y.Bytes(), l),
+	)
+}
+
+func (j *jwkSymmetric) thumbprint() string {
+	return octThumbprint(j.Key)
+}
+
+// ecThumbprint hashes the required members of an EC key in lexicographic
+// order, without whitespace (RFC 7638 section 3.2).
+func ecThumbprint(curve string, x, y []byte) string {
+	return thumbprintSum(fmt.Sprintf(
+		`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, curve,
+		base64.RawURLEncoding.EncodeToString(x),
+		base64.RawURLEncoding.EncodeToString(y),
+	))
+}
+
+// octThumbprint hashes the required members of a symmetric key.
+func octThumbprint(k []byte) string {
+	return thumbprintSum(fmt.Sprintf(
+		`{"k":"%s","kty":"oct"}`, base64.RawURLEncoding.EncodeToString(k),
+	))
+}
+
+func thumbprintSum(members string) string {
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,76 @@
+package jose
+
+import (
+	"testing"
+)
+
+const thumbprintTestKey = `{ "kty": "EC", "key_ops": ["sign", "verify"], "kid": "1", "crv": "P-256", "x": "g9IULlEyYGp3i2IZ1STiuDQ0rcrt3r3o-01f7_wOM_o=", "y": "8QfpzSUvN4UAI4PliUXpeOv8RwLU8P8qLXqhTCc4w1M=", "d": "dIz2ALAunAxB5ajQVx3fAdbttNX4WazEyvXLyi6BFBc=" }`
+
+const thumbprintTestValue = "KBT9ql7FgI_CEnALI6sxfnqSCJSANnr1a87Vpi2p9X4"
+
+func TestThumbprint(t *testing.T) {
+	// Padding and additional members must not influence the thumbprint
+	for _, key := range []string{
+		thumbprintTestKey,
+		`{"kty":"EC","crv":"P-256","x":"g9IULlEyYGp3i2IZ1STiuDQ0rcrt3r3o-01f7_wOM_o","y":"8QfpzSUvN4UAI4PliUXpeOv8RwLU8P8qLXqhTCc4w1M"}`,
+	} {
+		thumbprint, err := Thumbprint([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thumbprint != thumbprintTestValue {
+			t.Fatalf("Unexpected thumbprint (expected: %s, got %s)", thumbprintTestValue, thumbprint)
+		}
+	}
+	jwks, err := LoadJWKSet([]byte(`{ "keys": [` + thumbprintTestKey + `] }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumbprint, err := jwks.Thumbprint("1"); err != nil {
+		t.Fatal(err)
+	} else if thumbprint != thumbprintTestValue {
+		t.Fatalf("Unexpected thumbprint (expected: %s, got %s)", thumbprintTestValue, thumbprint)
+	}
+	if _, err := Thumbprint([]byte(`{"kty":"RSA"}`)); err == nil {
+		t.Fatal("Should not succeed")
+	}
+}
+
+func TestThumbprintKeyID(t *testing.T) {
+	jwks, err := LoadJWKSet([]byte(`
+		{ "keys": [
+			{ "kty": "oct", "key_ops": ["sign", "verify"], "alg": "HS256", "k": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4=" }
+		]}
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid := jwks.KeyIDs()[0]
+	if thumbprint, err := jwks.Thumbprint(kid); err != nil {
+		t.Fatal(err)
+	} else if kid != thumbprint {
+		t.Fatalf("Expected key id to be derived from thumbprint, got %s", kid)
+	}
+	var decoded TestToken
+	decode(t, encode(t, TestToken{Intvalue: 1}, jwks, kid), &decoded, jwks)
+}
+
+func TestDuplicateKeyMaterial(t *testing.T) {
+	_, err := LoadJWKSet([]byte(`
+		{ "keys": [
+			{ "kty": "oct", "key_ops": ["sign", "verify"], "kid": "1", "alg": "HS256", "k": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4=" },
+			{ "kty": "oct", "key_ops": ["sign", "verify"], "kid": "2", "alg": "HS512", "k": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4" }
+		]}
+	`))
+	if err == nil {
+		t.Fatal("Same key under two key ids should not succeed")
+	}
+	_, keyPEM, _ := pemTestKey(t)
+	jwks := NewJWKSet()
+	if err := jwks.AddPEM("", keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	if err := jwks.AddPEM("other", keyPEM); err == nil {
+		t.Fatal("Same key under two key ids should not succeed")
+	}
+}
@@ -10,9 +10,12 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"os"
 
+	"github.com/amsterdam/authz/jose"
 	"github.com/google/uuid"
 )
 
@@ -28,10 +31,11 @@ type JWK struct {
 
 type JWKEC struct {
 	JWK
-	Curve string `json:"crv"`
-	X     string `json:"x"`
-	Y     string `json:"y"`
-	D     string `json:"d"`
+	Curve string   `json:"crv"`
+	X     string   `json:"x"`
+	Y     string   `json:"y"`
+	D     string   `json:"d,omitempty"`
+	X5C   []string `json:"x5c,omitempty"`
 }
 
 type JWKHMAC struct {
@@ -41,25 +45,15 @@ type JWKHMAC struct {
 }
 
 func NewJWKEC(alg string) (*JWKEC, error) {
-	var (
-		c     elliptic.Curve
-		l     int
-		curve string
-	)
+	var c elliptic.Curve
 
 	switch alg {
 	case "ES256":
-		curve = "P-256"
 		c = elliptic.P256()
-		l = 32
 	case "ES384":
-		curve = "P-384"
 		c = elliptic.P384()
-		l = 48
 	case "ES512":
-		curve = "P-521"
 		c = elliptic.P521()
-		l = 66
 	default:
 		return nil, fmt.Errorf("%s is not a supported algorithm", alg)
 	}
@@ -68,14 +62,25 @@ func NewJWKEC(alg string) (*JWKEC, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newJWKECFromKey(&privKey.PublicKey, privKey.D)
+}
+
+// newJWKECFromKey creates a JWK for the given public key, and private key d
+// if it isn't nil.
+func newJWKECFromKey(pubKey *ecdsa.PublicKey, d *big.Int) (*JWKEC, error) {
+	params := pubKey.Curve.Params()
+	switch params.Name {
+	case "P-256", "P-384", "P-521":
+	default:
+		return nil, fmt.Errorf("%s is not a supported curve", params.Name)
+	}
 
 	// make sure we have correct key sizes
-	d := make([]byte, l)
+	l := (params.BitSize + 7) / 8
 	x := make([]byte, l)
 	y := make([]byte, l)
-	copy(d[l-len(privKey.D.Bytes()):], privKey.D.Bytes())
-	copy(x[l-len(privKey.X.Bytes()):], privKey.X.Bytes())
-	copy(y[l-len(privKey.Y.Bytes()):], privKey.Y.Bytes())
+	copy(x[l-len(pubKey.X.Bytes()):], pubKey.X.Bytes())
+	copy(y[l-len(pubKey.Y.Bytes()):], pubKey.Y.Bytes())
 
 	// Generate a UUID as key-id
 	kid, err := uuid.NewRandom()
@@ -86,11 +91,16 @@ func NewJWKEC(alg string) (*JWKEC, error) {
 	key := &JWKEC{}
 	key.KeyType = "EC"
 	key.KeyID = kid.String()
-	key.Curve = curve
+	key.Curve = params.Name
 	key.X = base64.URLEncoding.EncodeToString(x)
 	key.Y = base64.URLEncoding.EncodeToString(y)
-	key.D = base64.URLEncoding.EncodeToString(d)
-	key.KeyOps = []string{"verify", "sign"}
+	key.KeyOps = []string{"verify"}
+	if d != nil {
+		dFixed := make([]byte, l)
+		copy(dFixed[l-len(d.Bytes()):], d.Bytes())
+		key.D = base64.URLEncoding.EncodeToString(dFixed)
+		key.KeyOps = []string{"verify", "sign"}
+	}
 
 	return key, nil
 }
@@ -150,10 +160,26 @@ func readJWKSFromStdIn() *JWKSet {
 	return &jwks
 }
 
+// thumbprintKeyID returns the RFC 7638 thumbprint of the given key.
+func thumbprintKeyID(key interface{}) string {
+	encoded, err := json.Marshal(key)
+	if err != nil {
+		log.Fatalf("Error marshaling key: %v", err)
+	}
+	thumbprint, err := jose.Thumbprint(encoded)
+	if err != nil {
+		log.Fatalf("Error computing thumbprint: %v", err)
+	}
+	return thumbprint
+}
+
 func main() {
 	// Flags
 	create := flag.Bool("create", false, "Create a new JWKS instead of reading an existing one from stdin")
 	alg := flag.String("alg", "", "Algorithm, one of HS256, HS384, HS512, ES256, ES384 or ES512")
+	pemFile := flag.String("pem", "", "Add the ECDSA key (and certificate chain) in this PEM file")
+	exportKID := flag.String("export-pem", "", "Write the key with this key id as PEM instead of the JWKS")
+	thumbprintKID := flag.Bool("thumbprint-kid", false, "Use the key's RFC 7638 thumbprint as key id instead of a UUID")
 	flag.Parse()
 
 	// Grab the JWKS from stdin or create a new one
@@ -163,6 +189,12 @@ func main() {
 	} else {
 		jwks = readJWKSFromStdIn()
 	}
+	addKey := func(key interface{}, jwk *JWK) {
+		if *thumbprintKID {
+			jwk.KeyID = thumbprintKeyID(key)
+		}
+		jwks.Keys = append(jwks.Keys, key)
+	}
 
 	if len(*alg) >= 2 {
 		// Create and add keys
@@ -172,13 +204,13 @@ func main() {
 			if err != nil {
 				log.Fatalf("Error creating key: %v", err)
 			}
-			jwks.Keys = append(jwks.Keys, key)
+			addKey(key, &key.JWK)
 		case "ES":
 			key, err := NewJWKEC(*alg)
 			if err != nil {
 				log.Fatalf("Error creating key: %v", err)
 			}
-			jwks.Keys = append(jwks.Keys, key)
+			addKey(key, &key.JWK)
 		default:
 			log.Fatalf("Unsupported algorithm: %s", *alg)
 		}
@@ -186,6 +218,29 @@ func main() {
 		log.Fatalf("Unsupported algorithm: %s", *alg)
 	}
 
+	// Convert a PEM encoded key
+	if *pemFile != "" {
+		data, err := ioutil.ReadFile(*pemFile)
+		if err != nil {
+			log.Fatalf("Error reading PEM file: %v", err)
+		}
+		key, err := NewJWKECFromPEM(data)
+		if err != nil {
+			log.Fatalf("Error converting PEM file: %v", err)
+		}
+		addKey(key, &key.JWK)
+	}
+
+	// Export a key to PEM
+	if *exportKID != "" {
+		pemData, err := ExportPEM(jwks, *exportKID)
+		if err != nil {
+			log.Fatalf("Error exporting key: %v", err)
+		}
+		fmt.Printf("%s", pemData)
+		return
+	}
+
 	jwksJSON, err := json.MarshalIndent(jwks, "", "  ")
 	if err != nil {
 		log.Fatalf("Error marshaling jwks: %v", err)
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/amsterdam/authz/jose"
+)
+
+// NewJWKECFromPEM creates a JWK from an ECDSA private key (SEC 1 or PKCS #8),
+// public key or certificate, optionally followed by its certificate chain. The
+// data is parsed by jose.ParsePEM like the service does, so a chain that
+// doesn't belong to the key is rejected.
+func NewJWKECFromPEM(data []byte) (*JWKEC, error) {
+	privKey, pubKey, certs, err := jose.ParsePEM(data)
+	if err != nil {
+		return nil, err
+	}
+	var d *big.Int
+	if privKey != nil {
+		d = privKey.D
+	}
+	key, err := newJWKECFromKey(pubKey, d)
+	if err != nil {
+		return nil, err
+	}
+	for _, cert := range certs {
+		key.X5C = append(key.X5C, base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+	return key, nil
+}
+
+// ExportPEM returns the key with the given key id as a PEM encoded PKCS #8
+// private key or PKIX public key, followed by its certificate chain.
+func ExportPEM(jwks *JWKSet, kid string) ([]byte, error) {
+	for _, k := range jwks.Keys {
+		encoded, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		var key JWKEC
+		if err := json.Unmarshal(encoded, &key); err != nil {
+			return nil, err
+		}
+		if key.KeyID != kid {
+			continue
+		}
+		if key.KeyType != "EC" {
+			return nil, fmt.Errorf("Can't export key of type %s to PEM", key.KeyType)
+		}
+		return key.pem()
+	}
+	return nil, fmt.Errorf("Key %s not found", kid)
+}
+
+func (key *JWKEC) pem() ([]byte, error) {
+	var c elliptic.Curve
+	switch key.Curve {
+	case "P-256":
+		c = elliptic.P256()
+	case "P-384":
+		c = elliptic.P384()
+	case "P-521":
+		c = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("%s is not a supported curve", key.Curve)
+	}
+	x, err := decodeBigInt(key.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBigInt(key.Y)
+	if err != nil {
+		return nil, err
+	}
+	pubKey := &ecdsa.PublicKey{Curve: c, X: x, Y: y}
+	buf := new(bytes.Buffer)
+	if key.D != "" {
+		d, err := decodeBigInt(key.D)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(&ecdsa.PrivateKey{PublicKey: *pubKey, D: d})
+		if err != nil {
+			return nil, err
+		}
+		pem.Encode(buf, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	} else {
+		der, err := x509.MarshalPKIXPublicKey(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		pem.Encode(buf, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}
+	for _, cert := range key.X5C {
+		der, err := base64.StdEncoding.DecodeString(cert)
+		if err != nil {
+			return nil, err
+		}
+		pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
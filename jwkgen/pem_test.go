@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func pemTestKey(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "jwkgen test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	return keyPEM, certPEM
+}
+
+func TestNewJWKECFromPEM(t *testing.T) {
+	keyPEM, certPEM := pemTestKey(t)
+	key, err := NewJWKECFromPEM(append(keyPEM, certPEM...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.D == "" || len(key.X5C) != 1 {
+		t.Fatalf("Unexpected key: %+v", key)
+	}
+}
+
+func TestNewJWKECFromPEMMismatchedCertificate(t *testing.T) {
+	keyPEM, _ := pemTestKey(t)
+	_, otherCertPEM := pemTestKey(t)
+	if _, err := NewJWKECFromPEM(append(keyPEM, otherCertPEM...)); err == nil {
+		t.Fatal("Should not succeed")
+	}
+}
@@ -3,8 +3,11 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/base64"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/pprof"
 	"os"
@@ -40,6 +43,9 @@ func main() {
 	// Create server
 	bindAddr := fmt.Sprintf("%s:%d", conf.BindHost, conf.BindPort)
 	server := &http.Server{Addr: bindAddr, Handler: handler}
+	if conf.TLS.enabled() {
+		server.TLSConfig = conf.TLS.serverConfig()
+	}
 
 	// Shut down server if signal is received
 	go func() {
@@ -52,7 +58,12 @@ func main() {
 
 	// Start the OAuth 2.0 server
 	log.Printf("Starting service on %s.\n", bindAddr)
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+	if conf.TLS.enabled() {
+		err = server.ListenAndServeTLS(conf.TLS.CertFile, conf.TLS.KeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		log.Warnf("Error shutting down service: %v\n", err)
 	} else {
 		log.Println("Server stopped")
@@ -71,14 +82,21 @@ func conf() *config {
 	if conf.BaseURL == "" {
 		log.Fatal("Must set base-url in config")
 	}
-	// Check that the JWKS is set
+	// Check that the JWKS is set, it may be empty if keys are in Vault
 	if conf.Accesstoken.JWKS == "" {
-		log.Fatal("Must set JSON Web Key Set (jwk-set) in config")
+		if (conf.Accesstoken.Vault == vaultTransitConfig{}) {
+			log.Fatal("Must set JSON Web Key Set (jwk-set) in config")
+		}
+		conf.Accesstoken.JWKS = `{ "keys": [] }`
 	}
 	// Warn if profiler is enabled
 	if conf.PprofEnabled {
 		log.Warnln("Profiling should not be enbaled in production!")
 	}
+	// Client certificates can only be requested over TLS
+	if conf.TLS.ClientCerts && !conf.TLS.enabled() {
+		log.Fatal("Must set cert-file and key-file to request client certificates")
+	}
 	return conf
 }
 
@@ -138,15 +156,63 @@ func options(conf *config) []oauth2.Option {
 		log.Fatal("Must register at least one IdP")
 	}
 
-	// Clients
-	if len(conf.Clients) == 0 {
+	// Database, for state storage and registered clients
+	var (
+		db      *sql.DB
+		dialect *sqlDialect
+	)
+	if (conf.Database != databaseConfig{}) {
+		var err error
+		if db, dialect, err = openDatabase(&conf.Database); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Clients, static clients take precedence over those from the API and
+	// registered clients
+	registration := len(conf.ClientReg.InitialTokens) > 0
+	if len(conf.Clients) == 0 && conf.ClientsAPI.URL == "" && !registration {
 		log.Fatal("Must configure at least one registered client")
 	}
-	options = append(options, oauth2.Clients(conf.Clients))
+	clients := clientMaps{conf.Clients}
+	if conf.ClientsAPI.URL != "" {
+		clients = append(clients, newDatapuntClients(&conf.ClientsAPI))
+	}
+	if registration {
+		if db == nil {
+			log.Fatal("Client registration needs a database")
+		}
+		registry := newSQLClients(db, dialect)
+		clients = append(clients, registry)
+		options = append(options, oauth2.ClientRegistration(registry, conf.ClientReg.InitialTokens))
+	}
+	options = append(options, oauth2.Clients(clients))
+	// Resource servers
+	if len(conf.Resources) > 0 {
+		var servers []oauth2.ResourceServer
+		for _, server := range conf.Resources {
+			servers = append(servers, oauth2.ResourceServer{URI: server.URI, Scopes: server.Scopes})
+		}
+		options = append(options, oauth2.ResourceServers(servers...))
+	}
 	// Access token config
 	if conf.Accesstoken.KID != "" {
 		options = append(options, oauth2.JWKID(conf.Accesstoken.KID))
 	}
+	if (conf.Accesstoken.Vault != vaultTransitConfig{}) {
+		signer, err := newVaultTransitSigner(&conf.Accesstoken.Vault)
+		if err != nil {
+			log.Fatal(err)
+		}
+		kid := conf.Accesstoken.Vault.KID
+		if kid == "" {
+			kid = conf.Accesstoken.Vault.Key
+		}
+		options = append(options, oauth2.JWKSigner(kid, signer))
+		if conf.Accesstoken.KID == "" {
+			options = append(options, oauth2.JWKID(kid))
+		}
+	}
 	if conf.Accesstoken.Lifetime != 0 {
 		options = append(
 			options, oauth2.AccessTokenLifetime(conf.Accesstoken.Lifetime),
@@ -157,6 +223,11 @@ func options(conf *config) []oauth2.Option {
 			options, oauth2.AccessTokenIssuer(conf.Accesstoken.Issuer),
 		)
 	}
+	if conf.Accesstoken.Profile == "rfc9068" {
+		options = append(
+			options, oauth2.JWTAccessTokens(conf.Accesstoken.Audience),
+		)
+	}
 	// Authorization provider
 	if (conf.Authz != authzConfig{}) {
 		if authz, err := newDatapuntAuthz(&conf.Authz); err != nil {
@@ -166,11 +237,72 @@ func options(conf *config) []oauth2.Option {
 		}
 	}
 	// Storage provider
-	if (conf.Redis != redisConfig{}) {
-		engine := newRedisStorage(conf.Redis.Address, conf.Redis.Password)
+	if conf.Redis.enabled() {
+		engine, err := newRedisStorage(&conf.Redis)
+		if err != nil {
+			log.Fatal(err)
+		}
+		timeout := time.Duration(conf.AuthnTimeout) * time.Second
+		options = append(options, oauth2.StateStorage(engine, timeout))
+	}
+	if db != nil && !conf.Redis.enabled() {
+		reapInterval := conf.Database.ReapInterval
+		if reapInterval == 0 {
+			reapInterval = defaultReapInterval
+		}
+		engine := newSQLStorage(db, dialect, time.Duration(reapInterval)*time.Second)
 		timeout := time.Duration(conf.AuthnTimeout) * time.Second
 		options = append(options, oauth2.StateStorage(engine, timeout))
 	}
+	if conf.MaxAuthnReqs != 0 && !conf.Redis.enabled() && (conf.Database == databaseConfig{}) {
+		timeout := time.Duration(conf.AuthnTimeout) * time.Second
+		options = append(options, oauth2.MemoryStateStorage(conf.MaxAuthnReqs, timeout))
+	}
+	// Authorization state cookies
+	if len(conf.StateCookies.Keys) > 0 {
+		keys, err := decodeKeys(conf.StateCookies.Keys)
+		if err != nil {
+			log.Fatalf("Invalid state cookie key: %v", err)
+		}
+		timeout := time.Duration(conf.AuthnTimeout) * time.Second
+		options = append(options, oauth2.StateCookies(keys, timeout))
+	}
+	// State encryption
+	if len(conf.StateEncrypt.Keys) > 0 {
+		keys, err := decodeKeys(conf.StateEncrypt.Keys)
+		if err != nil {
+			log.Fatalf("Invalid state encryption key: %v", err)
+		}
+		options = append(options, oauth2.StateEncryption(keys))
+	}
+	// DPoP nonces
+	if conf.DPoP.NonceKey != "" {
+		keys, err := decodeKeys([]string{conf.DPoP.NonceKey})
+		if err != nil {
+			log.Fatalf("Invalid DPoP nonce key: %v", err)
+		}
+		lifetime := conf.DPoP.NonceLifetime
+		if lifetime == 0 {
+			lifetime = defaultDPoPNonceLifetime
+		}
+		options = append(options, oauth2.DPoPNonces(keys[0], time.Duration(lifetime)*time.Second))
+	}
+	// Pairwise subject identifiers
+	if conf.Pairwise.Key != "" {
+		keys, err := decodeKeys([]string{conf.Pairwise.Key})
+		if err != nil {
+			log.Fatalf("Invalid pairwise subject key: %v", err)
+		}
+		options = append(options, oauth2.PairwiseSubjects(keys[0]))
+	}
+	// Mutual TLS client authentication
+	if conf.TLS.ClientCerts {
+		roots, err := conf.TLS.clientCAs()
+		if err != nil {
+			log.Fatalf("Invalid client CA file: %v", err)
+		}
+		options = append(options, oauth2.MutualTLS(roots))
+	}
 	// Trace header
 	if conf.TraceHeader != "" {
 		options = append(options, oauth2.TraceHeader(conf.TraceHeader))
@@ -214,3 +346,29 @@ func (h *Handler) handleProfiles(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) servePing(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
+
+// decodeKeys decodes base64 encoded keys.
+func decodeKeys(encoded []string) ([][]byte, error) {
+	var keys [][]byte
+	for _, key := range encoded {
+		k, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// newRequest creates an outgoing request that is cancelled with ctx and
+// carries the trace identifier of the incoming request, if any.
+func newRequest(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if header, id := oauth2.TraceID(ctx); header != "" {
+		req.Header.Set(header, id)
+	}
+	return req, nil
+}
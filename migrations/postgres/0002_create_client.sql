@@ -0,0 +1,9 @@
+CREATE TABLE authz_client (
+	id                TEXT PRIMARY KEY,
+	name              TEXT NOT NULL,
+	redirects         TEXT NOT NULL,
+	secret            TEXT NOT NULL,
+	grant_type        TEXT NOT NULL,
+	registration_hash BYTEA NOT NULL,
+	issued_at         BIGINT NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE authz_client ADD COLUMN grant_types TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE authz_client ADD COLUMN response_types TEXT NOT NULL DEFAULT '[]';
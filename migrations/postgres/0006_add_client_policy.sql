@@ -0,0 +1,4 @@
+ALTER TABLE authz_client ADD COLUMN idps TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE authz_client ADD COLUMN token_lifetime BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE authz_client ADD COLUMN require_pkce BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE authz_client ADD COLUMN require_consent BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,7 @@
+CREATE TABLE authz_state (
+	key        TEXT PRIMARY KEY,
+	value      BLOB NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+
+CREATE INDEX authz_state_expires_at ON authz_state (expires_at);
@@ -0,0 +1 @@
+ALTER TABLE authz_client ADD COLUMN secrets TEXT NOT NULL DEFAULT '[]';
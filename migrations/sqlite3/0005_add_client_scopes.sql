@@ -0,0 +1 @@
+ALTER TABLE authz_client ADD COLUMN scopes TEXT NOT NULL DEFAULT '[]';
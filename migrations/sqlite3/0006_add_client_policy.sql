@@ -0,0 +1,4 @@
+ALTER TABLE authz_client ADD COLUMN idps TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE authz_client ADD COLUMN token_lifetime INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE authz_client ADD COLUMN require_pkce INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE authz_client ADD COLUMN require_consent INTEGER NOT NULL DEFAULT 0;
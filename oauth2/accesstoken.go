@@ -1,7 +1,10 @@
 package oauth2
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/amsterdam/authz/jose"
@@ -10,13 +13,74 @@ import (
 )
 
 type accessTokenPayload struct {
-	Issuer    string   `json:"iss"`
-	Subject   string   `json:"sub"`
-	IssuedAt  int64    `json:"iat"`
-	NotBefore int64    `json:"nbf"`
-	ExpiresAt int64    `json:"exp"`
-	JWTId     string   `json:"jti"`
-	Scopes    []string `json:"scopes"`
+	Issuer    string        `json:"iss"`
+	Subject   string        `json:"sub"`
+	IssuedAt  int64         `json:"iat"`
+	NotBefore int64         `json:"nbf"`
+	ExpiresAt int64         `json:"exp"`
+	JWTId     string        `json:"jti"`
+	Scopes    []string      `json:"scopes"`
+	Audience  []string      `json:"aud,omitempty"`
+	Confirm   *confirmation `json:"cnf,omitempty"`
+}
+
+// jwtAccessTokenPayload is the payload of an access token in the JWT profile
+// (RFC 9068 section 2.2).
+type jwtAccessTokenPayload struct {
+	Issuer    string        `json:"iss"`
+	Subject   string        `json:"sub"`
+	Audience  []string      `json:"aud"`
+	ClientID  string        `json:"client_id"`
+	IssuedAt  int64         `json:"iat"`
+	NotBefore int64         `json:"nbf"`
+	ExpiresAt int64         `json:"exp"`
+	JWTId     string        `json:"jti"`
+	Scope     string        `json:"scope,omitempty"`
+	AuthTime  int64         `json:"auth_time,omitempty"`
+	ACR       string        `json:"acr,omitempty"`
+	Confirm   *confirmation `json:"cnf,omitempty"`
+}
+
+// jwtAccessTokenType is the typ header of access tokens in the JWT profile.
+const jwtAccessTokenType = "at+jwt"
+
+// accessTokenGrant holds what an access token grants, and to whom.
+type accessTokenGrant struct {
+	Subject string
+	// UID of the user if Subject is a pairwise subject identifier; it is only
+	// used in the audit log
+	UID      string
+	ClientID string
+	Scopes   []string
+	// Resource indicators of the resource servers the token is for (RFC
+	// 8707); the token is valid at every resource server if empty
+	Audience []string
+	// Lifetime in seconds
+	Lifetime int64
+	// Key of the client that the token is bound to, if any
+	Confirm *confirmation
+	// When and how the user authenticated, if the token is for a user
+	AuthTime int64
+	ACR      string
+	// Extra claims, which can't override the claims above
+	Claims map[string]interface{}
+}
+
+// reservedClaims are the claims that extra claims can't override: the
+// registered claims (RFC 7519 section 4.1) and the other claims of access
+// tokens.
+var reservedClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true, "jti": true,
+	"scopes": true, "scope": true, "client_id": true, "auth_time": true, "acr": true, "cnf": true,
+}
+
+// confirmation is the cnf claim of an access token that is bound to a key of
+// the client (RFC 7800).
+type confirmation struct {
+	// SHA-256 thumbprint of the client certificate (RFC 8705 section 3.1)
+	X5tS256 string `json:"x5t#S256,omitempty"`
+	// RFC 7638 thumbprint of the client's DPoP key (RFC 9449 section 6.1)
+	JKT string `json:"jkt,omitempty"`
 }
 
 type accessTokenEncoder struct {
@@ -24,30 +88,102 @@ type accessTokenEncoder struct {
 	Lifetime int64
 	Issuer   string
 	KeyID    string
+	// JWTProfile makes the encoder issue tokens in the JWT profile (RFC
+	// 9068), with aud Audience if not for specific resource servers.
+	JWTProfile bool
+	Audience   string
 }
 
 func newAccessTokenEncoder(jwks *jose.JWKSet) (*accessTokenEncoder, error) {
-	kids := jwks.KeyIDs()
-	if len(kids) < 1 {
-		return nil, errors.New("JWK set must contain at least one key")
+	enc := &accessTokenEncoder{jwks: jwks, Lifetime: 60}
+	if kids := jwks.KeyIDs(); len(kids) > 0 {
+		enc.KeyID = kids[0]
+	}
+	return enc, nil
+}
+
+// checkKey makes sure the encoder has a key it can sign access tokens with.
+// Keys, including external signers, may have been added after creation.
+func (enc *accessTokenEncoder) checkKey() error {
+	if enc.KeyID == "" {
+		kids := enc.jwks.KeyIDs()
+		if len(kids) < 1 {
+			return errors.New("JWK set must contain at least one key")
+		}
+		enc.KeyID = kids[0]
 	}
-	return &accessTokenEncoder{jwks: jwks, Lifetime: 60, KeyID: kids[0]}, nil
+	if !enc.jwks.CanSign(enc.KeyID) {
+		return fmt.Errorf("JWK %s can't be used to sign access tokens", enc.KeyID)
+	}
+	return nil
 }
 
 func (enc *accessTokenEncoder) Encode(subject string, scopes []string) (string, error) {
+	return enc.EncodeGrant(&accessTokenGrant{Subject: subject, Scopes: scopes, Lifetime: enc.Lifetime})
+}
+
+// EncodeGrant encodes an access token for the given grant.
+func (enc *accessTokenEncoder) EncodeGrant(g *accessTokenGrant) (string, error) {
 	jti, err := uuid.NewRandom()
 	if err != nil {
 		return "", err
 	}
 	now := time.Now().Unix()
+	if enc.JWTProfile {
+		audience := g.Audience
+		if len(audience) == 0 {
+			audience = []string{enc.Audience}
+		}
+		return enc.encode(jwtAccessTokenType, g.Claims, &jwtAccessTokenPayload{
+			Issuer:    enc.Issuer,
+			Subject:   g.Subject,
+			Audience:  audience,
+			ClientID:  g.ClientID,
+			IssuedAt:  now,
+			NotBefore: now - 10,
+			ExpiresAt: now + g.Lifetime,
+			JWTId:     jti.String(),
+			Scope:     strings.Join(g.Scopes, " "),
+			AuthTime:  g.AuthTime,
+			ACR:       g.ACR,
+			Confirm:   g.Confirm,
+		})
+	}
 	payload := &accessTokenPayload{
 		Issuer:    enc.Issuer,
-		Subject:   subject,
+		Subject:   g.Subject,
 		IssuedAt:  now,
 		NotBefore: now - 10,
-		ExpiresAt: now + enc.Lifetime,
+		ExpiresAt: now + g.Lifetime,
 		JWTId:     jti.String(),
-		Scopes:    scopes,
+		Scopes:    g.Scopes,
+		Audience:  g.Audience,
+		Confirm:   g.Confirm,
+	}
+	return enc.encode("", g.Claims, payload)
+}
+
+// encode encodes the payload with the extra claims that don't override its
+// claims or reserved claims.
+func (enc *accessTokenEncoder) encode(typ string, claims map[string]interface{}, payload interface{}) (string, error) {
+	if len(claims) == 0 {
+		return enc.jwks.EncodeTyped(enc.KeyID, typ, payload)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return "", err
+	}
+	for name, value := range claims {
+		if _, ok := merged[name]; ok || reservedClaims[name] {
+			continue
+		}
+		if merged[name], err = json.Marshal(value); err != nil {
+			return "", err
+		}
 	}
-	return enc.jwks.Encode(enc.KeyID, payload)
+	return enc.jwks.EncodeTyped(enc.KeyID, typ, merged)
 }
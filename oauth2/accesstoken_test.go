@@ -1,8 +1,11 @@
 package oauth2
 
 import (
+	"net/http"
+	"net/url"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/amsterdam/authz/jose"
 )
@@ -49,6 +52,131 @@ func TestEncode(t *testing.T) {
 	}
 }
 
+func TestEncodeJWTProfile(t *testing.T) {
+	enc, jwks, err := makeEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.JWTProfile, enc.Audience = true, "https://api/"
+	for _, audience := range [][]string{nil, {"https://resource/"}} {
+		jwt, err := enc.EncodeGrant(&accessTokenGrant{
+			Subject: "subject", ClientID: "client", Scopes: []string{"scope1", "scope2"},
+			Audience: audience, Lifetime: 60, AuthTime: 1500000000, ACR: "acr",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ, err := jose.ParseType(jwt); err != nil || typ != "at+jwt" {
+			t.Fatalf("Unexpected typ: %s %v", typ, err)
+		}
+		var decoded jwtAccessTokenPayload
+		if err := jwks.Decode(jwt, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		expected := audience
+		if expected == nil {
+			expected = []string{"https://api/"}
+		}
+		if decoded.Subject != "subject" || decoded.ClientID != "client" || decoded.Scope != "scope1 scope2" ||
+			!reflect.DeepEqual(decoded.Audience, expected) || decoded.AuthTime != 1500000000 || decoded.ACR != "acr" {
+			t.Fatalf("Unexpected payload: %+v", decoded)
+		}
+	}
+}
+
+func TestJWTAccessTokens(t *testing.T) {
+	handler := testClientHandler(t,
+		[]*Client{&Client{ID: "app", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}}},
+		JWTAccessTokens("https://api/"),
+		IDProvider(&testIDP{BaseURL: "http://test/", Users: []*User{&User{UID: "user:1", ACR: "urn:test:2fa"}}}),
+	)
+	start := time.Now().Unix()
+	code := testCode(t, handler, "app")
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"app"}}
+	resp, token, e := testTokenRequest(handler, form)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Token request failed: %s %+v", resp.Status, e)
+	}
+	keys, _ := jose.LoadJWKSet([]byte(testTokenJWKS))
+	var decoded jwtAccessTokenPayload
+	if err := keys.Decode(token.AccessToken, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ClientID != "app" || decoded.Scope != "scope:1" || decoded.AuthTime < start || decoded.ACR != "urn:test:2fa" {
+		t.Fatalf("Unexpected payload: %+v", decoded)
+	}
+	if _, err := Handler("http://test/", testTokenJWKS, JWTAccessTokens("")); err == nil {
+		t.Fatal("JWT access tokens without audience accepted")
+	}
+}
+
+func TestEncodeClaims(t *testing.T) {
+	enc, jwks, err := makeEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{
+		"tenant": "amsterdam", "department": []string{"ICT"},
+		"sub": "other", "scopes": []string{"admin"}, "exp": 0, "client_id": "other",
+	}
+	for _, profile := range []bool{false, true} {
+		enc.JWTProfile, enc.Audience = profile, "https://api/"
+		jwt, err := enc.EncodeGrant(&accessTokenGrant{
+			Subject: "subject", ClientID: "client", Scopes: []string{"scope1"}, Lifetime: 60, Claims: claims,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded map[string]interface{}
+		if err := jwks.Decode(jwt, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded["tenant"] != "amsterdam" || !reflect.DeepEqual(decoded["department"], []interface{}{"ICT"}) {
+			t.Errorf("Claims missing: %v", decoded)
+		}
+		if decoded["sub"] != "subject" || decoded["exp"] == 0.0 || decoded["client_id"] == "other" ||
+			(!profile && !reflect.DeepEqual(decoded["scopes"], []interface{}{"scope1"})) || (profile && decoded["scopes"] != nil) {
+			t.Errorf("Claims overridden: %v", decoded)
+		}
+	}
+}
+
+func TestClaimsProvider(t *testing.T) {
+	type call struct {
+		user   *User
+		client string
+		scopes []string
+	}
+	var calls []call
+	clients := []*Client{
+		&Client{ID: "app", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}},
+	}
+	handler := testClientHandler(t, clients,
+		IDProvider(&testIDP{BaseURL: "http://test/", Users: []*User{&User{UID: "user:1", Data: "Jane"}}}),
+		ClaimsProvider(func(user *User, client *Client, scopes []string) map[string]interface{} {
+			calls = append(calls, call{user, client.ID, scopes})
+			return map[string]interface{}{"name": user.Data, "sub": "other"}
+		}),
+	)
+	keys, _ := jose.LoadJWKSet([]byte(testTokenJWKS))
+	code := testCode(t, handler, "app")
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"app"}}
+	resp, token, e := testTokenRequest(handler, form)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Token request failed: %s %+v", resp.Status, e)
+	}
+	var decoded map[string]interface{}
+	if err := keys.Decode(token.AccessToken, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["name"] != "Jane" || decoded["sub"] != "user:1" {
+		t.Fatalf("Unexpected claims: %v", decoded)
+	}
+	if len(calls) != 1 || calls[0].user.UID != "user:1" || calls[0].client != "app" || !reflect.DeepEqual(calls[0].scopes, []string{"scope:1"}) {
+		t.Fatalf("Unexpected calls: %+v", calls)
+	}
+}
+
 func BenchmarkEncode(b *testing.B) {
 	enc, _, err := makeEncoder()
 	if err != nil {
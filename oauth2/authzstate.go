@@ -2,43 +2,152 @@ package oauth2
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 )
 
+// stateVersion is the version of the encoding of state data. Increment it
+// when making changes that older releases can't decode, add a case for it to
+// decodeState and keep decoding the previous version, so requests that are in
+// flight during a rolling deploy keep working.
+const stateVersion = 1
+
+// authorizationState is stored between the authorization request and the IdP
+// callback. Fields must have explicit JSON names that don't change.
 type authorizationState struct {
-	ClientID     string
-	RedirectURI  string
-	ResponseType string
-	Scope        []string
-	State        string
-	IDPID        string
+	ClientID     string   `json:"client_id"`
+	RedirectURI  string   `json:"redirect_uri"`
+	ResponseType string   `json:"response_type"`
+	Scope        []string `json:"scope"`
+	State        string   `json:"state,omitempty"`
+	IDPID        string   `json:"idp_id"`
+	DPoPJKT      string   `json:"dpop_jkt,omitempty"`
+	Resources    []string `json:"resource,omitempty"`
+	// PKCE code challenge (RFC 7636)
+	CodeChallenge       string `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string `json:"code_challenge_method,omitempty"`
+	// BindingHash is the hash of the secret in the user agent's binding
+	// cookie.
+	BindingHash []byte `json:"binding_hash,omitempty"`
+}
+
+// stateEnvelope holds encoded state data and the version of its encoding.
+type stateEnvelope struct {
+	Version int             `json:"v"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// encodeState encodes v as versioned JSON.
+func encodeState(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&stateEnvelope{Version: stateVersion, Data: data})
+}
+
+// decodeState decodes data encoded by encodeState, or by releases that
+// encoded state using gob, into v.
+func decodeState(encoded []byte, v interface{}) error {
+	if len(encoded) == 0 || encoded[0] != '{' {
+		// Releases before version 1 used gob, which never starts with '{'
+		return gob.NewDecoder(bytes.NewReader(encoded)).Decode(v)
+	}
+	var envelope stateEnvelope
+	if err := json.Unmarshal(encoded, &envelope); err != nil {
+		return err
+	}
+	if envelope.Data == nil {
+		return errors.New("Invalid state encoding")
+	}
+	switch envelope.Version {
+	case 1:
+		return json.Unmarshal(envelope.Data, v)
+	default:
+		return fmt.Errorf("Unknown state encoding version: %d", envelope.Version)
+	}
 }
 
 type stateStorage struct {
-	engine      StateKeeper
+	engine      ContextStateKeeper
 	maxLifetime time.Duration
+	// sealer encrypts and authenticates state if set, using the key as
+	// additional data so entries can't be moved to another key.
+	sealer *sealer
 }
 
-func newStateStorage(engine StateKeeper, lifetime time.Duration) *stateStorage {
-	return &stateStorage{engine, lifetime}
+func newStateStorage(engine ContextStateKeeper, lifetime time.Duration) *stateStorage {
+	return &stateStorage{engine: engine, maxLifetime: lifetime}
 }
 
-func (store *stateStorage) restore(key string, e interface{}) error {
-	encoded, err := store.engine.Restore(key)
+func (store *stateStorage) restore(ctx context.Context, key string, e interface{}) error {
+	encoded, err := store.engine.RestoreContext(ctx, key)
 	if err != nil {
 		return err
 	}
-	data := bytes.NewBufferString(encoded)
-	dec := gob.NewDecoder(data)
-	return dec.Decode(e)
+	if store.sealer != nil {
+		opened, err := store.sealer.open([]byte(encoded), []byte(key))
+		if err != nil {
+			return err
+		}
+		encoded = string(opened)
+	}
+	return decodeState([]byte(encoded), e)
+}
+
+func (store *stateStorage) persist(ctx context.Context, key string, data interface{}) error {
+	return store.persistFor(ctx, key, data, store.maxLifetime)
 }
 
-func (store *stateStorage) persist(key string, data interface{}) error {
-	var encoded bytes.Buffer
-	enc := gob.NewEncoder(&encoded)
-	if err := enc.Encode(data); err != nil {
+// persistFor saves data that expires after the given lifetime.
+func (store *stateStorage) persistFor(ctx context.Context, key string, data interface{}, lifetime time.Duration) error {
+	value, err := encodeState(data)
+	if err != nil {
 		return err
 	}
-	return store.engine.Persist(key, encoded.String(), store.maxLifetime)
+	if store.sealer != nil {
+		sealed, err := store.sealer.seal(value, []byte(key))
+		if err != nil {
+			return err
+		}
+		value = sealed
+	}
+	return store.engine.PersistContext(ctx, key, string(value), lifetime)
+}
+
+// errReplay is returned by claimOnce if the key has been claimed before.
+var errReplay = errors.New("Replayed")
+
+// claimOnce records the use of a one-time key, such as the jti of a JWT, until
+// the key's lifetime has passed. It returns errReplay if the key was used
+// before. Claiming is atomic if the engine is a ContextExclusiveStateKeeper,
+// so of concurrent claims of a key only one succeeds.
+func (store *stateStorage) claimOnce(ctx context.Context, key string, lifetime time.Duration) error {
+	// Engines expire data in seconds
+	if lifetime < time.Second {
+		lifetime = time.Second
+	}
+	if engine, ok := store.engine.(ContextExclusiveStateKeeper); ok {
+		ok, err := engine.PersistNewContext(ctx, key, "1", lifetime)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errReplay
+		}
+		return nil
+	}
+	// Best effort for engines that can't claim keys atomically
+	if _, err := store.engine.RestoreContext(ctx, key); err == nil {
+		// Restoring removed the key, so record it again
+		if err := store.engine.PersistContext(ctx, key, "1", lifetime); err != nil {
+			return err
+		}
+		return errReplay
+	}
+	return store.engine.PersistContext(ctx, key, "1", lifetime)
 }
@@ -1,16 +1,187 @@
 package oauth2
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func TestState(t *testing.T) {
-	/*&authorizationState{
-		ClientId:     "client",
-		RedirectURI:  "http://redirect",
+// TestStateFixtures decodes state as stored by previous releases, which may
+// still be in storage during a rolling deploy. The fixtures were captured from
+// the storage engine of those releases.
+func TestStateFixtures(t *testing.T) {
+	expected := authorizationState{
+		ClientID:     "testclient",
+		RedirectURI:  "http://testurl/",
 		ResponseType: "token",
-		Scope:        []string{"abc", "def"},
+		Scope:        []string{"scope:1", "scope:2"},
 		State:        "abcstate",
-		IdPData:      []byte("the idp set me"),
-	}*/
+		IDPID:        "testidp",
+		BindingHash:  []byte{1, 2, 3},
+	}
+	for _, test := range []struct {
+		fixture string
+		binding bool
+	}{
+		{"state_gob.bin", false},        // gob, before user agent binding
+		{"state_gob_binding.bin", true}, // gob
+		{"state_v1.json", true},         // version 1
+	} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", test.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state authorizationState
+		if err := decodeState(data, &state); err != nil {
+			t.Fatalf("%s: %s", test.fixture, err)
+		}
+		want := expected
+		if !test.binding {
+			want.BindingHash = nil
+		}
+		if !reflect.DeepEqual(state, want) {
+			t.Errorf("%s: got %+v, expected %+v", test.fixture, state, want)
+		}
+	}
+}
+
+func TestStateEncoding(t *testing.T) {
+	state := &authorizationState{ClientID: "client", Scope: []string{"a"}}
+	encoded, err := encodeState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(encoded, []byte(`{"v":1,`)) {
+		t.Fatalf("Unversioned encoding: %s", encoded)
+	}
+	var decoded authorizationState
+	if err := decodeState(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, state) {
+		t.Fatalf("got %+v, expected %+v", decoded, state)
+	}
+	for _, encoded := range []string{`{"data":{}}`, `{"v":0,"data":{}}`, `{"v":2,"data":{}}`, `{"v":1}`} {
+		if err := decodeState([]byte(encoded), &decoded); err == nil {
+			t.Fatalf("Decoded invalid state: %s", encoded)
+		}
+	}
+}
+
+func TestStateEncryption(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	engine := newStateMap(0, time.Hour)
+	defer engine.Close()
+	store := newStateStorage(contextStateKeeper(engine), time.Minute)
+	store.sealer, _ = newSealer([][]byte{oldKey})
+	ctx := context.Background()
+	state := &authorizationState{ClientID: "client", RedirectURI: "http://testurl/"}
+	// Restore using rotated keys
+	if err := store.persist(ctx, "key", state); err != nil {
+		t.Fatal(err)
+	}
+	if raw := engine.order.Back().Value.(*stateMapEntry).value; strings.Contains(raw, "testurl") {
+		t.Fatal("State stored in plain text")
+	}
+	store.sealer, _ = newSealer([][]byte{newKey, oldKey})
+	var restored authorizationState
+	if err := store.restore(ctx, "key", &restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.RedirectURI != state.RedirectURI {
+		t.Fatalf("Unexpected restored state: %+v", restored)
+	}
+	// Entries moved to another key, tampered or unsealed entries fail
+	if err := store.persist(ctx, "key", state); err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := engine.Restore("key")
+	engine.Persist("other", sealed, time.Minute)
+	if err := store.restore(ctx, "other", &restored); err == nil {
+		t.Fatal("Entry moved to another key should not restore")
+	}
+	engine.Persist("key", sealed[:len(sealed)-1]+"x", time.Minute)
+	if err := store.restore(ctx, "key", &restored); err == nil {
+		t.Fatal("Tampered entry should not restore")
+	}
+	plain := newStateStorage(contextStateKeeper(engine), time.Minute)
+	plain.persist(ctx, "key", state)
+	if err := store.restore(ctx, "key", &restored); err == nil {
+		t.Fatal("Unsealed entry should not restore")
+	}
+}
+
+func TestStateClaimOnce(t *testing.T) {
+	engine := newStateMap(0, time.Hour)
+	defer engine.Close()
+	store := newStateStorage(contextStateKeeper(engine), time.Minute)
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- store.claimOnce(context.Background(), "jti", time.Minute)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	claimed := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			claimed++
+		case errReplay:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if claimed != 1 {
+		t.Fatalf("Key was claimed %d times", claimed)
+	}
+	// Expired claims can be claimed again
+	if err := store.claimOnce(context.Background(), "short", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.claimOnce(context.Background(), "short", 0); err != errReplay {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// testPlainStateKeeper is a StateKeeper that can't claim keys atomically.
+type testPlainStateKeeper struct {
+	engine *stateMap
+}
+
+func (k testPlainStateKeeper) Persist(key string, data string, lifetime time.Duration) error {
+	return k.engine.Persist(key, data, lifetime)
+}
+
+func (k testPlainStateKeeper) Restore(key string) (string, error) {
+	return k.engine.Restore(key)
+}
+
+func TestStateClaimOnceFallback(t *testing.T) {
+	engine := newStateMap(0, time.Hour)
+	defer engine.Close()
+	keeper := contextStateKeeper(testPlainStateKeeper{engine})
+	if _, ok := keeper.(ContextExclusiveStateKeeper); ok {
+		t.Fatal("Plain state keeper should not be exclusive")
+	}
+	store := newStateStorage(keeper, time.Minute)
+	if err := store.claimOnce(context.Background(), "jti", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.claimOnce(context.Background(), "jti", time.Minute); err != errReplay {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
 }
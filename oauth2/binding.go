@@ -0,0 +1,62 @@
+package oauth2
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+// bindingCookiePrefix is the prefix of the name of binding cookies. The
+// cookie name ends with the authzRef token the binding belongs to.
+const bindingCookiePrefix = "authz_binding_"
+
+// bindUserAgent binds the authorization request with the given authzRef token
+// to the user agent, to prevent login CSRF: an attacker who hands the callback
+// URL of a flow they completed to a victim. It sets a cookie for the given
+// path holding a random secret and returns the secret's hash, which should be
+// saved with the authorization state and checked using checkUserAgentBinding.
+func (h *handler) bindUserAgent(w http.ResponseWriter, path string, authzRef string) ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, h.bindingCookie(path, authzRef, base64.RawURLEncoding.EncodeToString(secret)))
+	hash := sha256.Sum256(secret)
+	return hash[:], nil
+}
+
+// checkUserAgentBinding checks that the request holds the binding cookie of
+// the authorization request with the given authzRef token and that its secret
+// matches the given hash. The cookie is removed.
+func (h *handler) checkUserAgentBinding(w http.ResponseWriter, r *http.Request, path string, authzRef string, hash []byte) error {
+	expired := h.bindingCookie(path, authzRef, "")
+	expired.MaxAge = -1
+	http.SetCookie(w, expired)
+	cookie, err := r.Cookie(bindingCookiePrefix + authzRef)
+	if err != nil {
+		return errors.New("Binding cookie missing")
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return err
+	}
+	secretHash := sha256.Sum256(secret)
+	if len(hash) == 0 || subtle.ConstantTimeCompare(secretHash[:], hash) != 1 {
+		return errors.New("Binding cookie doesn't match")
+	}
+	return nil
+}
+
+func (h *handler) bindingCookie(path string, authzRef string, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     bindingCookiePrefix + authzRef,
+		Value:    value,
+		Path:     path,
+		Secure:   h.callbackURL.Scheme == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
@@ -0,0 +1,246 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amsterdam/authz/jose"
+)
+
+const (
+	// clientAssertionType is the client_assertion_type of JWT client
+	// assertions (RFC 7523 section 2.2).
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	// maxAssertionLifetime limits how far in the future client assertions may
+	// expire, which is how long their jti must be remembered.
+	maxAssertionLifetime = time.Hour
+)
+
+// clientAssertion holds the claims of a client assertion (RFC 7523 section 3).
+type clientAssertion struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	JWTId     string   `json:"jti"`
+}
+
+// audience is the aud claim of a JWT, which is a string or an array of
+// strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, aud := range a {
+		if aud == s {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAuthError is returned when a client fails to authenticate.
+type clientAuthError struct {
+	description string
+	// basic is true if the client tried to use HTTP Basic authentication
+	basic bool
+}
+
+func (e *clientAuthError) Error() string {
+	return e.description
+}
+
+// authenticateClient authenticates the client of a token request, using
+// client_secret_basic, client_secret_post, client_secret_jwt,
+// private_key_jwt, tls_client_auth or self_signed_tls_client_auth. Clients
+// that have no credentials don't authenticate and only send their client_id.
+// Errors other than *clientAuthError are server errors.
+func (h *handler) authenticateClient(r *http.Request) (*Client, error) {
+	form := r.PostForm
+	basicID, basicSecret, basic := r.BasicAuth()
+	methods := 0
+	for _, used := range []bool{basic, form.Get("client_secret") != "", form.Get("client_assertion") != ""} {
+		if used {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return nil, &clientAuthError{"multiple client authentication methods", basic}
+	}
+	switch {
+	case basic:
+		// The credentials are form encoded (RFC 6749 section 2.3.1)
+		clientID, err1 := url.QueryUnescape(basicID)
+		secret, err2 := url.QueryUnescape(basicSecret)
+		if err1 != nil || err2 != nil {
+			return nil, &clientAuthError{"invalid basic authentication", true}
+		}
+		return h.authenticateSecret(clientID, secret, true)
+	case form.Get("client_secret") != "":
+		return h.authenticateSecret(form.Get("client_id"), form.Get("client_secret"), false)
+	case form.Get("client_assertion") != "":
+		if form.Get("client_assertion_type") != clientAssertionType {
+			return nil, &clientAuthError{"unsupported client_assertion_type", false}
+		}
+		return h.authenticateAssertion(r.Context(), form.Get("client_id"), form.Get("client_assertion"))
+	}
+	client, err := h.clientMap.Get(form.Get("client_id"))
+	if err != nil {
+		return nil, &clientAuthError{"unknown client", false}
+	}
+	if client.usesMutualTLS() {
+		return h.authenticateCertificate(r, client)
+	}
+	if client.confidential() {
+		return nil, &clientAuthError{"client authentication required", false}
+	}
+	return client, nil
+}
+
+// confidential returns true if the client has credentials to authenticate
+// with (RFC 6749 section 2.1).
+func (c *Client) confidential() bool {
+	return c.Secret != "" || len(c.Secrets) > 0 || c.JWKS != "" || c.JWKSURI != "" || c.usesMutualTLS()
+}
+
+// authenticateSecret authenticates a client using its client secret. Clients
+// with too many failed attempts are rejected without checking the secret.
+func (h *handler) authenticateSecret(clientID string, secret string, basic bool) (*Client, error) {
+	client, err := h.clientMap.Get(clientID)
+	if err != nil {
+		return nil, &clientAuthError{"invalid client credentials", basic}
+	}
+	if !h.secretLimiter.allow(client.ID) {
+		return nil, &clientAuthError{"too many failed attempts", basic}
+	}
+	if !client.ValidSecret(secret) {
+		h.secretLimiter.fail(client.ID)
+		return nil, &clientAuthError{"invalid client credentials", basic}
+	}
+	return client, nil
+}
+
+// authenticateAssertion authenticates a client using a JWT signed using its
+// plain text secret (client_secret_jwt) or one of its keys
+// (private_key_jwt). Each assertion can only be used once.
+func (h *handler) authenticateAssertion(ctx context.Context, clientID string, assertion string) (*Client, error) {
+	var unverified clientAssertion
+	if err := jose.DecodeUnverified(assertion, &unverified); err != nil {
+		return nil, &clientAuthError{"invalid client assertion", false}
+	}
+	if clientID == "" {
+		clientID = unverified.Subject
+	}
+	client, err := h.clientMap.Get(clientID)
+	if err != nil {
+		return nil, &clientAuthError{"unknown client", false}
+	}
+	keys, err := h.clientKeys(client, assertion)
+	if err != nil {
+		return nil, &clientAuthError{err.Error(), false}
+	}
+	var claims clientAssertion
+	if err := keys.Decode(assertion, &claims); err != nil {
+		return nil, &clientAuthError{"invalid client assertion signature", false}
+	}
+	if err := h.checkAssertion(client, &claims); err != nil {
+		return nil, &clientAuthError{err.Error(), false}
+	}
+	lifetime := time.Until(time.Unix(claims.ExpiresAt, 0))
+	key := "client_assertion:" + client.ID + ":" + claims.JWTId
+	if err := h.stateStore.claimOnce(ctx, key, lifetime); err == errReplay {
+		return nil, &clientAuthError{"client assertion replayed", false}
+	} else if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// checkAssertion validates the claims of a client assertion.
+func (h *handler) checkAssertion(client *Client, claims *clientAssertion) error {
+	now := time.Now()
+	switch {
+	case claims.Issuer != client.ID || claims.Subject != client.ID:
+		return errors.New("client assertion iss and sub must be the client_id")
+	case !claims.Audience.contains(h.tokenURL.String()) &&
+		(h.accessTokenEnc.Issuer == "" || !claims.Audience.contains(h.accessTokenEnc.Issuer)):
+		return errors.New("client assertion has invalid aud")
+	case claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0)):
+		return errors.New("client assertion expired")
+	case time.Unix(claims.ExpiresAt, 0).After(now.Add(maxAssertionLifetime)):
+		return errors.New("client assertion expires too late")
+	case claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0)):
+		return errors.New("client assertion not valid yet")
+	case claims.JWTId == "":
+		return errors.New("client assertion has no jti")
+	}
+	return nil
+}
+
+// clientKeys returns the keys to verify the given client assertion with:
+// the client's secret for HMAC algorithms, or the client's keys otherwise.
+func (h *handler) clientKeys(client *Client, assertion string) (jose.Decoder, error) {
+	alg, kid, err := jose.ParseHeader(assertion)
+	if err != nil {
+		return nil, errors.New("invalid client assertion")
+	}
+	if strings.HasPrefix(alg, "HS") {
+		// Hashed secrets can't be used as keys
+		if client.Secret == "" {
+			return nil, errors.New("client_secret_jwt not supported for client")
+		}
+		keys := jose.NewJWKSet()
+		if err := keys.AddSymmetricKey(kid, alg, []byte(client.Secret)); err != nil {
+			return nil, err
+		}
+		return keys, nil
+	}
+	switch {
+	case client.JWKS != "":
+		keys, err := jose.LoadPublicJWKSet([]byte(client.JWKS))
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWK set of client: %v", err)
+		}
+		return keys, nil
+	case client.JWKSURI != "":
+		return h.remoteKeys.get(client.JWKSURI), nil
+	}
+	return nil, errors.New("private_key_jwt not supported for client")
+}
+
+// remoteKeySets caches the key sets at clients' jwks_uri.
+type remoteKeySets struct {
+	mutex sync.Mutex
+	sets  map[string]*jose.RemoteJWKSet
+}
+
+func newRemoteKeySets() *remoteKeySets {
+	return &remoteKeySets{sets: make(map[string]*jose.RemoteJWKSet)}
+}
+
+func (s *remoteKeySets) get(jwksURI string) *jose.RemoteJWKSet {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys, ok := s.sets[jwksURI]
+	if !ok {
+		keys = jose.NewRemoteJWKSet(jwksURI, nil)
+		s.sets[jwksURI] = keys
+	}
+	return keys
+}
@@ -0,0 +1,108 @@
+package oauth2
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// consentState is stored while the user is asked for consent.
+type consentState struct {
+	authentication
+	Authz authorizationState `json:"authz"`
+	Scope []string           `json:"scope"`
+	// BindingHash is the hash of the secret in the user agent's binding
+	// cookie for the consent form.
+	BindingHash []byte `json:"binding_hash"`
+}
+
+// consentTemplate is the page that asks the user for consent.
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Authorize {{.Client}}</title></head>
+<body>
+<form method="POST" action="{{.Action}}">
+<p>{{.Client}} wants to access your data{{if .Scope}} with these permissions:{{end}}</p>
+{{if .Scope}}<ul>{{range .Scope}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<input type="hidden" name="ref" value="{{.Ref}}">
+<button type="submit" name="consent" value="approve">Allow</button>
+<button type="submit" name="consent" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+// consentPage asks the user to consent to the scopes granted to the client.
+// The consent form is bound to the user agent, so other sites can't submit
+// it.
+func (h *handler) consentPage(w http.ResponseWriter, r *http.Request, client *Client, state *authorizationState, authn *authentication, scope []string) error {
+	ref, err := randomToken(16)
+	if err != nil {
+		return err
+	}
+	bindingHash, err := h.bindUserAgent(w, h.consentURL.Path, ref)
+	if err != nil {
+		return err
+	}
+	consent := &consentState{
+		authentication: *authn, Authz: *state, Scope: scope, BindingHash: bindingHash,
+	}
+	if err := h.stateStore.persist(r.Context(), consentKey(ref), consent); err != nil {
+		return err
+	}
+	name := client.Name
+	if name == "" {
+		name = client.ID
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; form-action 'self'; frame-ancestors 'none'")
+	return consentTemplate.Execute(w, map[string]interface{}{
+		"Client": name, "Scope": scope, "Ref": ref, "Action": h.consentURL.String(),
+	})
+}
+
+// serveConsent handles the consent form.
+func (h *handler) serveConsent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	logger := h.logger(r).WithField("type", "consent request")
+	ref := r.PostFormValue("ref")
+	var consent consentState
+	if err := h.stateStore.restore(r.Context(), consentKey(ref), &consent); err != nil {
+		logger.WithError(err).Infoln("Error restoring consent state")
+		http.Error(w, "invalid or expired consent form", http.StatusBadRequest)
+		return
+	}
+	if err := h.checkUserAgentBinding(w, r, h.consentURL.Path, ref, consent.BindingHash); err != nil {
+		logger.WithError(err).Warnln("Consent from another user agent")
+		http.Error(w, "authorization request not started in this browser", http.StatusBadRequest)
+		return
+	}
+	state := &consent.Authz
+	redirectURI, err := url.Parse(state.RedirectURI)
+	if err != nil {
+		logger.WithError(err).Errorln("Error reconstructing redirect_uri")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	client, err := h.clientMap.Get(state.ClientID)
+	if err != nil {
+		h.errorResponse(w, redirectURI, "unauthorized_client", "unknown client")
+		logger.WithError(err).Infoln("unauthorized_client: unknown client")
+		return
+	}
+	logger = logger.WithField("client_id", client.ID).WithFields(consent.logFields())
+	if r.PostFormValue("consent") != "approve" {
+		h.errorResponse(w, redirectURI, "access_denied", "user denied consent")
+		logger.Infoln("User denied consent")
+		return
+	}
+	h.authorizationResponse(w, r, redirectURI, client, state, &consent.authentication, consent.Scope, logger)
+}
+
+func consentKey(ref string) string {
+	return "consent:" + ref
+}
@@ -0,0 +1,69 @@
+package oauth2
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var testConsentRef = regexp.MustCompile(`name="ref" value="([^"]+)"`)
+
+// testConsentForm runs an authorization request up to the consent page, and
+// returns the consent form's ref and the user agent's cookies.
+func testConsentForm(t *testing.T, handler http.Handler) (string, []*http.Cookie) {
+	resp := testAuthorizeResponse(handler, "app", nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Frame-Options") != "DENY" {
+		t.Fatalf("Unexpected consent page: %s %v", resp.Status, resp.Header)
+	}
+	match := testConsentRef.FindSubmatch(body)
+	if match == nil || !strings.Contains(string(body), "App") || !strings.Contains(string(body), "scope:1") {
+		t.Fatalf("Unexpected consent page: %s", body)
+	}
+	return string(match[1]), resp.Cookies()
+}
+
+func testConsent(handler http.Handler, ref string, consent string, cookies []*http.Cookie) *http.Response {
+	form := url.Values{"ref": {ref}, "consent": {consent}}
+	r := httptest.NewRequest("POST", "http://test/oauth2/consent", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestConsent(t *testing.T) {
+	handler := testPolicyHandler(t, &Client{
+		ID: "app", Name: "App", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}, RequireConsent: true,
+	})
+	// Consent forms are bound to the user agent
+	otherRef, _ := testConsentForm(t, handler)
+	if resp := testConsent(handler, otherRef, "approve", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Consent from other user agent accepted: %s", resp.Status)
+	}
+	// Approve
+	ref, cookies := testConsentForm(t, handler)
+	resp := testConsent(handler, ref, "approve", cookies)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || location.Query().Get("code") == "" || location.Query().Get("state") != "xyz" {
+		t.Fatalf("Unexpected redirect: %s %s", resp.Status, resp.Header.Get("Location"))
+	}
+	// Consent forms can only be used once
+	if resp := testConsent(handler, ref, "approve", cookies); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Consent form used twice: %s", resp.Status)
+	}
+	// Deny
+	ref, cookies = testConsentForm(t, handler)
+	resp = testConsent(handler, ref, "deny", cookies)
+	location, err = url.Parse(resp.Header.Get("Location"))
+	if err != nil || location.Query().Get("error") != "access_denied" {
+		t.Fatalf("Unexpected redirect: %s %s", resp.Status, resp.Header.Get("Location"))
+	}
+}
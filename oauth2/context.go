@@ -0,0 +1,120 @@
+package oauth2
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ContextStateKeeper is a StateKeeper that accepts a context, so a slow
+// storage engine can be cancelled when the request that uses it is. Handlers
+// pass the context of the HTTP request.
+type ContextStateKeeper interface {
+	PersistContext(ctx context.Context, key string, data string, lifetime time.Duration) error
+	RestoreContext(ctx context.Context, key string) (string, error)
+}
+
+// ContextExclusiveStateKeeper is an ExclusiveStateKeeper that accepts a
+// context.
+type ContextExclusiveStateKeeper interface {
+	ContextStateKeeper
+	PersistNewContext(ctx context.Context, key string, data string, lifetime time.Duration) (bool, error)
+}
+
+// ContextAuthz is an Authz that accepts a context when mapping a user on
+// scopes.
+type ContextAuthz interface {
+	ScopeSet
+	// ScopeSetForContext() returns the given user's authorized scopeset.
+	ScopeSetForContext(ctx context.Context, u *User) (ScopeSet, error)
+}
+
+// stateKeeperAdapter makes a StateKeeper a ContextStateKeeper by ignoring the
+// context.
+type stateKeeperAdapter struct {
+	StateKeeper
+}
+
+func (a stateKeeperAdapter) PersistContext(ctx context.Context, key string, data string, lifetime time.Duration) error {
+	return a.Persist(key, data, lifetime)
+}
+
+func (a stateKeeperAdapter) RestoreContext(ctx context.Context, key string) (string, error) {
+	return a.Restore(key)
+}
+
+// exclusiveStateKeeperAdapter makes an ExclusiveStateKeeper a
+// ContextExclusiveStateKeeper by ignoring the context.
+type exclusiveStateKeeperAdapter struct {
+	stateKeeperAdapter
+	exclusive ExclusiveStateKeeper
+}
+
+func (a exclusiveStateKeeperAdapter) PersistNewContext(ctx context.Context, key string, data string, lifetime time.Duration) (bool, error) {
+	return a.exclusive.PersistNew(key, data, lifetime)
+}
+
+// contextStateKeeper returns engine as a ContextStateKeeper, adapting it if
+// it doesn't accept contexts itself. The adapter is a
+// ContextExclusiveStateKeeper if engine is an ExclusiveStateKeeper.
+func contextStateKeeper(engine StateKeeper) ContextStateKeeper {
+	if c, ok := engine.(ContextStateKeeper); ok {
+		return c
+	}
+	if e, ok := engine.(ExclusiveStateKeeper); ok {
+		return exclusiveStateKeeperAdapter{stateKeeperAdapter{engine}, e}
+	}
+	return stateKeeperAdapter{engine}
+}
+
+// authzAdapter makes an Authz a ContextAuthz by ignoring the context.
+type authzAdapter struct {
+	Authz
+}
+
+func (a authzAdapter) ScopeSetForContext(ctx context.Context, u *User) (ScopeSet, error) {
+	return a.ScopeSetFor(u)
+}
+
+// contextAuthz returns p as a ContextAuthz, adapting it if it doesn't accept
+// contexts itself.
+func contextAuthz(p Authz) ContextAuthz {
+	if c, ok := p.(ContextAuthz); ok {
+		return c
+	}
+	return authzAdapter{p}
+}
+
+type traceKey struct{}
+
+// trace holds the request identifier of an incoming request.
+type trace struct {
+	header string
+	id     string
+}
+
+// TraceID returns the name of the trace header and the request identifier of
+// the incoming request, as set by the TraceHeader option, from the request's
+// context. IdPs and other components can set it on outgoing requests so the
+// identifier propagates. The header is empty if there is no identifier.
+func TraceID(ctx context.Context) (header string, id string) {
+	if t, ok := ctx.Value(traceKey{}).(*trace); ok {
+		return t.header, t.id
+	}
+	return "", ""
+}
+
+// withTrace adds the request identifier in the trace header to the contexts
+// of requests.
+func (h *handler) withTrace(next http.Handler) http.Handler {
+	if h.traceHeader == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.Header.Get(h.traceHeader); id != "" {
+			ctx := context.WithValue(r.Context(), traceKey{}, &trace{h.traceHeader, id})
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,84 @@
+package oauth2
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testContextAuthz records the trace id from the context it's called with.
+type testContextAuthz struct {
+	*testAuthz
+	traceID string
+}
+
+func (a *testContextAuthz) ScopeSetForContext(ctx context.Context, u *User) (ScopeSet, error) {
+	_, a.traceID = TraceID(ctx)
+	return a.ScopeSetFor(u)
+}
+
+// testContextStateKeeper records the contexts it's called with.
+type testContextStateKeeper struct {
+	*stateMap
+	traceIDs []string
+}
+
+func (k *testContextStateKeeper) PersistContext(ctx context.Context, key string, data string, lifetime time.Duration) error {
+	_, id := TraceID(ctx)
+	k.traceIDs = append(k.traceIDs, id)
+	return k.Persist(key, data, lifetime)
+}
+
+func (k *testContextStateKeeper) PersistNewContext(ctx context.Context, key string, data string, lifetime time.Duration) (bool, error) {
+	_, id := TraceID(ctx)
+	k.traceIDs = append(k.traceIDs, id)
+	return k.PersistNew(key, data, lifetime)
+}
+
+func (k *testContextStateKeeper) RestoreContext(ctx context.Context, key string) (string, error) {
+	_, id := TraceID(ctx)
+	k.traceIDs = append(k.traceIDs, id)
+	return k.Restore(key)
+}
+
+func TestRequestContext(t *testing.T) {
+	authz := &testContextAuthz{
+		testAuthz: newTestAuthz(map[string][]string{"user:1": []string{"scope:1"}}),
+	}
+	engine := &testContextStateKeeper{stateMap: newStateMap(0, time.Hour)}
+	defer engine.Close()
+	handler, err := Handler(
+		"http://test/",
+		`{ "keys": [{ "kty": "oct", "key_ops": ["sign"], "kid": "1", "alg": "HS256", "k": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4=" }]}`,
+		IDProvider(&testIDP{BaseURL: "http://test/", Users: []*User{&User{UID: "user:1"}}}),
+		Clients(testClientMap{&Client{ID: "client", Redirects: []string{"http://testurl/"}, GrantType: "token"}}),
+		ContextAuthzProvider(authz),
+		ContextStateStorage(engine, time.Minute),
+		TraceHeader("X-Unique-ID"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authzReq := httptest.NewRequest("GET", "http://test/oauth2/authorize?client_id=client&response_type=token&scope=scope:1&idp_id=testidp", nil)
+	authzReq.Header.Set("X-Unique-ID", "authorize")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, authzReq)
+	callbackReq := httptest.NewRequest("GET", w.Result().Header.Get("Location")+"&uid=user:1", nil)
+	callbackReq.Header.Set("X-Unique-ID", "callback")
+	for _, cookie := range w.Result().Cookies() {
+		callbackReq.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, callbackReq)
+	if w.Code != 303 {
+		t.Fatalf("Unexpected response (expected 303, got %d)", w.Code)
+	}
+	if authz.traceID != "callback" {
+		t.Fatalf("Authz provider didn't get the request context: %q", authz.traceID)
+	}
+	// The first three calls are the handler's storage check
+	if n := len(engine.traceIDs); n != 5 || engine.traceIDs[3] != "authorize" || engine.traceIDs[4] != "callback" {
+		t.Fatalf("State storage didn't get the request contexts: %q", engine.traceIDs)
+	}
+}
@@ -0,0 +1,151 @@
+package oauth2
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// stateCookiePrefix is the prefix of the name of state cookies. The cookie
+// name ends with the authzRef token the state belongs to.
+const stateCookiePrefix = "authz_state_"
+
+// sealedState is the content of a state cookie.
+type sealedState struct {
+	Expires int64  `json:"exp"`
+	Data    []byte `json:"data"`
+}
+
+// stateCookies keeps authorization state in encrypted cookies in the user
+// agent rather than in a StateKeeper. The cookie is bound to the authzRef
+// token, so it can only be restored in the callback of the authorization
+// request it was created for, and it is restored only once: the tokens of
+// consumed cookies are kept until the cookies expire.
+//
+// The consumed tokens are kept in memory, so when running multiple nodes each
+// node only prevents replays of cookies it has seen itself.
+type stateCookies struct {
+	sealer   *sealer
+	lifetime time.Duration
+	path     string
+	secure   bool
+	consumed *replayCache
+}
+
+func newStateCookies(keys [][]byte, lifetime time.Duration, callbackURL string, secure bool) (*stateCookies, error) {
+	s, err := newSealer(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &stateCookies{
+		sealer:   s,
+		lifetime: lifetime,
+		path:     callbackURL,
+		secure:   secure,
+		consumed: newReplayCache(),
+	}, nil
+}
+
+// persist seals the given data into a cookie for the given authzRef token.
+func (c *stateCookies) persist(w http.ResponseWriter, authzRef string, data interface{}) error {
+	encodedData, err := encodeState(data)
+	if err != nil {
+		return err
+	}
+	state := sealedState{
+		Expires: time.Now().Add(c.lifetime).Unix(),
+		Data:    encodedData,
+	}
+	encoded, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	name := stateCookiePrefix + authzRef
+	sealed, err := c.sealer.seal(encoded, []byte(name))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, c.cookie(name, base64.RawURLEncoding.EncodeToString(sealed)))
+	return nil
+}
+
+// restore opens the cookie for the given authzRef token, decodes it into v
+// and removes the cookie.
+func (c *stateCookies) restore(w http.ResponseWriter, r *http.Request, authzRef string, v interface{}) error {
+	name := stateCookiePrefix + authzRef
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return errors.New("State cookie missing")
+	}
+	// Remove the cookie, whether it's valid or not
+	expired := c.cookie(name, "")
+	expired.MaxAge = -1
+	http.SetCookie(w, expired)
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return err
+	}
+	encoded, err := c.sealer.open(sealed, []byte(name))
+	if err != nil {
+		return err
+	}
+	var state sealedState
+	if err := json.Unmarshal(encoded, &state); err != nil {
+		return err
+	}
+	expires := time.Unix(state.Expires, 0)
+	if time.Now().After(expires) {
+		return errors.New("State cookie expired")
+	}
+	if !c.consumed.add(authzRef, expires) {
+		return errors.New("State cookie already used")
+	}
+	return decodeState(state.Data, v)
+}
+
+func (c *stateCookies) cookie(name string, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     c.path,
+		MaxAge:   int(c.lifetime.Seconds()),
+		Secure:   c.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// replayCache holds identifiers that have been used until they expire.
+type replayCache struct {
+	expiries  map[string]time.Time
+	lastPurge time.Time
+	mutex     sync.Mutex
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{expiries: make(map[string]time.Time)}
+}
+
+// add adds the given id, which is valid until expires. It returns false if
+// the id has been added before.
+func (c *replayCache) add(id string, expires time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastPurge) > time.Minute {
+		for k, exp := range c.expiries {
+			if now.After(exp) {
+				delete(c.expiries, k)
+			}
+		}
+		c.lastPurge = now
+	}
+	if _, ok := c.expiries[id]; ok {
+		return false
+	}
+	c.expiries[id] = expires
+	return true
+}
@@ -0,0 +1,62 @@
+package oauth2
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCookieHandler(t *testing.T) http.Handler {
+	clients := []*Client{
+		&Client{ID: "testclient_single_redirect", Redirects: []string{"http://testurl/"}, GrantType: "token"},
+	}
+	return testClientHandler(t, clients, StateCookies([][]byte{bytes.Repeat([]byte{1}, 32)}, time.Minute))
+}
+
+func TestStateCookies(t *testing.T) {
+	handler := testCookieHandler(t)
+	authzReq := httptest.NewRequest("GET", "http://test/oauth2/authorize?client_id=testclient_single_redirect&response_type=token&scope=scope:1&idp_id=testidp", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, authzReq)
+	var stateCookie, bindingCookie *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if strings.HasPrefix(cookie.Name, stateCookiePrefix) {
+			stateCookie = cookie
+		} else {
+			bindingCookie = cookie
+		}
+	}
+	if stateCookie == nil || !stateCookie.HttpOnly || stateCookie.Path != "/oauth2/callback/" {
+		t.Fatalf("Expected a state cookie, got %v", w.Result().Cookies())
+	}
+	callback := w.Result().Header.Get("Location") + "&uid=user:1"
+	callbackReq := func(cookie *http.Cookie) *http.Response {
+		r := httptest.NewRequest("GET", callback, nil)
+		r.AddCookie(bindingCookie)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+	// Missing and tampered cookies are rejected
+	expectBadRequest("missing state cookie", t, callbackReq(nil), "invalid state token\n")
+	tampered := *stateCookie
+	tampered.Value = tampered.Value[:len(tampered.Value)-2] + "AA"
+	expectBadRequest("tampered state cookie", t, callbackReq(&tampered), "invalid state token\n")
+	// Valid cookie is accepted once
+	resp := callbackReq(stateCookie)
+	if resp.StatusCode != 303 {
+		t.Fatalf("Unexpected response (expected 303, got %d)", resp.StatusCode)
+	}
+	for _, cleared := range resp.Cookies() {
+		if cleared.MaxAge >= 0 {
+			t.Fatalf("Expected cookie to be removed, got %v", cleared)
+		}
+	}
+	expectBadRequest("replayed state cookie", t, callbackReq(stateCookie), "invalid state token\n")
+}
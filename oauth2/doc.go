@@ -2,8 +2,14 @@
 Package oauth2 provides a fully customizable OAuth 2.0 authorization service
 http.handler.
 
-This package currently supports the implicit flow only. Other flows will be
-supported in the future. See RFC6749 for more details.
+This package supports the implicit flow and the authorization code flow, in
+which clients exchange authorization codes at the token endpoint,
+/oauth2/token. See RFC6749 for more details.
+
+Clients opt in to the authorization code flow by listing their grant types or
+response types. Clients that only have grant type "code" get an access token
+in the fragment of the redirect, as in the implicit flow, as they did before
+the token endpoint existed.
 
 To use oauth2, create a handler and run an HTTP server:
 
@@ -50,6 +56,8 @@ A minimally useful service provides implementations of:
 
 If you run the service on more than a single node you may also want to use external
 state storage such as Redis. To do so, implement the oauth2.StateKeeper interface.
+Alternatively, the StateCookies option keeps the state of authorization requests
+in encrypted cookies in the user agent.
 
 */
 package oauth2
@@ -0,0 +1,43 @@
+package oauth2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/amsterdam/authz/dpop"
+)
+
+// dpopReplayCache is a dpop.ReplayCache that remembers used proofs in the
+// state storage, so proofs can't be replayed at other nodes.
+type dpopReplayCache struct {
+	h *handler
+}
+
+// Claim implements dpop.ReplayCache.
+func (c *dpopReplayCache) Claim(ctx context.Context, key string, expires time.Time) (bool, error) {
+	err := c.h.stateStore.claimOnce(ctx, key, time.Until(expires))
+	if err == errReplay {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// verifyDPoP verifies the DPoP proof of a token request, if any, and returns
+// the thumbprint of the key that the access token must be bound to.
+func (h *handler) verifyDPoP(r *http.Request) (string, error) {
+	proofs := r.Header[http.CanonicalHeaderKey(dpop.ProofHeader)]
+	switch len(proofs) {
+	case 0:
+		return "", nil
+	case 1:
+	default:
+		return "", errors.New("multiple DPoP proofs")
+	}
+	proof, err := h.dpop.Verify(r.Context(), proofs[0], "POST", h.tokenURL.String(), "")
+	if err != nil {
+		return "", err
+	}
+	return proof.Thumbprint, nil
+}
@@ -0,0 +1,131 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/amsterdam/authz/dpop"
+	"github.com/amsterdam/authz/jose"
+)
+
+func testDPoPProof(t *testing.T, keys *jose.JWKSet, jti string, nonce string) string {
+	proof, err := keys.EncodeEmbedded("client", "dpop+jwt", map[string]interface{}{
+		"jti": jti, "htm": "POST", "htu": "http://test/oauth2/token",
+		"iat": time.Now().Unix(), "nonce": nonce,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+func TestTokenDPoP(t *testing.T) {
+	handler := testTokenHandler(t)
+	keys, err := jose.LoadJWKSet([]byte(testClientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jkt, _ := keys.Thumbprint("client")
+	code := testCode(t, handler, "public_client")
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"public_client"}}
+	// Invalid proofs are rejected before the code is used
+	r := testTokenFormRequest(form)
+	r.Header.Set(dpop.ProofHeader, "invalid")
+	if resp, _, e := testTokenResponse(handler, r); resp.StatusCode != http.StatusBadRequest || e.Code != "invalid_dpop_proof" {
+		t.Fatalf("Invalid proof accepted: %s %+v", resp.Status, e)
+	}
+	r = testTokenFormRequest(form)
+	r.Header.Set(dpop.ProofHeader, testDPoPProof(t, keys, "1", ""))
+	resp, token, e := testTokenResponse(handler, r)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Token request failed: %s %+v", resp.Status, e)
+	}
+	if token.TokenType != "DPoP" {
+		t.Errorf("Unexpected token type: %s", token.TokenType)
+	}
+	var payload accessTokenPayload
+	if err := jose.DecodeUnverified(token.AccessToken, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Confirm == nil || payload.Confirm.JKT != jkt {
+		t.Errorf("Access token not bound to DPoP key: %+v", payload.Confirm)
+	}
+	// Replayed proofs are rejected
+	code = testCode(t, handler, "public_client")
+	form.Set("code", code)
+	r = testTokenFormRequest(form)
+	r.Header.Set(dpop.ProofHeader, testDPoPProof(t, keys, "1", ""))
+	if resp, _, e := testTokenResponse(handler, r); resp.StatusCode != http.StatusBadRequest || e.Code != "invalid_dpop_proof" {
+		t.Fatalf("Replayed proof accepted: %s %+v", resp.Status, e)
+	}
+}
+
+func TestTokenDPoPJKT(t *testing.T) {
+	handler := testTokenHandler(t)
+	keys, err := jose.LoadJWKSet([]byte(testClientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jkt, _ := keys.Thumbprint("client")
+	// Codes issued for a dpop_jkt require a proof using that key
+	code := testCodeWithParams(t, handler, "public_client", url.Values{"dpop_jkt": {jkt}})
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"public_client"}}
+	if resp, _, e := testTokenRequest(handler, form); resp.StatusCode != http.StatusBadRequest || e.Code != "invalid_dpop_proof" {
+		t.Fatalf("Code bound to DPoP key used without proof: %s %+v", resp.Status, e)
+	}
+	code = testCodeWithParams(t, handler, "public_client", url.Values{"dpop_jkt": {jkt}})
+	form.Set("code", code)
+	r := testTokenFormRequest(form)
+	r.Header.Set(dpop.ProofHeader, testDPoPProof(t, keys, "2", ""))
+	if resp, _, e := testTokenResponse(handler, r); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Token request failed: %s %+v", resp.Status, e)
+	}
+}
+
+func TestImplicitDPoPJKT(t *testing.T) {
+	handler := testTokenHandler(t)
+	location := testAuthorize(t, handler, "implicit_client", url.Values{
+		"response_type": {"token"}, "dpop_jkt": {"thumbprint"},
+	})
+	fragment, err := url.ParseQuery(location.Fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fragment.Get("token_type") != "DPoP" {
+		t.Fatalf("Unexpected token type: %s", fragment.Get("token_type"))
+	}
+	var payload accessTokenPayload
+	if err := jose.DecodeUnverified(fragment.Get("access_token"), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Confirm == nil || payload.Confirm.JKT != "thumbprint" {
+		t.Errorf("Access token not bound to DPoP key: %+v", payload.Confirm)
+	}
+}
+
+func TestTokenDPoPNonces(t *testing.T) {
+	handler := testClientHandler(t,
+		[]*Client{&Client{ID: "public_client", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}}},
+		DPoPNonces([]byte("0123456789abcdef"), time.Minute),
+	)
+	keys, err := jose.LoadJWKSet([]byte(testClientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := testCode(t, handler, "public_client")
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"public_client"}}
+	r := testTokenFormRequest(form)
+	r.Header.Set(dpop.ProofHeader, testDPoPProof(t, keys, "1", ""))
+	resp, _, e := testTokenResponse(handler, r)
+	nonce := resp.Header.Get(dpop.NonceHeader)
+	if resp.StatusCode != http.StatusBadRequest || e.Code != "use_dpop_nonce" || nonce == "" {
+		t.Fatalf("Proof without nonce accepted: %s %+v", resp.Status, e)
+	}
+	r = testTokenFormRequest(form)
+	r.Header.Set(dpop.ProofHeader, testDPoPProof(t, keys, "2", nonce))
+	if resp, _, e := testTokenResponse(handler, r); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Token request failed: %s %+v", resp.Status, e)
+	}
+}
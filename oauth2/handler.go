@@ -1,7 +1,9 @@
 package oauth2
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
 	"net/http"
@@ -10,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/amsterdam/authz/dpop"
 	"github.com/amsterdam/authz/jose"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
@@ -17,13 +20,28 @@ import (
 
 type handler struct {
 	callbackURL url.URL
+	registerURL url.URL
+	tokenURL    url.URL
+	consentURL  url.URL
 
 	// Components / interfaces
 	accessTokenEnc *accessTokenEncoder
 	stateStore     *stateStorage
-	authz          Authz
+	stateCookies   *stateCookies
+	stateSealer    *sealer
+	authz          ContextAuthz
 	idps           map[string]IDP
+	resources      map[string]ResourceServer
+	claims         ClaimsFunc
+	pairwiseKey    []byte
 	clientMap      ClientMap
+	clientRegistry ClientRegistry
+	remoteKeys     *remoteKeySets
+	secretLimiter  *secretLimiter
+	mtls           bool
+	mtlsRoots      *x509.CertPool
+	dpop           *dpop.Verifier
+	initialTokens  []string
 	traceHeader    string
 }
 
@@ -34,15 +52,34 @@ func Handler(baseURL string, jwks string, options ...Option) (http.Handler, erro
 	if err != nil {
 		return nil, err
 	}
-	u, err = u.Parse("oauth2/callback/")
+	callbackURL, err := u.Parse("oauth2/callback/")
+	if err != nil {
+		return nil, err
+	}
+	registerURL, err := u.Parse("oauth2/register/")
+	if err != nil {
+		return nil, err
+	}
+	tokenURL, err := u.Parse("oauth2/token")
+	if err != nil {
+		return nil, err
+	}
+	consentURL, err := u.Parse("oauth2/consent")
 	if err != nil {
 		return nil, err
 	}
 	// Create handler
 	h := &handler{
-		callbackURL: *u,
+		callbackURL: *callbackURL,
+		registerURL: *registerURL,
+		tokenURL:    *tokenURL,
+		consentURL:  *consentURL,
+		remoteKeys:  newRemoteKeySets(),
 		idps:        make(map[string]IDP),
+		resources:   make(map[string]ResourceServer),
 	}
+	h.secretLimiter = newSecretLimiter(secretMaxFailures, secretFailureWindow)
+	h.dpop = dpop.NewVerifier(&dpopReplayCache{h})
 	// Create JWKSet
 	jwkset, err := jose.LoadJWKSet([]byte(jwks))
 	if err != nil {
@@ -60,17 +97,28 @@ func Handler(baseURL string, jwks string, options ...Option) (http.Handler, erro
 			return nil, err
 		}
 	}
+	if err := h.accessTokenEnc.checkKey(); err != nil {
+		return nil, err
+	}
 	// Set default transient store if none given
 	if h.stateStore == nil {
-		log.Warnln("Using in-memory state storage")
-		h.stateStore = newStateStorage(newStateMap(), 60*time.Second)
-	} else {
-		h.checkStateStore()
+		if h.stateCookies == nil {
+			log.Warnln("Using in-memory state storage")
+		} else {
+			// Authorization state is in cookies, but the rest isn't
+			log.Warnln("Using in-memory state storage for authorization codes, consent and replay records, which only works when running a single node")
+		}
+		h.stateStore = newStateStorage(
+			contextStateKeeper(newStateMap(defaultStateMapMaxEntries, stateMapSweepInterval)),
+			60*time.Second,
+		)
 	}
+	h.stateStore.sealer = h.stateSealer
+	h.checkStateStore()
 	// Set default scopeset if no authz provider is given
 	if h.authz == nil {
 		log.Warnln("using empty scope set")
-		h.authz = &emptyScopeSet{}
+		h.authz = contextAuthz(&emptyScopeSet{})
 	}
 	// Set default clientmap if no ClientMap is given
 	if h.clientMap == nil {
@@ -86,27 +134,38 @@ func Handler(baseURL string, jwks string, options ...Option) (http.Handler, erro
 	mux.HandleFunc(
 		"/oauth2/authorize", timedHandler(h.serveAuthorizationRequest, "authorize"),
 	)
+	mux.HandleFunc("/oauth2/token", timedHandler(h.serveTokenRequest, "token"))
+	mux.HandleFunc("/oauth2/consent", timedHandler(h.serveConsent, "consent"))
 	// Register one callback per idp so we can route correctly
 	for idpID := range h.idps {
 		path := fmt.Sprintf("/oauth2/callback/%s", idpID)
 		mux.HandleFunc(path, timedHandler(h.serveIDPCallback, idpID+"_callback"))
 	}
+	// Dynamic client registration and management
+	if h.clientRegistry != nil {
+		mux.HandleFunc("/oauth2/register", timedHandler(h.serveRegistration, "register"))
+		mux.HandleFunc("/oauth2/register/", timedHandler(h.serveClientConfiguration, "client_configuration"))
+	}
 	// Register Prometheis metrics endpoint
 	mux.Handle("/metrics", promhttp.Handler())
-	return mux, nil
+	return h.withTrace(mux), nil
 }
 
 // checkStateStore makes sure a key / value pair is only restored once
 func (h *handler) checkStateStore() {
-	if err := h.stateStore.persist("test", struct{}{}); err != nil {
+	ctx := context.Background()
+	if err := h.stateStore.persist(ctx, "test", struct{}{}); err != nil {
 		log.Fatalf("State storage not working: %v\n", err)
 	}
-	if err := h.stateStore.restore("test", &struct{}{}); err != nil {
+	if err := h.stateStore.restore(ctx, "test", &struct{}{}); err != nil {
 		log.Fatalf("State storage not working: %v\n", err)
 	}
-	if err := h.stateStore.restore("test", &struct{}{}); err == nil {
+	if err := h.stateStore.restore(ctx, "test", &struct{}{}); err == nil {
 		log.Fatal("State storage not working: doesn't remove key on first restore")
 	}
+	if _, ok := h.stateStore.engine.(ContextExclusiveStateKeeper); !ok {
+		log.Warnln("State storage can't claim one-time keys atomically, so concurrent replays may be accepted")
+	}
 }
 
 func (h *handler) logger(r *http.Request) *log.Entry {
@@ -192,7 +251,7 @@ func (h *handler) serveAuthorizationRequest(
 		logger.Infoln("invalid_request: response_type missing")
 		return
 	}
-	if responseType[0] != client.GrantType {
+	if !client.allowsResponseType(responseType[0]) {
 		h.errorResponse(
 			w, redirectURI, "unsupported_response_type",
 			"response_type not supported for client",
@@ -200,16 +259,27 @@ func (h *handler) serveAuthorizationRequest(
 		logger.Infoln("unsupported_response_type: response_type not supported for client")
 		return
 	}
-	authzState.ResponseType = client.GrantType
+	authzState.ResponseType = responseType[0]
+	// code_challenge and code_challenge_method (RFC 7636 section 4.3)
+	if err := authzState.setCodeChallenge(client, query); err != nil {
+		h.errorResponse(w, redirectURI, "invalid_request", err.Error())
+		logger.Infof("invalid_request: %v", err)
+		return
+	}
 	// state
 	if s, ok := query["state"]; ok {
 		authzState.State = s[0]
 	}
+	// dpop_jkt binds the access token to the client's DPoP key (RFC 9449
+	// section 10)
+	if jkt, ok := query["dpop_jkt"]; ok {
+		authzState.DPoPJKT = jkt[0]
+	}
 	// scope
 	scopeMap := make(map[string]struct{})
 	if s, ok := query["scope"]; ok {
 		for _, scope := range strings.Split(s[0], " ") {
-			if !h.authz.ValidScope(scope) {
+			if !h.authz.ValidScope(scope) || (!client.allowsScope(scope) && !client.dropsScopes()) {
 				h.errorResponse(
 					w, redirectURI, "invalid_scope",
 					fmt.Sprintf("invalid scope: %s", scope),
@@ -217,6 +287,10 @@ func (h *handler) serveAuthorizationRequest(
 				logger.Infof("invalid scope: %s", scope)
 				return
 			}
+			if !client.allowsScope(scope) {
+				logger.Infof("Dropped scope not allowed for client: %s", scope)
+				continue
+			}
 			scopeMap[scope] = struct{}{}
 		}
 	}
@@ -226,6 +300,14 @@ func (h *handler) serveAuthorizationRequest(
 		authzState.Scope[i] = k
 		i++
 	}
+	// resource (RFC 8707 section 2)
+	resources, err := h.resourceIndicators(query["resource"])
+	if err != nil {
+		h.errorResponse(w, redirectURI, "invalid_target", err.Error())
+		logger.Infof("invalid_target: %v", err)
+		return
+	}
+	authzState.Resources = resources
 	// Validate IDP and get idp handler url for this request
 	if idpID, ok := query["idp_id"]; ok {
 		authzState.IDPID = idpID[0]
@@ -234,13 +316,18 @@ func (h *handler) serveAuthorizationRequest(
 			logger.Infoln("invalid_request: unknown idp_id")
 			return
 		}
+		if !client.allowsIDP(authzState.IDPID) {
+			h.errorResponse(w, redirectURI, "invalid_request", "idp_id not allowed for client")
+			logger.Infoln("invalid_request: idp_id not allowed for client")
+			return
+		}
 	} else {
 		h.errorResponse(w, redirectURI, "invalid_request", "idp_id missing")
 		logger.Infoln("invalid_request: idp_id missing")
 		return
 	}
 	// Create authn session
-	authnRedirect, err := h.authnSession(idp, authzState)
+	authnRedirect, err := h.authnSession(w, r, idp, authzState)
 	if err != nil {
 		h.errorResponse(w, redirectURI, "server_error", "internal server error")
 		logger.WithError(err).Errorln("Couldn't save session")
@@ -282,11 +369,16 @@ func (h *handler) serveIDPCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var state authorizationState
-	if err := h.stateStore.restore(string(authzRef), &state); err != nil {
+	if err := h.restoreAuthzState(w, r, authzRef, &state); err != nil {
 		logger.WithError(err).Errorln("Error restoring state")
 		http.Error(w, "invalid state token", http.StatusBadRequest)
 		return
 	}
+	if err := h.checkUserAgentBinding(w, r, h.callbackURL.Path, authzRef, state.BindingHash); err != nil {
+		logger.WithError(err).Warnln("Callback from another user agent")
+		http.Error(w, "authorization request not started in this browser", http.StatusBadRequest)
+		return
+	}
 	redirectURI, err := url.Parse(state.RedirectURI)
 	if err != nil {
 		logger.WithError(err).Errorf("Error reconstructing redirect_uri from unmarshalled state: %v\n", state.RedirectURI)
@@ -297,43 +389,92 @@ func (h *handler) serveIDPCallback(w http.ResponseWriter, r *http.Request) {
 		h.errorResponse(w, redirectURI, "access_denied", "couldn't authenticate user")
 		return
 	}
+	client, err := h.clientMap.Get(state.ClientID)
+	if err != nil {
+		h.errorResponse(w, redirectURI, "unauthorized_client", "unknown client")
+		logger.WithError(err).Infoln("unauthorized_client: unknown client")
+		return
+	}
 	grantedScopes := []string{}
 	if len(state.Scope) > 0 {
-		userScopes, err := h.authz.ScopeSetFor(user)
+		userScopes, err := h.authz.ScopeSetForContext(r.Context(), user)
 		if err != nil {
 			logger.WithError(err).Errorln("Error getting scopes for user")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		for _, scope := range state.Scope {
-			if userScopes.ValidScope(scope) {
+			if userScopes.ValidScope(scope) && client.allowsScope(scope) {
 				grantedScopes = append(grantedScopes, scope)
 			}
 		}
 	}
-	accessToken, err := h.accessTokenEnc.Encode(user.UID, grantedScopes)
+	subject, err := h.subject(client, user.UID)
+	if err != nil {
+		logger.WithError(err).Errorln("Error computing subject")
+		h.errorResponse(w, redirectURI, "server_error", "internal server error")
+		return
+	}
+	authn := &authentication{Subject: subject, AuthTime: time.Now().Unix(), ACR: user.ACR}
+	if subject != user.UID {
+		authn.UID = user.UID
+	}
+	if h.claims != nil {
+		authn.Claims = h.claims(user, client, grantedScopes)
+	}
+	if client.RequireConsent {
+		if err := h.consentPage(w, r, client, &state, authn, grantedScopes); err != nil {
+			logger.WithError(err).Errorln("Error asking for consent")
+			h.errorResponse(w, redirectURI, "server_error", "internal server error")
+			return
+		}
+		logger.WithFields(authn.logFields()).Info("Asked user for consent")
+		return
+	}
+	h.authorizationResponse(w, r, redirectURI, client, &state, authn, grantedScopes, logger)
+}
+
+// authorizationResponse issues an authorization code or an access token to
+// the client and redirects the user agent to it.
+func (h *handler) authorizationResponse(w http.ResponseWriter, r *http.Request, redirectURI *url.URL, client *Client, state *authorizationState, authn *authentication, grantedScopes []string, logger *log.Entry) {
+	if state.ResponseType == "code" && client.exchangesCodes() {
+		if err := h.codeResponse(w, r, redirectURI, state, authn, grantedScopes); err != nil {
+			logger.WithError(err).Errorln("Error issuing authorization code")
+			h.errorResponse(w, redirectURI, "server_error", "internal server error")
+			return
+		}
+		logger.WithFields(authn.logFields()).Info("Authorization code issued")
+		return
+	}
+	grant := h.tokenGrant(client, authn, grantedScopes, state.Resources)
+	tokenType := "bearer"
+	if state.DPoPJKT != "" {
+		grant.Confirm = &confirmation{JKT: state.DPoPJKT}
+		tokenType = "DPoP"
+	}
+	accessToken, err := h.accessTokenEnc.EncodeGrant(grant)
 	if err != nil {
 		logger.WithError(err).Errorln("Error encoding accesstoken")
 		h.errorResponse(w, redirectURI, "server_error", "internal server error")
 		return
 	}
 	h.implicitResponse(
-		w, redirectURI, accessToken, "bearer", h.accessTokenEnc.Lifetime,
-		grantedScopes, state.State,
+		w, redirectURI, accessToken, tokenType, grant.Lifetime,
+		grant.Scopes, state.State,
 	)
 	// Auditlog
 	sigIdx := strings.LastIndex(accessToken, ".") + 1
-	logger.WithFields(log.Fields{
-		"sub":            user.UID,
+	logger.WithFields(authn.logFields()).WithFields(log.Fields{
 		"tokensignature": accessToken[sigIdx:],
-		"scopes":         grantedScopes,
-		"expires_in":     h.accessTokenEnc.Lifetime,
+		"scopes":         grant.Scopes,
+		"aud":            grant.Audience,
+		"expires_in":     grant.Lifetime,
 	}).Info("User authorized")
 }
 
 // authnSession saves the current state of the authorization request and
 // returns a redirect URL for the given idp
-func (h *handler) authnSession(idp IDP, state *authorizationState) (string, error) {
+func (h *handler) authnSession(w http.ResponseWriter, r *http.Request, idp IDP, state *authorizationState) (string, error) {
 	// Create token
 	token := make([]byte, 16)
 	rand.Read(token)
@@ -343,12 +484,36 @@ func (h *handler) authnSession(idp IDP, state *authorizationState) (string, erro
 	if err != nil {
 		return "", err
 	}
-	if err := h.stateStore.persist(b64Token, state); err != nil {
+	// Bind the authorization request to the user agent
+	bindingHash, err := h.bindUserAgent(w, h.callbackURL.Path, b64Token)
+	if err != nil {
+		return "", err
+	}
+	state.BindingHash = bindingHash
+	if err := h.persistAuthzState(w, r, b64Token, state); err != nil {
 		return "", err
 	}
 	return redir.String(), nil
 }
 
+// persistAuthzState saves the state of the authorization request, in a state
+// cookie if configured or in the state storage otherwise.
+func (h *handler) persistAuthzState(w http.ResponseWriter, r *http.Request, authzRef string, state *authorizationState) error {
+	if h.stateCookies != nil {
+		return h.stateCookies.persist(w, authzRef, state)
+	}
+	return h.stateStore.persist(r.Context(), authzRef, state)
+}
+
+// restoreAuthzState restores the state of the authorization request saved by
+// persistAuthzState.
+func (h *handler) restoreAuthzState(w http.ResponseWriter, r *http.Request, authzRef string, state *authorizationState) error {
+	if h.stateCookies != nil {
+		return h.stateCookies.restore(w, r, authzRef, state)
+	}
+	return h.stateStore.restore(r.Context(), authzRef, state)
+}
+
 // oauth20Error
 func (h *handler) errorResponse(
 	w http.ResponseWriter, r *url.URL, code string, desc string) {
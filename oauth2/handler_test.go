@@ -65,6 +65,22 @@ func testHandler(tokenSecret string) http.Handler {
 	return handler
 }
 
+// testClientHandler creates a handler for the given clients that signs tokens
+// using testTokenJWKS, with an IdP that knows user:1 and an authz provider
+// that gives user:1 scope:1 and scope:2. Extra options are applied last, so
+// they can replace the IdP and authz provider.
+func testClientHandler(t *testing.T, clients []*Client, options ...Option) http.Handler {
+	handler, err := Handler("http://test/", testTokenJWKS, append([]Option{
+		Clients(testClientMap(clients)),
+		IDProvider(&testIDP{BaseURL: "http://test/", Users: []*User{&User{UID: "user:1"}}}),
+		AuthzProvider(newTestAuthz(map[string][]string{"user:1": []string{"scope:1", "scope:2"}})),
+	}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
 // Verify responses from valid and invalid authz requests
 // This function does not verify the callback
 func TestAuthorizationHandler(t *testing.T) {
@@ -267,9 +283,12 @@ func TestValidCallbackToken(t *testing.T) {
 func verifyCallbackToken(t *testing.T, redirectURI string) {
 	handler := testHandler("test")
 	// First, make a valid authz request to get a valid token
-	callback := validCallbackURL(t, handler, redirectURI)
+	callback, cookies := validCallbackURL(t, handler, redirectURI)
 	// Now make the valid callback request
 	callbackReq := httptest.NewRequest("GET", callback, nil)
+	for _, cookie := range cookies {
+		callbackReq.AddCookie(cookie)
+	}
 	w := httptest.NewRecorder()
 	handler.ServeHTTP(w, callbackReq)
 	resp := w.Result()
@@ -297,7 +316,7 @@ func verifyCallbackToken(t *testing.T, redirectURI string) {
 	}
 }
 
-func validCallbackURL(t *testing.T, handler http.Handler, redirectURI string) string {
+func validCallbackURL(t *testing.T, handler http.Handler, redirectURI string) (string, []*http.Cookie) {
 	authzReq := httptest.NewRequest("GET", "http://test/oauth2/authorize", nil)
 	q := authzReq.URL.Query()
 	q.Set("client_id", "testclient_wildcard_redirect")
@@ -327,7 +346,28 @@ func validCallbackURL(t *testing.T, handler http.Handler, redirectURI string) st
 	q = u.Query()
 	q.Set("uid", "user:1")
 	u.RawQuery = q.Encode()
-	return u.String()
+	return u.String(), r.Cookies()
+}
+
+func TestCallbackUserAgentBinding(t *testing.T) {
+	handler := testHandler("test")
+	for _, cookieValue := range []string{"", "other-secret"} {
+		callback, cookies := validCallbackURL(t, handler, "http://testurl/")
+		if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+			t.Fatalf("Expected a binding cookie, got %v", cookies)
+		}
+		callbackReq := httptest.NewRequest("GET", callback, nil)
+		if cookieValue != "" {
+			cookies[0].Value = cookieValue
+			callbackReq.AddCookie(cookies[0])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, callbackReq)
+		expectBadRequest(
+			"binding cookie "+cookieValue, t, w.Result(),
+			"authorization request not started in this browser\n",
+		)
+	}
 }
 
 ///////
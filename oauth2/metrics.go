@@ -16,8 +16,22 @@ var requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 	[]string{"endpoint", "status"},
 )
 
+var stateMapEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "oauth2",
+	Name:      "state_map_entries",
+	Help:      "Number of entries in the in-memory state storage.",
+})
+
+var stateMapEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "oauth2",
+	Name:      "state_map_evictions_total",
+	Help:      "Number of entries removed from the in-memory state storage without being restored.",
+},
+	[]string{"reason"},
+)
+
 func init() {
-	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(requestDuration, stateMapEntries, stateMapEvictions)
 }
 
 type httpHandler func(w http.ResponseWriter, r *http.Request)
@@ -0,0 +1,74 @@
+package oauth2
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+)
+
+// certThumbprint returns the base64url encoded SHA-256 hash of the DER
+// encoding of a certificate, which is its x5t#S256.
+func certThumbprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// clientCertificate returns the client certificate of the TLS connection of
+// the request, or nil.
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// usesMutualTLS returns true if the client authenticates using a client
+// certificate.
+func (c *Client) usesMutualTLS() bool {
+	return c.TLSSubjectDN != "" || len(c.TLSCertThumbprints) > 0
+}
+
+// authenticateCertificate authenticates a client using the client certificate
+// of the TLS connection (RFC 8705 section 2): a self-signed certificate with a
+// registered thumbprint, or a certificate with the registered subject DN that
+// was issued by a trusted CA.
+func (h *handler) authenticateCertificate(r *http.Request, client *Client) (*Client, error) {
+	cert := clientCertificate(r)
+	if !h.mtls || cert == nil {
+		return nil, &clientAuthError{"client certificate required", false}
+	}
+	thumbprint := []byte(certThumbprint(cert))
+	for _, t := range client.TLSCertThumbprints {
+		if subtle.ConstantTimeCompare([]byte(t), thumbprint) == 1 {
+			return client, nil
+		}
+	}
+	if client.TLSSubjectDN != "" && h.mtlsRoots != nil && cert.Subject.String() == client.TLSSubjectDN {
+		intermediates := x509.NewCertPool()
+		for _, c := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(c)
+		}
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:         h.mtlsRoots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err == nil {
+			return client, nil
+		}
+	}
+	return nil, &clientAuthError{"invalid client certificate", false}
+}
+
+// certConfirmation returns the cnf claim that binds access tokens to the
+// client certificate of the request, or nil if the client doesn't use mutual
+// TLS (RFC 8705 section 3).
+func (h *handler) certConfirmation(r *http.Request, client *Client) *confirmation {
+	cert := clientCertificate(r)
+	if !h.mtls || cert == nil || !client.usesMutualTLS() {
+		return nil
+	}
+	return &confirmation{X5tS256: certThumbprint(cert)}
+}
@@ -0,0 +1,109 @@
+package oauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amsterdam/authz/jose"
+)
+
+// testCertificate creates a certificate for the given subject, signed by
+// parent or self-signed if parent is nil.
+func testCertificate(t *testing.T, cn string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn, Organization: []string{"Test"}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	caCert, caKey := testCertificate(t, "Test CA", true, nil, nil)
+	clientCert, _ := testCertificate(t, "client", false, caCert, caKey)
+	otherCert, _ := testCertificate(t, "client", false, nil, nil)
+	selfSigned, _ := testCertificate(t, "self", false, nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	clients := []*Client{
+		&Client{ID: "pki_client", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}, TLSSubjectDN: "CN=client,O=Test"},
+		&Client{ID: "self_client", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}, TLSCertThumbprints: []string{certThumbprint(selfSigned)}},
+	}
+	handler := testClientHandler(t, clients, MutualTLS(roots))
+	keys, err := jose.LoadJWKSet([]byte(testTokenJWKS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		description string
+		clientID    string
+		certs       []*x509.Certificate
+		valid       bool
+	}{
+		{"tls_client_auth", "pki_client", []*x509.Certificate{clientCert}, true},
+		{"self_signed_tls_client_auth", "self_client", []*x509.Certificate{selfSigned}, true},
+		{"untrusted issuer", "pki_client", []*x509.Certificate{otherCert}, false},
+		{"wrong subject", "pki_client", []*x509.Certificate{selfSigned}, false},
+		{"unregistered certificate", "self_client", []*x509.Certificate{otherCert}, false},
+		{"no certificate", "self_client", nil, false},
+	} {
+		code := testCode(t, handler, test.clientID)
+		form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {test.clientID}}
+		r := httptest.NewRequest("POST", "http://test/oauth2/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.TLS = &tls.ConnectionState{PeerCertificates: test.certs}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		resp := w.Result()
+		if !test.valid {
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("%s: expected invalid_client, got %s", test.description, resp.Status)
+			}
+			continue
+		}
+		var token tokenResponse
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: token request failed: %s", test.description, resp.Status)
+			continue
+		}
+		var payload accessTokenPayload
+		if err := keys.Decode(token.AccessToken, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Confirm == nil || payload.Confirm.X5tS256 != certThumbprint(test.certs[0]) {
+			t.Errorf("%s: access token not bound to certificate: %+v", test.description, payload.Confirm)
+		}
+	}
+}
@@ -1,12 +1,17 @@
 package oauth2
 
 import (
+	"container/list"
+	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"sync"
 	"time"
+
+	"github.com/amsterdam/authz/jose"
 )
 
 // Option is a handler setting that can be passed to Handler().
@@ -24,12 +29,126 @@ func TraceHeader(headerName string) Option {
 // StateStorage is an option that sets the transient storage for the handler
 // instance.
 func StateStorage(engine StateKeeper, lifetime time.Duration) Option {
+	return ContextStateStorage(contextStateKeeper(engine), lifetime)
+}
+
+// ContextStateStorage is an option that sets transient storage that accepts
+// the request context for the handler instance.
+func ContextStateStorage(engine ContextStateKeeper, lifetime time.Duration) Option {
 	return func(s *handler) error {
 		s.stateStore = newStateStorage(engine, lifetime)
 		return nil
 	}
 }
 
+// StateEncryption is an option that encrypts and authenticates the data in
+// the state storage using the given AES keys, so entries that were read or
+// changed by anyone with access to the storage engine fail to restore. Data is
+// sealed using the first key; the other keys are only used to open data, which
+// allows for key rotation.
+func StateEncryption(keys [][]byte) Option {
+	return func(s *handler) error {
+		sealer, err := newSealer(keys)
+		if err != nil {
+			return err
+		}
+		s.stateSealer = sealer
+		return nil
+	}
+}
+
+// StateCookies is an option that keeps the state of authorization requests in
+// cookies that are encrypted and authenticated using the given AES keys,
+// instead of in the state storage. New cookies are sealed using the first key;
+// the other keys are only used to open cookies, which allows for key rotation.
+// Cookies expire after the given lifetime. Authorization codes, consent and
+// the replay records of client assertions are still kept in the state
+// storage, so nodes need shared state storage to exchange codes.
+func StateCookies(keys [][]byte, lifetime time.Duration) Option {
+	return func(s *handler) error {
+		c, err := newStateCookies(
+			keys, lifetime, s.callbackURL.Path, s.callbackURL.Scheme == "https",
+		)
+		if err != nil {
+			return err
+		}
+		s.stateCookies = c
+		return nil
+	}
+}
+
+// MutualTLS is an option that enables client authentication at the token
+// endpoint using the client certificate of the TLS connection (RFC 8705).
+// Certificates of clients with a subject DN must be issued by one of roots,
+// which may be nil if only self-signed certificates are used. The server must
+// request client certificates without verifying them. Access tokens issued to
+// these clients are bound to their certificate.
+func MutualTLS(roots *x509.CertPool) Option {
+	return func(s *handler) error {
+		s.mtls = true
+		s.mtlsRoots = roots
+		return nil
+	}
+}
+
+// DPoPNonces is an option that requires DPoP proofs at the token endpoint to
+// contain a nonce issued by the server (RFC 9449 section 8). Nonces are
+// authenticated using key, which must be the same at all nodes, and are valid
+// for the given lifetime.
+func DPoPNonces(key []byte, lifetime time.Duration) Option {
+	return func(s *handler) error {
+		if len(key) < 16 {
+			return errors.New("DPoP nonce key must be at least 16 bytes")
+		}
+		s.dpop.RequireNonces(key, lifetime)
+		return nil
+	}
+}
+
+// JWTAccessTokens is an option that issues access tokens in the JWT profile
+// (RFC 9068) instead of the legacy format. Tokens that aren't restricted to
+// resource servers using resource indicators get the given aud.
+func JWTAccessTokens(audience string) Option {
+	return func(s *handler) error {
+		if audience == "" {
+			return errors.New("JWT access tokens need a default audience")
+		}
+		s.accessTokenEnc.JWTProfile = true
+		s.accessTokenEnc.Audience = audience
+		return nil
+	}
+}
+
+// ResourceServers is an option that registers the resource servers that
+// clients can request access tokens for using resource indicators (RFC 8707).
+// These tokens have the resource indicators as their aud.
+func ResourceServers(servers ...ResourceServer) Option {
+	return func(s *handler) error {
+		for _, server := range servers {
+			u, err := url.Parse(server.URI)
+			if err != nil || !u.IsAbs() || u.Fragment != "" {
+				return fmt.Errorf("Invalid resource indicator: %s", server.URI)
+			}
+			s.resources[server.URI] = server
+		}
+		return nil
+	}
+}
+
+// MemoryStateStorage is an option that sets in-memory transient storage that
+// holds at most maxEntries entries, so abandoned authorization requests can't
+// exhaust memory. When full the oldest entries are evicted. Zero means
+// unlimited. This storage only works when running a single node.
+func MemoryStateStorage(maxEntries int, lifetime time.Duration) Option {
+	return func(s *handler) error {
+		s.stateStore = newStateStorage(
+			contextStateKeeper(newStateMap(maxEntries, stateMapSweepInterval)),
+			lifetime,
+		)
+		return nil
+	}
+}
+
 // Clients is an option that sets the given client mapping for the handler
 // instance.
 func Clients(m ClientMap) Option {
@@ -39,9 +158,29 @@ func Clients(m ClientMap) Option {
 	}
 }
 
+// ClientRegistration is an option that enables dynamic client registration
+// (RFC 7591) and management (RFC 7592) of clients in the given registry.
+// Registering a client requires one of the given initial access tokens.
+func ClientRegistration(registry ClientRegistry, initialAccessTokens []string) Option {
+	return func(s *handler) error {
+		if len(initialAccessTokens) == 0 {
+			return errors.New("Client registration needs an initial access token")
+		}
+		s.clientRegistry = registry
+		s.initialTokens = initialAccessTokens
+		return nil
+	}
+}
+
 // AuthzProvider is an option that sets the given authorization provider for
 // the handler instance.
 func AuthzProvider(p Authz) Option {
+	return ContextAuthzProvider(contextAuthz(p))
+}
+
+// ContextAuthzProvider is an option that sets the given authorization provider
+// that accepts the request context for the handler instance.
+func ContextAuthzProvider(p ContextAuthz) Option {
 	return func(s *handler) error {
 		s.authz = p
 		return nil
@@ -56,6 +195,14 @@ func JWKID(kid string) Option {
 	}
 }
 
+// JWKSigner is an option that adds an external signer, such as a key in a
+// KMS or Vault, to the JWK set used for access tokens. See jose.AddSigner.
+func JWKSigner(kid string, signer jose.Signer) Option {
+	return func(s *handler) error {
+		return s.accessTokenEnc.jwks.AddSigner(kid, signer)
+	}
+}
+
 // AccessTokenLifetime is an option that sets the lifetime of access tokens.
 func AccessTokenLifetime(lifetime int64) Option {
 	return func(s *handler) error {
@@ -72,6 +219,31 @@ func AccessTokenIssuer(issuer string) Option {
 	}
 }
 
+// PairwiseSubjects is an option that sets the key of pairwise pseudonymous
+// subject identifiers, which are the sub of access tokens issued to clients
+// that require them (see PairwiseSubject). The key must be at least 32 bytes
+// and the same on all nodes; changing it changes all pairwise subjects.
+func PairwiseSubjects(key []byte) Option {
+	return func(s *handler) error {
+		if len(key) < 32 {
+			return errors.New("Pairwise subject key must be at least 32 bytes")
+		}
+		s.pairwiseKey = key
+		return nil
+	}
+}
+
+// ClaimsProvider is an option that adds the claims returned by f to access
+// tokens. f is called when a user authenticates, with the scopes granted to
+// the client. Claims that the access token already has, such as sub and
+// scopes, can't be overridden and are ignored.
+func ClaimsProvider(f ClaimsFunc) Option {
+	return func(s *handler) error {
+		s.claims = f
+		return nil
+	}
+}
+
 // IDProvider is an option that adds the given IdP to this handler. If the IDP was
 // already registered it will be silently overwritten.
 func IDProvider(i IDP) Option {
@@ -81,6 +253,16 @@ func IDProvider(i IDP) Option {
 	}
 }
 
+// ResourceServer is a protected resource that access tokens can be restricted
+// to.
+type ResourceServer struct {
+	// Resource indicator: an absolute URI without a fragment
+	URI string
+	// Scopes the resource server accepts. If not empty, access tokens for the
+	// resource server only contain these scopes.
+	Scopes []string
+}
+
 // StateKeeper defines a storage engine used to store transient state data
 // throughout the handler.
 type StateKeeper interface {
@@ -88,6 +270,18 @@ type StateKeeper interface {
 	Restore(key string) (string, error)
 }
 
+// ExclusiveStateKeeper is a StateKeeper that can save data only if the key
+// doesn't exist yet, atomically. One-time keys, such as the jti of client
+// assertions, are claimed using PersistNew if the storage engine implements
+// it. Otherwise a best-effort check is used, which concurrent requests that
+// use the same key can both pass.
+type ExclusiveStateKeeper interface {
+	StateKeeper
+	// PersistNew saves data only if the key doesn't exist or has expired,
+	// and returns false if it exists.
+	PersistNew(key string, data string, lifetime time.Duration) (bool, error)
+}
+
 // User holds user data returned from the IDP. We require a UUID because we
 // encode it in our access token.
 type User struct {
@@ -95,6 +289,9 @@ type User struct {
 	UID string
 	// Data may be used
 	Data interface{}
+	// ACR is the authentication context class reference (OpenID Connect Core
+	// section 2) of the authentication, if known.
+	ACR string
 }
 
 // IDP defines an identity provider.
@@ -106,10 +303,15 @@ type IDP interface {
 	AuthnRedirect(authzRef string) (*url.URL, error)
 	// AuthnCallback receives the IDP's callback request. It returns the
 	// authzRef as given to the corresponding call to AuthnRedirect, and the
-	// logged-in User or nil if authentication failed.
+	// logged-in User or nil if authentication failed. Outgoing requests should
+	// use the request's context, so they are cancelled with the request.
 	AuthnCallback(r *http.Request) (string, *User, error)
 }
 
+// ClaimsFunc returns extra claims for access tokens issued to the given client
+// for the given user and scopes.
+type ClaimsFunc func(user *User, client *Client, scopes []string) map[string]interface{}
+
 // ScopeSet defines a set of scopes.
 type ScopeSet interface {
 	// ValidScope() returns true if scope is a subset of this scopeset.
@@ -129,10 +331,56 @@ type Client struct {
 	ID string
 	// list of registered redirects
 	Redirects []string
-	// client secret
+	// client secret in plain text, use Secrets instead
 	Secret string
-	// Allowed grants (implicit, authz code, client credentials)
+	// hashed client secrets; clients may have several during rotation
+	Secrets []ClientSecret
+	// JSON encoded JWK set, or URL of the JWK set, holding the keys the
+	// client signs client assertions with (private_key_jwt)
+	JWKS    string
+	JWKSURI string
+	// Subject DN of the certificate, issued by a trusted CA, that the client
+	// authenticates with using mutual TLS (tls_client_auth)
+	TLSSubjectDN string
+	// SHA-256 thumbprints of the self-signed certificates that the client
+	// authenticates with using mutual TLS (self_signed_tls_client_auth)
+	TLSCertThumbprints []string
+	// Allowed grant types (authorization_code, implicit) and response types
+	// (code, token). If one is empty it follows from the other.
+	GrantTypes    []string
+	ResponseTypes []string
+	// Allowed grant (code or token), used if GrantTypes and ResponseTypes
+	// are empty. Code clients that only set GrantType get access tokens in
+	// the redirect, as before the token endpoint existed; set GrantTypes or
+	// ResponseTypes to get authorization codes instead.
 	GrantType string
+	// Scopes the client may request; all scopes if empty, unless the client
+	// was registered dynamically
+	Scopes []string
+	// What happens to requested scopes that the client may not request:
+	// ScopeModeReject (the default) or ScopeModeDrop
+	ScopeMode string
+	// IdPs the client may use; all IdPs if empty
+	IDPs []string
+	// Lifetime of access tokens issued to the client in seconds; the
+	// lifetime of the handler if zero
+	TokenLifetime int64
+	// Authorization requests must use PKCE (RFC 7636) with method S256
+	RequirePKCE bool
+	// The user must consent to the scopes granted to the client
+	RequireConsent bool
+	// Access tokens have a pairwise subject identifier instead of the UID of
+	// the user, which is the same for all clients in the client's sector. The
+	// sector is the client id if empty.
+	PairwiseSubject bool
+	Sector          string
+	// Human readable name of dynamically registered clients
+	Name string
+	// SHA-256 hash of the registration access token of dynamically
+	// registered clients
+	RegistrationHash []byte
+	// Time of registration of dynamically registered clients
+	IssuedAt time.Time
 }
 
 // ClientMap defines OAuth 2.0 clients.
@@ -141,44 +389,139 @@ type ClientMap interface {
 	Get(id string) (*Client, error)
 }
 
-// stateMap is the default StateKeeper
+// ClientRegistry is a ClientMap that stores dynamically registered clients.
+type ClientRegistry interface {
+	ClientMap
+	// Register adds a new client.
+	Register(ctx context.Context, c *Client) error
+	// Update replaces a registered client.
+	Update(ctx context.Context, c *Client) error
+	// Delete removes a registered client.
+	Delete(ctx context.Context, id string) error
+}
+
+const (
+	defaultStateMapMaxEntries = 100000
+	stateMapSweepInterval     = 30 * time.Second
+)
+
+// stateMap is the default StateKeeper. It holds at most maxEntries entries,
+// evicting the oldest entry when full, and a janitor removes expired entries
+// every sweepInterval until the map is closed.
 type stateMap struct {
-	values   map[string]string
-	expiries map[string]time.Time
-	mutex    sync.Mutex
+	entries    map[string]*list.Element
+	order      *list.List // of *stateMapEntry, oldest first
+	maxEntries int
+	mutex      sync.Mutex
+	stop       chan struct{}
+}
+
+type stateMapEntry struct {
+	key     string
+	value   string
+	expires time.Time
 }
 
-func newStateMap() *stateMap {
-	return &stateMap{
-		values:   make(map[string]string),
-		expiries: make(map[string]time.Time),
+func newStateMap(maxEntries int, sweepInterval time.Duration) *stateMap {
+	s := &stateMap{
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		maxEntries: maxEntries,
+		stop:       make(chan struct{}),
 	}
+	go s.janitor(sweepInterval)
+	return s
 }
 
 func (s *stateMap) Persist(key string, value string, lifetime time.Duration) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	exp := time.Now().Add(lifetime)
-	s.values[key] = value
-	s.expiries[key] = exp
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+	s.insert(key, value, lifetime)
 	return nil
 }
 
-func (s *stateMap) Restore(key string) (string, error) {
+func (s *stateMap) PersistNew(key string, value string, lifetime time.Duration) (bool, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	val, valOk := s.values[key]
-	exp, expOk := s.expiries[key]
-	if expOk {
-		delete(s.expiries, key)
+	if elem, ok := s.entries[key]; ok {
+		if time.Now().Before(elem.Value.(*stateMapEntry).expires) {
+			return false, nil
+		}
+		s.remove(elem)
+	}
+	s.insert(key, value, lifetime)
+	return true, nil
+}
+
+// insert adds an entry, evicting the oldest entries if the map is full. The
+// caller must hold the mutex.
+func (s *stateMap) insert(key string, value string, lifetime time.Duration) {
+	for s.maxEntries > 0 && s.order.Len() >= s.maxEntries {
+		s.remove(s.order.Front())
+		stateMapEvictions.WithLabelValues("full").Inc()
 	}
-	if valOk {
-		delete(s.values, key)
+	entry := &stateMapEntry{key: key, value: value, expires: time.Now().Add(lifetime)}
+	s.entries[key] = s.order.PushBack(entry)
+	stateMapEntries.Set(float64(s.order.Len()))
+}
+
+func (s *stateMap) Restore(key string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return "", fmt.Errorf("key %s not found", key)
 	}
-	if !valOk || !expOk || time.Now().After(exp) {
+	s.remove(elem)
+	stateMapEntries.Set(float64(s.order.Len()))
+	entry := elem.Value.(*stateMapEntry)
+	if time.Now().After(entry.expires) {
 		return "", fmt.Errorf("key %s not found", key)
 	}
-	return val, nil
+	return entry.value, nil
+}
+
+// sweep removes expired entries.
+func (s *stateMap) sweep() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for elem := s.order.Front(); elem != nil; {
+		next := elem.Next()
+		if now.After(elem.Value.(*stateMapEntry).expires) {
+			s.remove(elem)
+			stateMapEvictions.WithLabelValues("expired").Inc()
+		}
+		elem = next
+	}
+	stateMapEntries.Set(float64(s.order.Len()))
+}
+
+// Close stops the janitor.
+func (s *stateMap) Close() {
+	close(s.stop)
+}
+
+// janitor sweeps the map every interval until the map is closed.
+func (s *stateMap) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+func (s *stateMap) remove(elem *list.Element) {
+	s.order.Remove(elem)
+	delete(s.entries, elem.Value.(*stateMapEntry).key)
 }
 
 // emptyClientMap is the default ClientMap.
@@ -1,13 +1,19 @@
 package oauth2
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"testing"
 	"time"
 )
 
 func TestStateMap(t *testing.T) {
 	key, value := "key", "value"
-	m := newStateMap()
+	m := newStateMap(0, time.Hour)
+	defer m.Close()
 	// test persistence
 	if err := m.Persist(key, value, 2*time.Second); err != nil {
 		t.Fatal(err)
@@ -29,3 +35,96 @@ func TestStateMap(t *testing.T) {
 		t.Fatal("timout didn't work")
 	}
 }
+
+func TestStateMapLimits(t *testing.T) {
+	m := newStateMap(2, time.Hour)
+	defer m.Close()
+	for _, key := range []string{"1", "2", "3"} {
+		if err := m.Persist(key, key, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The oldest entry should have been evicted
+	if _, err := m.Restore("1"); err == nil {
+		t.Fatal("Oldest entry wasn't evicted")
+	}
+	for _, key := range []string{"2", "3"} {
+		if value, err := m.Restore(key); err != nil || value != key {
+			t.Fatalf("Unexpected result for %s: %s, %v", key, value, err)
+		}
+	}
+	// Expired entries should be swept
+	m.Persist("expired", "value", time.Nanosecond)
+	m.Persist("valid", "value", time.Minute)
+	time.Sleep(2 * time.Nanosecond)
+	m.sweep()
+	if len(m.entries) != 1 || m.order.Len() != 1 {
+		t.Fatalf("Expected 1 entry after sweep, got %d", len(m.entries))
+	}
+	if _, err := m.Restore("valid"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStateMapJanitor(t *testing.T) {
+	m := newStateMap(0, time.Millisecond)
+	defer m.Close()
+	m.Persist("expired", "value", time.Nanosecond)
+	for i := 0; ; i++ {
+		m.mutex.Lock()
+		n := m.order.Len()
+		m.mutex.Unlock()
+		if n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Janitor didn't sweep")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testSigner is an external ES256 signer.
+type testSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func (s *testSigner) Algorithm() string {
+	return "ES256"
+}
+
+func (s *testSigner) Sign(msg []byte) ([]byte, error) {
+	sum := sha256.Sum256(msg)
+	r, sig, err := ecdsa.Sign(rand.Reader, s.key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	copy(signature[32-len(r.Bytes()):32], r.Bytes())
+	copy(signature[64-len(sig.Bytes()):], sig.Bytes())
+	return signature, nil
+}
+
+func (s *testSigner) Public() crypto.PublicKey {
+	return &s.key.PublicKey
+}
+
+func TestJWKSigner(t *testing.T) {
+	emptyJWKS := `{ "keys": [] }`
+	if _, err := Handler("http://test/", emptyJWKS); err == nil {
+		t.Fatal("Handler without signing key should not succeed")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &testSigner{key}
+	if _, err := Handler("http://test/", emptyJWKS, JWKSigner("external", signer)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Handler(
+		"http://test/", emptyJWKS, JWKSigner("external", signer), JWKID("other"),
+	); err == nil {
+		t.Fatal("Handler with unknown signing key should not succeed")
+	}
+}
@@ -0,0 +1,42 @@
+package oauth2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// PairwiseSubject returns the pairwise pseudonymous subject identifier of the
+// user with the given UID for clients in the given sector: a keyed hash of
+// both, so resource servers of different sectors can't correlate users.
+// Operators who have the key can compute the subject of a known user, and the
+// audit log holds the UID of each pairwise subject.
+func PairwiseSubject(key []byte, sector string, uid string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sector))
+	mac.Write([]byte{0})
+	mac.Write([]byte(uid))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sector returns the sector of the client, which is its id unless clients
+// share a sector.
+func (c *Client) sector() string {
+	if c.Sector != "" {
+		return c.Sector
+	}
+	return c.ID
+}
+
+// subject returns the sub of access tokens issued to the client for the user
+// with the given UID.
+func (h *handler) subject(client *Client, uid string) (string, error) {
+	if !client.PairwiseSubject {
+		return uid, nil
+	}
+	if h.pairwiseKey == nil {
+		return "", errors.New("Client requires pairwise subjects, but no key is set")
+	}
+	return PairwiseSubject(h.pairwiseKey, client.sector(), uid), nil
+}
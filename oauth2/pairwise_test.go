@@ -0,0 +1,64 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/amsterdam/authz/jose"
+)
+
+var testPairwiseKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestPairwiseSubject(t *testing.T) {
+	sub := PairwiseSubject(testPairwiseKey, "sector", "user:1")
+	if sub != PairwiseSubject(testPairwiseKey, "sector", "user:1") {
+		t.Fatal("Pairwise subject isn't stable")
+	}
+	for _, other := range []string{
+		PairwiseSubject(testPairwiseKey, "other", "user:1"),
+		PairwiseSubject(testPairwiseKey, "sector", "user:2"),
+		PairwiseSubject([]byte("fedcba9876543210fedcba9876543210"), "sector", "user:1"),
+	} {
+		if other == sub {
+			t.Fatalf("Pairwise subjects collide: %s", sub)
+		}
+	}
+}
+
+func TestPairwiseSubjects(t *testing.T) {
+	clients := []*Client{
+		&Client{ID: "app1", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}, PairwiseSubject: true, Sector: "city"},
+		&Client{ID: "app2", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}, PairwiseSubject: true, Sector: "city"},
+		&Client{ID: "app3", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}, PairwiseSubject: true},
+		&Client{ID: "public", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}},
+	}
+	handler := testClientHandler(t, clients, PairwiseSubjects(testPairwiseKey))
+	keys, _ := jose.LoadJWKSet([]byte(testTokenJWKS))
+	subjects := make(map[string]string)
+	for _, client := range clients {
+		code := testCode(t, handler, client.ID)
+		form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {client.ID}}
+		resp, token, e := testTokenRequest(handler, form)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Token request failed: %s %+v", resp.Status, e)
+		}
+		var payload accessTokenPayload
+		if err := keys.Decode(token.AccessToken, &payload); err != nil {
+			t.Fatal(err)
+		}
+		subjects[client.ID] = payload.Subject
+	}
+	if subjects["app1"] != PairwiseSubject(testPairwiseKey, "city", "user:1") || subjects["app2"] != subjects["app1"] ||
+		subjects["app3"] != PairwiseSubject(testPairwiseKey, "app3", "user:1") || subjects["public"] != "user:1" {
+		t.Fatalf("Unexpected subjects: %v", subjects)
+	}
+	// Pairwise subjects need a key
+	handler = testClientHandler(t, clients)
+	if location := testAuthorize(t, handler, "app1", nil); location.Query().Get("error") != "server_error" {
+		t.Fatalf("Unexpected redirect: %s", location)
+	}
+	if _, err := Handler("http://test/", testTokenJWKS, PairwiseSubjects([]byte("short"))); err == nil {
+		t.Fatal("Short pairwise subject key accepted")
+	}
+}
@@ -0,0 +1,69 @@
+package oauth2
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/url"
+)
+
+// setCodeChallenge sets the PKCE code challenge of an authorization request
+// (RFC 7636 section 4.3). Clients that require PKCE must use method S256.
+func (s *authorizationState) setCodeChallenge(client *Client, query url.Values) error {
+	challenge, method := query.Get("code_challenge"), query.Get("code_challenge_method")
+	if challenge == "" {
+		if client.RequirePKCE {
+			return errors.New("code_challenge required")
+		}
+		return nil
+	}
+	if s.ResponseType != "code" {
+		return errors.New("code_challenge requires response_type code")
+	}
+	if method == "" {
+		method = "plain"
+	}
+	if method != "S256" && (method != "plain" || client.RequirePKCE) {
+		return errors.New("code_challenge_method not supported")
+	}
+	if !validCodeVerifier(challenge) {
+		return errors.New("invalid code_challenge")
+	}
+	s.CodeChallenge, s.CodeChallengeMethod = challenge, method
+	return nil
+}
+
+// verifyCodeVerifier returns true if the code verifier matches the code
+// challenge (RFC 7636 section 4.6).
+func verifyCodeVerifier(challenge string, method string, verifier string) bool {
+	if !validCodeVerifier(verifier) {
+		return false
+	}
+	switch method {
+	case "S256":
+		hash := sha256.Sum256([]byte(verifier))
+		verifier = base64.RawURLEncoding.EncodeToString(hash[:])
+	case "plain":
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(verifier), []byte(challenge)) == 1
+}
+
+// validCodeVerifier returns true if v has the syntax of a code verifier,
+// which is also that of a code challenge (RFC 7636 section 4.1).
+func validCodeVerifier(v string) bool {
+	if len(v) < 43 || len(v) > 128 {
+		return false
+	}
+	for _, c := range v {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
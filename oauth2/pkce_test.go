@@ -0,0 +1,68 @@
+package oauth2
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+const testCodeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+func TestPKCE(t *testing.T) {
+	handler := testTokenHandler(t)
+	hash := sha256.Sum256([]byte(testCodeVerifier))
+	s256 := url.Values{"code_challenge": {base64.RawURLEncoding.EncodeToString(hash[:])}, "code_challenge_method": {"S256"}}
+	plain := url.Values{"code_challenge": {testCodeVerifier}}
+	for _, test := range []struct {
+		description string
+		params      url.Values
+		verifier    string
+		valid       bool
+	}{
+		{"S256", s256, testCodeVerifier, true},
+		{"plain", plain, testCodeVerifier, true},
+		{"wrong verifier", s256, testCodeVerifier[1:] + "x", false},
+		{"no verifier", s256, "", false},
+		{"verifier without challenge", nil, testCodeVerifier, false},
+	} {
+		code := testCodeWithParams(t, handler, "public_client", test.params)
+		form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"public_client"}}
+		if test.verifier != "" {
+			form.Set("code_verifier", test.verifier)
+		}
+		resp, _, e := testTokenRequest(handler, form)
+		if test.valid && resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: token request failed: %s %+v", test.description, resp.Status, e)
+		} else if !test.valid && (e == nil || e.Code != "invalid_grant") {
+			t.Errorf("%s: expected invalid_grant, got %s %+v", test.description, resp.Status, e)
+		}
+	}
+	// Code challenges are only valid in authorization code requests
+	params := url.Values{"response_type": {"token"}, "code_challenge": {testCodeVerifier}}
+	if code := testAuthorizeError(handler, "implicit_client", params); code != "invalid_request" {
+		t.Errorf("Expected invalid_request, got %q", code)
+	}
+}
+
+func TestRequirePKCE(t *testing.T) {
+	handler := testPolicyHandler(t, &Client{
+		ID: "app", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}, RequirePKCE: true,
+	})
+	for _, params := range []url.Values{
+		nil, {"code_challenge": {testCodeVerifier}, "code_challenge_method": {"plain"}},
+	} {
+		if code := testAuthorizeError(handler, "app", params); code != "invalid_request" {
+			t.Errorf("%v: expected invalid_request, got %q", params, code)
+		}
+	}
+	hash := sha256.Sum256([]byte(testCodeVerifier))
+	code := testCodeWithParams(t, handler, "app", url.Values{
+		"code_challenge": {base64.RawURLEncoding.EncodeToString(hash[:])}, "code_challenge_method": {"S256"},
+	})
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"app"}, "code_verifier": {testCodeVerifier}}
+	if resp, _, e := testTokenRequest(handler, form); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Token request failed: %s %+v", resp.Status, e)
+	}
+}
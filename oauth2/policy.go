@@ -0,0 +1,110 @@
+package oauth2
+
+// Scope modes of clients.
+const (
+	// ScopeModeReject rejects requests for scopes the client may not request.
+	ScopeModeReject = "reject"
+	// ScopeModeDrop removes the scopes the client may not request from
+	// requests.
+	ScopeModeDrop = "drop"
+)
+
+// responseTypeGrants maps response types to the grant types they are part of.
+var responseTypeGrants = map[string]string{
+	"code":  "authorization_code",
+	"token": "implicit",
+}
+
+// allowedTypes returns the grant types and response types the client may use.
+func (c *Client) allowedTypes() (grantTypes []string, responseTypes []string) {
+	grantTypes, responseTypes = c.GrantTypes, c.ResponseTypes
+	if len(grantTypes) == 0 && len(responseTypes) == 0 {
+		switch c.GrantType {
+		case "code", "token":
+			responseTypes = []string{c.GrantType}
+		}
+	}
+	if len(grantTypes) == 0 {
+		for _, responseType := range responseTypes {
+			if grantType, ok := responseTypeGrants[responseType]; ok {
+				grantTypes = append(grantTypes, grantType)
+			}
+		}
+	}
+	if len(responseTypes) == 0 {
+		for _, grantType := range grantTypes {
+			for responseType, g := range responseTypeGrants {
+				if g == grantType {
+					responseTypes = append(responseTypes, responseType)
+				}
+			}
+		}
+	}
+	return grantTypes, responseTypes
+}
+
+// allowsGrantType returns true if the client may use the given grant type.
+func (c *Client) allowsGrantType(grantType string) bool {
+	grantTypes, _ := c.allowedTypes()
+	return contains(grantTypes, grantType)
+}
+
+// allowsResponseType returns true if the client may use the given response
+// type.
+func (c *Client) allowsResponseType(responseType string) bool {
+	_, responseTypes := c.allowedTypes()
+	return contains(responseTypes, responseType)
+}
+
+// exchangesCodes returns true if the client gets authorization codes for
+// response type code, which it exchanges at the token endpoint. Clients that
+// only have grant type "code" got access tokens in the redirect before the
+// token endpoint existed, as in the implicit flow, and still do; they opt in
+// to authorization codes by listing their grant types or response types.
+func (c *Client) exchangesCodes() bool {
+	return len(c.GrantTypes) > 0 || len(c.ResponseTypes) > 0
+}
+
+// allowsScope returns true if the client may request the given scope.
+// Configured clients without scopes may request all scopes, but registered
+// clients may only request the scopes they registered.
+func (c *Client) allowsScope(scope string) bool {
+	if len(c.Scopes) == 0 {
+		return !c.registered()
+	}
+	return contains(c.Scopes, scope)
+}
+
+// registered returns true if the client was registered dynamically.
+func (c *Client) registered() bool {
+	return len(c.RegistrationHash) > 0
+}
+
+// dropsScopes returns true if scopes the client may not request are dropped
+// from its requests instead of rejected.
+func (c *Client) dropsScopes() bool {
+	return c.ScopeMode == ScopeModeDrop
+}
+
+// allowsIDP returns true if the client may use the IdP with the given id.
+func (c *Client) allowsIDP(idpID string) bool {
+	return len(c.IDPs) == 0 || contains(c.IDPs, idpID)
+}
+
+// tokenLifetime returns the lifetime in seconds of access tokens issued to
+// the given client.
+func (h *handler) tokenLifetime(c *Client) int64 {
+	if c.TokenLifetime > 0 {
+		return c.TokenLifetime
+	}
+	return h.accessTokenEnc.Lifetime
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func testPolicyHandler(t *testing.T, clients ...*Client) http.Handler {
+	return testClientHandler(t, clients)
+}
+
+// testAuthorizeError runs an authorization request that fails before the
+// user authenticates, and returns the error in the redirect to the client.
+func testAuthorizeError(handler http.Handler, clientID string, params url.Values) string {
+	query := url.Values{
+		"client_id": {clientID}, "response_type": {"code"},
+		"scope": {"scope:1"}, "idp_id": {"testidp"},
+	}
+	for k, v := range params {
+		query[k] = v
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://test/oauth2/authorize?"+query.Encode(), nil))
+	location, err := url.Parse(w.Result().Header.Get("Location"))
+	if err != nil {
+		return ""
+	}
+	return location.Query().Get("error")
+}
+
+func TestClientAllowedTypes(t *testing.T) {
+	for _, test := range []struct {
+		client        Client
+		grantTypes    []string
+		responseTypes []string
+	}{
+		{Client{GrantType: "code"}, []string{"authorization_code"}, []string{"code"}},
+		{Client{GrantType: "token"}, []string{"implicit"}, []string{"token"}},
+		{Client{GrantType: "client_credentials"}, nil, nil},
+		{Client{GrantTypes: []string{"authorization_code"}}, []string{"authorization_code"}, []string{"code"}},
+		{Client{ResponseTypes: []string{"code", "token"}}, []string{"authorization_code", "implicit"}, []string{"code", "token"}},
+		{Client{GrantType: "code", GrantTypes: []string{"implicit"}}, []string{"implicit"}, []string{"token"}},
+	} {
+		grantTypes, responseTypes := test.client.allowedTypes()
+		if !reflect.DeepEqual(grantTypes, test.grantTypes) || !reflect.DeepEqual(responseTypes, test.responseTypes) {
+			t.Errorf("%+v: unexpected types %v %v", test.client, grantTypes, responseTypes)
+		}
+	}
+}
+
+func TestClientTokenLifetime(t *testing.T) {
+	handler := testPolicyHandler(t, &Client{
+		ID: "service", Secret: "secret", Redirects: []string{"http://testurl/"},
+		ResponseTypes: []string{"code"}, TokenLifetime: 60,
+	})
+	code := testCode(t, handler, "service")
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}}
+	if resp, token, e := testTokenRequest(handler, form, "service", "secret"); resp.StatusCode != http.StatusOK || token.ExpiresIn != 60 {
+		t.Fatalf("Token request failed: %s %+v", resp.Status, e)
+	}
+	// Clients can't get tokens without a user
+	form = url.Values{"grant_type": {"client_credentials"}}
+	if _, _, e := testTokenRequest(handler, form, "service", "secret"); e == nil || e.Code != "unsupported_grant_type" {
+		t.Fatalf("Client credentials grant accepted: %+v", e)
+	}
+}
+
+func TestClientRestrictions(t *testing.T) {
+	handler := testPolicyHandler(t,
+		&Client{
+			ID: "restricted", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"},
+			Scopes: []string{"scope:2"}, IDPs: []string{"otheridp"},
+		},
+		&Client{ID: "open", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}},
+		&Client{
+			ID: "dropping", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"},
+			Scopes: []string{"scope:2"}, ScopeMode: ScopeModeDrop,
+		},
+		&Client{
+			ID: "registered", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"},
+			RegistrationHash: []byte{1, 2, 3},
+		},
+	)
+	for _, test := range []struct {
+		description string
+		clientID    string
+		params      url.Values
+		code        string
+	}{
+		{"scope not allowed", "restricted", url.Values{"scope": {"scope:1"}}, "invalid_scope"},
+		{"idp not allowed", "restricted", url.Values{"scope": {"scope:2"}}, "invalid_request"},
+		{"response_type not allowed", "open", url.Values{"response_type": {"token"}}, "unsupported_response_type"},
+		{"unknown scope", "dropping", url.Values{"scope": {"scope:2 unknown"}}, "invalid_scope"},
+		{"registered without scopes", "registered", nil, "invalid_scope"},
+	} {
+		if code := testAuthorizeError(handler, test.clientID, test.params); code != test.code {
+			t.Errorf("%s: expected %s, got %q", test.description, test.code, code)
+		}
+	}
+	// Scopes not allowed for the client are dropped
+	code := testCodeWithParams(t, handler, "dropping", url.Values{"scope": {"scope:1 scope:2"}})
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"dropping"}}
+	if resp, token, e := testTokenRequest(handler, form); resp.StatusCode != http.StatusOK || token.Scope != "scope:2" {
+		t.Fatalf("Unexpected token response: %s %+v %+v", resp.Status, token, e)
+	}
+}
@@ -0,0 +1,325 @@
+package oauth2
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// registrationGrantTypes are the grant types clients can register (RFC 7591
+// section 2). Only grants that act on behalf of a user can be registered, so
+// a registered client can't get tokens without one.
+var registrationGrantTypes = []string{"authorization_code", "implicit"}
+
+// clientMetadata holds the client metadata that clients can register.
+type clientMetadata struct {
+	ClientID      string   `json:"client_id,omitempty"`
+	ClientSecret  string   `json:"client_secret,omitempty"`
+	RedirectURIs  []string `json:"redirect_uris,omitempty"`
+	GrantTypes    []string `json:"grant_types,omitempty"`
+	ResponseTypes []string `json:"response_types,omitempty"`
+	ClientName    string   `json:"client_name,omitempty"`
+	Scope         string   `json:"scope,omitempty"`
+}
+
+// clientInformation is the response to registration and management requests
+// (RFC 7591 section 3.2.1).
+type clientInformation struct {
+	clientMetadata
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   *int64 `json:"client_secret_expires_at,omitempty"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri"`
+}
+
+// registrationError is an error response to a registration request (RFC 7591
+// section 3.2.2).
+type registrationError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// serveRegistration handles client registration requests (RFC 7591).
+func (h *handler) serveRegistration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	logger := h.logger(r).WithField("type", "client registration request")
+	if !h.validInitialToken(bearerToken(r)) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid initial access token", http.StatusUnauthorized)
+		logger.Infoln("invalid initial access token")
+		return
+	}
+	var metadata clientMetadata
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		writeRegistrationError(w, "invalid_client_metadata", "invalid JSON")
+		return
+	}
+	client := &Client{IssuedAt: time.Now()}
+	if err := metadata.apply(client, h.authz); err != nil {
+		writeRegistrationError(w, err.Code, err.Description)
+		logger.Infof("%s: %s", err.Code, err.Description)
+		return
+	}
+	var err error
+	if client.ID, err = randomToken(16); err != nil {
+		logger.WithError(err).Errorln("Couldn't create client id")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var secret string
+	if !client.public() {
+		if secret, client.Secrets, err = newClientSecret(); err != nil {
+			logger.WithError(err).Errorln("Couldn't create client secret")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	registrationToken, err := randomToken(32)
+	if err != nil {
+		logger.WithError(err).Errorln("Couldn't create registration access token")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	hash := sha256.Sum256([]byte(registrationToken))
+	client.RegistrationHash = hash[:]
+	if err := h.clientRegistry.Register(r.Context(), client); err != nil {
+		logger.WithError(err).Errorln("Couldn't register client")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	info := h.clientInformation(client, secret)
+	info.RegistrationAccessToken = registrationToken
+	writeJSON(w, http.StatusCreated, info)
+	logger.WithField("client_id", client.ID).Infoln("Client registered")
+}
+
+// serveClientConfiguration handles requests to read, update and delete a
+// registered client (RFC 7592).
+func (h *handler) serveClientConfiguration(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger(r).WithField("type", "client configuration request")
+	clientID := strings.TrimPrefix(r.URL.Path, "/oauth2/register/")
+	client, err := h.clientRegistry.Get(clientID)
+	token := sha256.Sum256([]byte(bearerToken(r)))
+	if err != nil || len(client.RegistrationHash) == 0 ||
+		subtle.ConstantTimeCompare(token[:], client.RegistrationHash) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid registration access token", http.StatusUnauthorized)
+		logger.Infoln("invalid registration access token")
+		return
+	}
+	logger = logger.WithField("client_id", clientID)
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, h.clientInformation(client, ""))
+	case "PUT":
+		var metadata clientMetadata
+		if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+			writeRegistrationError(w, "invalid_client_metadata", "invalid JSON")
+			return
+		}
+		if metadata.ClientID != client.ID {
+			writeRegistrationError(w, "invalid_client_metadata", "client_id doesn't match")
+			return
+		}
+		if metadata.ClientSecret != "" && !client.ValidSecret(metadata.ClientSecret) {
+			writeRegistrationError(w, "invalid_client_metadata", "client_secret doesn't match")
+			return
+		}
+		updated := *client
+		if err := metadata.apply(&updated, h.authz); err != nil {
+			writeRegistrationError(w, err.Code, err.Description)
+			logger.Infof("%s: %s", err.Code, err.Description)
+			return
+		}
+		var secret string
+		switch {
+		case updated.public():
+			updated.Secret, updated.Secrets = "", nil
+		case updated.Secret == "" && len(updated.Secrets) == 0:
+			if secret, updated.Secrets, err = newClientSecret(); err != nil {
+				logger.WithError(err).Errorln("Couldn't create client secret")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := h.clientRegistry.Update(r.Context(), &updated); err != nil {
+			logger.WithError(err).Errorln("Couldn't update client")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, h.clientInformation(&updated, secret))
+		logger.Infoln("Client updated")
+	case "DELETE":
+		if err := h.clientRegistry.Delete(r.Context(), client.ID); err != nil {
+			logger.WithError(err).Errorln("Couldn't delete client")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		logger.Infoln("Client deleted")
+	default:
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+// validInitialToken returns true if token is one of the initial access tokens.
+func (h *handler) validInitialToken(token string) bool {
+	valid := false
+	for _, t := range h.initialTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valid = true
+		}
+	}
+	return token != "" && valid
+}
+
+// clientInformation returns the registered metadata of a client. Secrets are
+// only stored as hashes, so the secret is only included if it was just issued.
+func (h *handler) clientInformation(c *Client, secret string) *clientInformation {
+	info := &clientInformation{
+		clientMetadata: clientMetadata{
+			ClientID:     c.ID,
+			ClientSecret: secret,
+			RedirectURIs: c.Redirects,
+			ClientName:   c.Name,
+			Scope:        strings.Join(c.Scopes, " "),
+		},
+		ClientIDIssuedAt:      c.IssuedAt.Unix(),
+		RegistrationClientURI: h.registerURL.String() + url.PathEscape(c.ID),
+	}
+	info.GrantTypes, info.ResponseTypes = c.allowedTypes()
+	if secret != "" {
+		var expires int64
+		info.ClientSecretExpiresAt = &expires
+	}
+	return info
+}
+
+// apply validates the metadata and sets it on the given client. Registered
+// scopes must be in the given scopeset.
+func (m *clientMetadata) apply(c *Client, scopeSet ScopeSet) *registrationError {
+	grantTypes, responseTypes := m.GrantTypes, m.ResponseTypes
+	if len(grantTypes) == 0 && len(responseTypes) == 0 {
+		grantTypes = []string{"authorization_code"}
+	}
+	// Grant types and response types follow from each other (RFC 7591
+	// section 2.1)
+	types := &Client{GrantTypes: grantTypes, ResponseTypes: responseTypes}
+	grantTypes, responseTypes = types.allowedTypes()
+	for _, grantType := range grantTypes {
+		if !contains(registrationGrantTypes, grantType) {
+			return &registrationError{"invalid_client_metadata", "unsupported grant type: " + grantType}
+		}
+	}
+	for _, responseType := range responseTypes {
+		if grantType, ok := responseTypeGrants[responseType]; !ok || !contains(grantTypes, grantType) {
+			return &registrationError{"invalid_client_metadata", "response_types don't match grant_types"}
+		}
+	}
+	for responseType, grantType := range responseTypeGrants {
+		if contains(grantTypes, grantType) && !contains(responseTypes, responseType) {
+			return &registrationError{"invalid_client_metadata", "response_types don't match grant_types"}
+		}
+	}
+	if len(m.RedirectURIs) == 0 {
+		return &registrationError{"invalid_redirect_uri", "redirect_uris missing"}
+	}
+	for _, redirectURI := range m.RedirectURIs {
+		if !validRedirectURI(redirectURI) {
+			return &registrationError{"invalid_redirect_uri", "invalid redirect URI: " + redirectURI}
+		}
+	}
+	scopes := strings.Fields(m.Scope)
+	for _, scope := range scopes {
+		if !scopeSet.ValidScope(scope) {
+			return &registrationError{"invalid_client_metadata", "unknown scope: " + scope}
+		}
+	}
+	c.GrantType = ""
+	c.GrantTypes = grantTypes
+	c.ResponseTypes = responseTypes
+	c.Redirects = m.RedirectURIs
+	c.Name = m.ClientName
+	c.Scopes = scopes
+	return nil
+}
+
+// public returns true if a registered client only uses the implicit grant,
+// so it gets no client secret.
+func (c *Client) public() bool {
+	grantTypes, _ := c.allowedTypes()
+	return len(grantTypes) == 1 && grantTypes[0] == "implicit"
+}
+
+// validRedirectURI returns true if the given redirect URI can be registered
+// dynamically: an absolute https URI without fragment or wildcard, or http on
+// the loopback interface.
+func validRedirectURI(redirectURI string) bool {
+	u, err := url.Parse(redirectURI)
+	if err != nil || u.Host == "" || u.Fragment != "" || strings.Contains(redirectURI, "*") {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		if u.Hostname() == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(u.Hostname())
+		return ip != nil && ip.IsLoopback()
+	}
+	return false
+}
+
+// newClientSecret creates a random client secret and returns it, and its hash.
+func newClientSecret() (string, []ClientSecret, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+	return secret, []ClientSecret{{Hash: HashRandomSecret(secret)}}, nil
+}
+
+// bearerToken returns the bearer token in the Authorization header of the
+// request, if any.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return auth[7:]
+	}
+	return ""
+}
+
+// randomToken returns a base64url encoded random token of n bytes.
+func randomToken(n int) (string, error) {
+	token := make([]byte, n)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func writeRegistrationError(w http.ResponseWriter, code string, desc string) {
+	writeJSON(w, http.StatusBadRequest, &registrationError{code, desc})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Errorln("Couldn't write response")
+	}
+}
@@ -0,0 +1,162 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testClientRegistry map[string]*Client
+
+func (m testClientRegistry) Get(id string) (*Client, error) {
+	if c, ok := m[id]; ok {
+		return c, nil
+	}
+	return nil, errors.New("unknown client")
+}
+
+func (m testClientRegistry) Register(ctx context.Context, c *Client) error {
+	m[c.ID] = c
+	return nil
+}
+
+func (m testClientRegistry) Update(ctx context.Context, c *Client) error {
+	m[c.ID] = c
+	return nil
+}
+
+func (m testClientRegistry) Delete(ctx context.Context, id string) error {
+	delete(m, id)
+	return nil
+}
+
+func testRegistrationHandler(t *testing.T, registry testClientRegistry) http.Handler {
+	jwks := `{ "keys": [
+		{ "kty": "oct", "key_ops": ["sign", "verify"], "kid": "1", "alg": "HS256", "k": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4=" }
+	]}`
+	handler, err := Handler(
+		"http://test/", jwks, Clients(registry),
+		ClientRegistration(registry, []string{"initial"}),
+		AuthzProvider(newTestAuthz(map[string][]string{"user:1": []string{"scope:1", "scope:2", "admin"}})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+func testRegistrationRequest(handler http.Handler, method string, url string, token string, body string) *http.Response {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestClientRegistration(t *testing.T) {
+	registry := make(testClientRegistry)
+	handler := testRegistrationHandler(t, registry)
+	metadata := `{"redirect_uris": ["https://app/callback"], "grant_types": ["implicit"], "client_name": "App", "scope": "scope:1"}`
+	// Initial access token required
+	for _, token := range []string{"", "wrong"} {
+		resp := testRegistrationRequest(handler, "POST", "http://test/oauth2/register", token, metadata)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Registered using token %q: %s", token, resp.Status)
+		}
+	}
+	resp := testRegistrationRequest(handler, "POST", "http://test/oauth2/register", "initial", metadata)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Registration failed: %s", resp.Status)
+	}
+	var info clientInformation
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	client, err := registry.Get(info.ClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client.allowsResponseType("token") || client.allowsGrantType("authorization_code") || client.Name != "App" || len(client.Secrets) != 0 || info.ClientSecret != "" {
+		t.Fatalf("Unexpected client: %+v", client)
+	}
+	if !client.allowsScope("scope:1") || client.allowsScope("scope:2") || info.Scope != "scope:1" {
+		t.Fatalf("Unexpected scopes: %v, %q", client.Scopes, info.Scope)
+	}
+	if info.RegistrationClientURI != "http://test/oauth2/register/"+info.ClientID {
+		t.Fatalf("Unexpected registration_client_uri: %s", info.RegistrationClientURI)
+	}
+	// Management requires the registration access token
+	if resp := testRegistrationRequest(handler, "GET", info.RegistrationClientURI, "initial", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Read using initial access token: %s", resp.Status)
+	}
+	token := info.RegistrationAccessToken
+	if resp := testRegistrationRequest(handler, "GET", info.RegistrationClientURI, token, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Read failed: %s", resp.Status)
+	}
+	update := `{"client_id": "` + info.ClientID + `", "redirect_uris": ["http://localhost:8000/"], "grant_types": ["authorization_code"]}`
+	if resp := testRegistrationRequest(handler, "PUT", info.RegistrationClientURI, token, update); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Update failed: %s", resp.Status)
+	}
+	if client, _ := registry.Get(info.ClientID); !client.allowsResponseType("code") || client.allowsGrantType("implicit") || len(client.Secrets) != 1 || client.Redirects[0] != "http://localhost:8000/" {
+		t.Fatalf("Unexpected client after update: %+v", client)
+	}
+	// Registered clients without scopes may request none
+	if client, _ := registry.Get(info.ClientID); client.allowsScope("scope:1") {
+		t.Fatalf("Unexpected scopes after update: %v", client.Scopes)
+	}
+	if resp := testRegistrationRequest(handler, "DELETE", info.RegistrationClientURI, token, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Delete failed: %s", resp.Status)
+	}
+	if _, err := registry.Get(info.ClientID); err == nil {
+		t.Fatal("Client not deleted")
+	}
+}
+
+func TestClientRegistrationValidation(t *testing.T) {
+	handler := testRegistrationHandler(t, make(testClientRegistry))
+	for _, test := range []struct {
+		metadata string
+		code     string
+	}{
+		{`{"redirect_uris": ["http://app/callback"]}`, "invalid_redirect_uri"},
+		{`{"redirect_uris": ["https://app/*"]}`, "invalid_redirect_uri"},
+		{`{"redirect_uris": ["https://app/#fragment"]}`, "invalid_redirect_uri"},
+		{`{"redirect_uris": ["/callback"]}`, "invalid_redirect_uri"},
+		{`{"grant_types": ["authorization_code"]}`, "invalid_redirect_uri"},
+		{`{"grant_types": ["password"], "redirect_uris": ["https://app/"]}`, "invalid_client_metadata"},
+		{`{"grant_types": ["implicit", "authorization_code"], "response_types": ["code"], "redirect_uris": ["https://app/"]}`, "invalid_client_metadata"},
+		{`{"grant_types": ["implicit"], "response_types": ["code"], "redirect_uris": ["https://app/"]}`, "invalid_client_metadata"},
+		{`{"redirect_uris": ["https://app/"], "scope": "scope:1 unknown"}`, "invalid_client_metadata"},
+		// Registered clients can't get tokens without a user
+		{`{"grant_types": ["client_credentials"], "scope": "admin"}`, "invalid_client_metadata"},
+		{`{"grant_types": ["authorization_code", "client_credentials"], "redirect_uris": ["https://app/"], "scope": "admin"}`, "invalid_client_metadata"},
+		{`not json`, "invalid_client_metadata"},
+	} {
+		resp := testRegistrationRequest(handler, "POST", "http://test/oauth2/register", "initial", test.metadata)
+		var e registrationError
+		json.NewDecoder(resp.Body).Decode(&e)
+		if resp.StatusCode != http.StatusBadRequest || e.Code != test.code {
+			t.Errorf("%s: expected %s, got %s %s", test.metadata, test.code, resp.Status, e.Code)
+		}
+	}
+	// Authorization code clients get a secret
+	resp := testRegistrationRequest(handler, "POST", "http://test/oauth2/register", "initial", `{"redirect_uris": ["https://app/"]}`)
+	var info clientInformation
+	json.NewDecoder(resp.Body).Decode(&info)
+	if resp.StatusCode != http.StatusCreated || info.ClientSecret == "" || info.ClientSecretExpiresAt == nil {
+		t.Fatalf("Unexpected response: %s %+v", resp.Status, info)
+	}
+	// Secrets are only returned when issued
+	resp = testRegistrationRequest(handler, "GET", info.RegistrationClientURI, info.RegistrationAccessToken, "")
+	var read clientInformation
+	json.NewDecoder(resp.Body).Decode(&read)
+	if resp.StatusCode != http.StatusOK || read.ClientSecret != "" {
+		t.Fatalf("Unexpected response: %s %+v", resp.Status, read)
+	}
+}
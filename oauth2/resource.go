@@ -0,0 +1,56 @@
+package oauth2
+
+import "errors"
+
+// resourceIndicators validates the resource parameters of a request (RFC 8707
+// section 2), which must be registered resource servers, and removes
+// duplicates.
+func (h *handler) resourceIndicators(values []string) ([]string, error) {
+	var resources []string
+	for _, resource := range values {
+		if _, ok := h.resources[resource]; !ok {
+			return nil, errors.New("unknown resource: " + resource)
+		}
+		if !contains(resources, resource) {
+			resources = append(resources, resource)
+		}
+	}
+	return resources, nil
+}
+
+// tokenGrant returns the grant of an access token for the given client and
+// scopes, for the user that authenticated as described by authn. If the token
+// is for the given resources, the scopes are narrowed to those the resource
+// servers accept.
+func (h *handler) tokenGrant(client *Client, authn *authentication, scopes []string, resources []string) *accessTokenGrant {
+	return &accessTokenGrant{
+		Subject:  authn.Subject,
+		UID:      authn.UID,
+		ClientID: client.ID,
+		Scopes:   h.resourceScopes(resources, scopes),
+		Audience: resources,
+		Lifetime: h.tokenLifetime(client),
+		AuthTime: authn.AuthTime,
+		ACR:      authn.ACR,
+		Claims:   authn.Claims,
+	}
+}
+
+// resourceScopes returns the scopes that at least one of the given resource
+// servers accepts. Resource servers without scopes accept all scopes.
+func (h *handler) resourceScopes(resources []string, scopes []string) []string {
+	if len(resources) == 0 {
+		return scopes
+	}
+	accepted := []string{}
+	for _, scope := range scopes {
+		for _, resource := range resources {
+			server := h.resources[resource]
+			if len(server.Scopes) == 0 || contains(server.Scopes, scope) {
+				accepted = append(accepted, scope)
+				break
+			}
+		}
+	}
+	return accepted
+}
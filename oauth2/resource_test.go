@@ -0,0 +1,88 @@
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/amsterdam/authz/jose"
+)
+
+func testResourceHandler(t *testing.T) http.Handler {
+	clients := []*Client{
+		&Client{ID: "app", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}},
+	}
+	return testClientHandler(t, clients, ResourceServers(
+		ResourceServer{URI: "https://api1/", Scopes: []string{"scope:1"}},
+		ResourceServer{URI: "https://api2/"},
+	))
+}
+
+func testTokenPayload(t *testing.T, token *tokenResponse) *accessTokenPayload {
+	keys, err := jose.LoadJWKSet([]byte(testTokenJWKS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload accessTokenPayload
+	if err := keys.Decode(token.AccessToken, &payload); err != nil {
+		t.Fatal(err)
+	}
+	return &payload
+}
+
+func TestResourceIndicators(t *testing.T) {
+	handler := testResourceHandler(t)
+	params := url.Values{"scope": {"scope:1 scope:2"}, "resource": {"https://api1/", "https://api2/"}}
+	for _, test := range []struct {
+		resources []string
+		aud       []string
+		scope     string
+		code      string
+	}{
+		{nil, []string{"https://api1/", "https://api2/"}, "scope:1 scope:2", ""},
+		{[]string{"https://api1/"}, []string{"https://api1/"}, "scope:1", ""},
+		{[]string{"https://api3/"}, nil, "", "invalid_target"},
+	} {
+		code := testCodeWithParams(t, handler, "app", params)
+		form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"app"}, "resource": test.resources}
+		resp, token, e := testTokenRequest(handler, form)
+		if test.code != "" {
+			if e == nil || e.Code != test.code {
+				t.Errorf("%v: expected %s, got %s %+v", test.resources, test.code, resp.Status, e)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: token request failed: %s %+v", test.resources, resp.Status, e)
+		}
+		scopes := strings.Fields(token.Scope)
+		sort.Strings(scopes)
+		if payload := testTokenPayload(t, token); !reflect.DeepEqual(payload.Audience, test.aud) || strings.Join(scopes, " ") != test.scope {
+			t.Errorf("%v: unexpected token: %+v %+v", test.resources, token, payload)
+		}
+	}
+	// Resources must be registered
+	params = url.Values{"resource": {"https://api3/"}}
+	if code := testAuthorizeError(handler, "app", params); code != "invalid_target" {
+		t.Errorf("Expected invalid_target, got %q", code)
+	}
+	// Tokens without resources have no aud
+	code := testCode(t, handler, "app")
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"app"}}
+	if resp, token, e := testTokenRequest(handler, form); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Token request failed: %s %+v", resp.Status, e)
+	} else if payload := testTokenPayload(t, token); payload.Audience != nil {
+		t.Errorf("Unexpected aud: %v", payload.Audience)
+	}
+}
+
+func TestResourceServersOption(t *testing.T) {
+	for _, uri := range []string{"/relative", "https://api/#fragment"} {
+		if _, err := Handler("http://test/", testTokenJWKS, ResourceServers(ResourceServer{URI: uri})); err == nil {
+			t.Errorf("Invalid resource indicator accepted: %s", uri)
+		}
+	}
+}
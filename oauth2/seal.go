@@ -0,0 +1,78 @@
+package oauth2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// sealKeyIDLength is the length of the key identifier prefixed to sealed data.
+const sealKeyIDLength = 4
+
+// sealer encrypts and authenticates data using AES-GCM. Data is always sealed
+// using the first key, but can be opened using any of the keys, so keys can be
+// rotated by prepending a new key and removing the old one once all data
+// sealed with it has expired.
+type sealer struct {
+	keyIDs [][]byte
+	aeads  []cipher.AEAD
+}
+
+// newSealer creates a sealer for the given AES keys, which must be 16, 24 or
+// 32 bytes long.
+func newSealer(keys [][]byte) (*sealer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("Need at least one key to seal data")
+	}
+	s := &sealer{}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid sealing key %d: %v", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keyID := sha256.Sum256(key)
+		s.keyIDs = append(s.keyIDs, keyID[:sealKeyIDLength])
+		s.aeads = append(s.aeads, aead)
+	}
+	return s, nil
+}
+
+// seal encrypts and authenticates plaintext and authenticates additionalData.
+// The result holds the key identifier, the nonce and the ciphertext.
+func (s *sealer) seal(plaintext []byte, additionalData []byte) ([]byte, error) {
+	aead := s.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(append([]byte{}, s.keyIDs[0]...), nonce...)
+	return aead.Seal(sealed, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts data created by seal, using the key it was sealed with.
+func (s *sealer) open(sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < sealKeyIDLength {
+		return nil, errors.New("Sealed data too short")
+	}
+	keyID, sealed := sealed[:sealKeyIDLength], sealed[sealKeyIDLength:]
+	for i, id := range s.keyIDs {
+		if subtle.ConstantTimeCompare(id, keyID) != 1 {
+			continue
+		}
+		aead := s.aeads[i]
+		if len(sealed) < aead.NonceSize() {
+			return nil, errors.New("Sealed data too short")
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		return aead.Open(nil, nonce, ciphertext, additionalData)
+	}
+	return nil, errors.New("Data sealed with unknown key")
+}
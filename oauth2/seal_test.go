@@ -0,0 +1,41 @@
+package oauth2
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealerKeyRotation(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	old, err := newSealer([][]byte{oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := newSealer([][]byte{newKey, oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := old.seal([]byte("secret"), []byte("aad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := rotated.open(sealed, []byte("aad")); err != nil {
+		t.Fatal(err)
+	} else if string(opened) != "secret" {
+		t.Fatalf("Unexpected plaintext: %s", opened)
+	}
+	if _, err := rotated.open(sealed, []byte("other")); err == nil {
+		t.Fatal("Opening with other additional data should fail")
+	}
+	sealed, err = rotated.seal([]byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.open(sealed, nil); err == nil {
+		t.Fatal("Opening with unknown key should fail")
+	}
+	if _, err := newSealer([][]byte{[]byte("short")}); err == nil {
+		t.Fatal("Invalid key size should fail")
+	}
+}
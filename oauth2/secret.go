@@ -0,0 +1,193 @@
+package oauth2
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Parameters of argon2id hashes created by HashSecret, as recommended by
+// OWASP. Secrets are checked on every token request, so this is cheaper than
+// what RFC 9106 recommends for passwords.
+const (
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// Failed secret attempts allowed per client and time window, on each node.
+const (
+	secretMaxFailures   = 10
+	secretFailureWindow = time.Minute
+)
+
+// ClientSecret is a hashed client secret.
+type ClientSecret struct {
+	// Hash is an argon2id hash in PHC string format, as created by
+	// HashSecret, a SHA-256 hash created by HashRandomSecret, or a bcrypt
+	// hash.
+	Hash string
+	// Expires is the time the secret stops being valid. Zero means never.
+	Expires time.Time
+}
+
+// HashSecret returns the argon2id hash of secret in PHC string format.
+func HashSecret(secret string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(secret), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// HashRandomSecret returns the SHA-256 hash of secret in the format
+// $sha256$<hash>. A fast unsalted hash is only safe for secrets that can't be
+// guessed, such as the random 32 byte secrets created when clients register.
+func HashRandomSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "$sha256$" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// CompareSecret returns true if secret matches the given argon2id, SHA-256
+// or bcrypt hash. The hashes are compared in constant time.
+func CompareSecret(hash string, secret string) bool {
+	if strings.HasPrefix(hash, "$sha256$") {
+		return subtle.ConstantTimeCompare([]byte(HashRandomSecret(secret)), []byte(hash)) == 1
+	}
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return compareArgon2id(hash, secret)
+	}
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil
+	}
+	return false
+}
+
+// compareArgon2id compares secret with an argon2id hash in PHC string format.
+func compareArgon2id(hash string, secret string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var (
+		version, memory int
+		iterations      uint32
+		threads         uint8
+	)
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	derived := argon2.IDKey([]byte(secret), salt, iterations, uint32(memory), threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// ValidSecret returns true if secret matches one of the client's secrets that
+// hasn't expired, or its plain text secret.
+func (c *Client) ValidSecret(secret string) bool {
+	if secret == "" {
+		return false
+	}
+	if c.Secret != "" && subtle.ConstantTimeCompare([]byte(c.Secret), []byte(secret)) == 1 {
+		return true
+	}
+	now := time.Now()
+	for _, s := range c.Secrets {
+		if !s.Expires.IsZero() && now.After(s.Expires) {
+			continue
+		}
+		if CompareSecret(s.Hash, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// secretLimiter limits the number of failed secret attempts per client, so
+// secrets can't be guessed and hashing can't be used to exhaust the server.
+type secretLimiter struct {
+	mutex    sync.Mutex
+	max      int
+	window   time.Duration
+	failures map[string]*secretFailures
+	swept    time.Time
+}
+
+type secretFailures struct {
+	count int
+	since time.Time
+}
+
+func newSecretLimiter(max int, window time.Duration) *secretLimiter {
+	return &secretLimiter{
+		max: max, window: window, failures: make(map[string]*secretFailures), swept: time.Now(),
+	}
+}
+
+// allow returns false if the client had too many failed attempts in the
+// current window.
+func (l *secretLimiter) allow(clientID string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	f, ok := l.failures[clientID]
+	if !ok {
+		return true
+	}
+	if time.Since(f.since) > l.window {
+		delete(l.failures, clientID)
+		return true
+	}
+	return f.count < l.max
+}
+
+// fail records a failed attempt of the client.
+func (l *secretLimiter) fail(clientID string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	f, ok := l.failures[clientID]
+	if now.Sub(l.swept) > l.window {
+		l.sweep(now)
+	}
+	if !ok || now.Sub(f.since) > l.window {
+		f = &secretFailures{since: now}
+		l.failures[clientID] = f
+	}
+	f.count++
+}
+
+// sweep removes the failures of windows that have passed.
+func (l *secretLimiter) sweep(now time.Time) {
+	l.swept = now
+	for id, f := range l.failures {
+		if now.Sub(f.since) > l.window {
+			delete(l.failures, id)
+		}
+	}
+}
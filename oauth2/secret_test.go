@@ -0,0 +1,86 @@
+package oauth2
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCompareSecret(t *testing.T) {
+	hash, err := HashSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Fatalf("Unexpected hash: %s", hash)
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []string{hash, HashRandomSecret("secret"), string(bcryptHash)} {
+		if !CompareSecret(h, "secret") {
+			t.Errorf("Secret doesn't match %s", h)
+		}
+		if CompareSecret(h, "other") {
+			t.Errorf("Other secret matches %s", h)
+		}
+	}
+	for _, h := range []string{"", "secret", "$sha256$", "$argon2id$v=19$m=65536,t=3,p=4$", "$argon2id$v=18$m=65536,t=3,p=4$c2FsdA$a2V5"} {
+		if CompareSecret(h, "secret") {
+			t.Errorf("Secret matches invalid hash %q", h)
+		}
+	}
+}
+
+func TestClientValidSecret(t *testing.T) {
+	current, _ := HashSecret("current")
+	next, _ := HashSecret("next")
+	old, _ := HashSecret("old")
+	client := &Client{Secrets: []ClientSecret{
+		{Hash: current, Expires: time.Now().Add(time.Hour)},
+		{Hash: next},
+		{Hash: old, Expires: time.Now().Add(-time.Hour)},
+	}}
+	for secret, valid := range map[string]bool{
+		"current": true, "next": true, "old": false, "": false, "other": false,
+	} {
+		if client.ValidSecret(secret) != valid {
+			t.Errorf("ValidSecret(%q) != %v", secret, valid)
+		}
+	}
+	plain := &Client{Secret: "plain"}
+	if !plain.ValidSecret("plain") || plain.ValidSecret("") || plain.ValidSecret("other") {
+		t.Error("Plain text secret not compared correctly")
+	}
+}
+
+func TestSecretLimiter(t *testing.T) {
+	l := newSecretLimiter(2, time.Minute)
+	for i := 0; i < 2; i++ {
+		if !l.allow("client") {
+			t.Fatalf("Attempt %d not allowed", i)
+		}
+		l.fail("client")
+	}
+	if l.allow("client") {
+		t.Fatal("Attempt allowed after too many failures")
+	}
+	if !l.allow("other") {
+		t.Fatal("Failures of another client counted")
+	}
+	// The failures are forgotten after the window
+	l.failures["client"].since = time.Now().Add(-2 * time.Minute)
+	if !l.allow("client") {
+		t.Fatal("Attempt not allowed after window")
+	}
+	l.fail("other")
+	l.failures["other"].since = time.Now().Add(-2 * time.Minute)
+	l.swept = time.Now().Add(-2 * time.Minute)
+	l.fail("client")
+	if _, ok := l.failures["other"]; ok {
+		t.Fatal("Failures not swept")
+	}
+}
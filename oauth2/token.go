@@ -0,0 +1,262 @@
+package oauth2
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/amsterdam/authz/dpop"
+	log "github.com/sirupsen/logrus"
+)
+
+// codeLifetime is how long authorization codes are valid (RFC 6749 section
+// 4.1.2 recommends at most 10 minutes).
+const codeLifetime = 60 * time.Second
+
+// authentication describes how the user authenticated, and holds the extra
+// claims for the user's access token.
+type authentication struct {
+	Subject string `json:"sub"`
+	// UID of the user if Subject is a pairwise subject identifier, for the
+	// audit log
+	UID      string                 `json:"uid,omitempty"`
+	AuthTime int64                  `json:"auth_time,omitempty"`
+	ACR      string                 `json:"acr,omitempty"`
+	Claims   map[string]interface{} `json:"claims,omitempty"`
+}
+
+// codeState is stored for an authorization code until it is exchanged for an
+// access token.
+type codeState struct {
+	authentication
+	ClientID    string   `json:"client_id"`
+	RedirectURI string   `json:"redirect_uri"`
+	Scope       []string `json:"scope"`
+	DPoPJKT     string   `json:"dpop_jkt,omitempty"`
+	Resources   []string `json:"resource,omitempty"`
+	// PKCE code challenge (RFC 7636)
+	CodeChallenge       string `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string `json:"code_challenge_method,omitempty"`
+}
+
+// tokenResponse is a successful response from the token endpoint (RFC 6749
+// section 5.1).
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// tokenError is an error response from the token endpoint (RFC 6749 section
+// 5.2).
+type tokenError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// serveTokenRequest handles token requests.
+func (h *handler) serveTokenRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	logger := h.logger(r).WithField("type", "token request")
+	if err := r.ParseForm(); err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", "invalid form")
+		return
+	}
+	client, err := h.authenticateClient(r)
+	if authErr, ok := err.(*clientAuthError); ok {
+		if authErr.basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		}
+		writeTokenError(w, http.StatusUnauthorized, "invalid_client", authErr.description)
+		logger.Infof("invalid_client: %s", authErr.description)
+		return
+	} else if err != nil {
+		logger.WithError(err).Errorln("Error authenticating client")
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "internal server error")
+		return
+	}
+	logger = logger.WithField("client_id", client.ID)
+	// The DPoP proof is verified before the code is used, so clients can
+	// retry using a nonce
+	if nonce := h.dpop.Nonce(); nonce != "" {
+		w.Header().Set(dpop.NonceHeader, nonce)
+	}
+	jkt, err := h.verifyDPoP(r)
+	if err == dpop.ErrUseNonce {
+		writeTokenError(w, http.StatusBadRequest, "use_dpop_nonce", "DPoP proof must contain a nonce")
+		return
+	} else if err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_dpop_proof", err.Error())
+		logger.Infof("invalid_dpop_proof: %v", err)
+		return
+	}
+	logger = logger.WithField("grant_type", r.PostForm.Get("grant_type"))
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		h.serveCodeGrant(w, r, client, jkt, logger)
+	case "":
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", "grant_type missing")
+	default:
+		writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type", "grant_type not supported")
+	}
+}
+
+// serveCodeGrant exchanges an authorization code for an access token (RFC
+// 6749 section 4.1.3), which is bound to the DPoP key with thumbprint jkt if
+// not empty.
+func (h *handler) serveCodeGrant(w http.ResponseWriter, r *http.Request, client *Client, jkt string, logger *log.Entry) {
+	if !client.allowsGrantType("authorization_code") {
+		writeTokenError(w, http.StatusBadRequest, "unauthorized_client", "grant_type not allowed for client")
+		return
+	}
+	var state codeState
+	if err := h.stateStore.restore(r.Context(), codeKey(r.PostForm.Get("code")), &state); err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "invalid code")
+		logger.WithError(err).Infoln("invalid_grant: invalid code")
+		return
+	}
+	// redirect_uri is only required if it was in the authorization request,
+	// which it must have been if the client has several
+	redirectURI := r.PostForm.Get("redirect_uri")
+	if redirectURI == "" && len(client.Redirects) == 1 {
+		redirectURI = client.Redirects[0]
+	}
+	if state.ClientID != client.ID || state.RedirectURI != redirectURI {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "code not issued to client or redirect_uri")
+		logger.Infoln("invalid_grant: code not issued to client or redirect_uri")
+		return
+	}
+	verifier := r.PostForm.Get("code_verifier")
+	switch {
+	case state.CodeChallenge != "" && !verifyCodeVerifier(state.CodeChallenge, state.CodeChallengeMethod, verifier):
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "invalid code_verifier")
+		logger.Infoln("invalid_grant: invalid code_verifier")
+		return
+	case state.CodeChallenge == "" && (verifier != "" || client.RequirePKCE):
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "code not issued using PKCE")
+		logger.Infoln("invalid_grant: code not issued using PKCE")
+		return
+	}
+	if state.DPoPJKT != "" && state.DPoPJKT != jkt {
+		writeTokenError(w, http.StatusBadRequest, "invalid_dpop_proof", "DPoP key doesn't match dpop_jkt")
+		logger.Infoln("invalid_dpop_proof: DPoP key doesn't match dpop_jkt")
+		return
+	}
+	// The token can be restricted to some of the resources of the
+	// authorization request (RFC 8707 section 2.2)
+	resources, err := h.resourceIndicators(r.PostForm["resource"])
+	if err == nil && len(state.Resources) > 0 {
+		if len(resources) == 0 {
+			resources = state.Resources
+		}
+		for _, resource := range resources {
+			if !contains(state.Resources, resource) {
+				err = errors.New("resource not in authorization request: " + resource)
+				break
+			}
+		}
+	}
+	if err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_target", err.Error())
+		logger.Infof("invalid_target: %v", err)
+		return
+	}
+	h.issueToken(w, r, client, jkt, h.tokenGrant(client, &state.authentication, state.Scope, resources), logger)
+}
+
+// issueToken writes a token response with an access token for the given
+// grant. The token is bound to the client's certificate if it uses mutual
+// TLS, and to the DPoP key with thumbprint jkt if not empty.
+func (h *handler) issueToken(w http.ResponseWriter, r *http.Request, client *Client, jkt string, grant *accessTokenGrant, logger *log.Entry) {
+	cnf := h.certConfirmation(r, client)
+	tokenType := "bearer"
+	if jkt != "" {
+		if cnf == nil {
+			cnf = &confirmation{}
+		}
+		cnf.JKT = jkt
+		tokenType = "DPoP"
+	}
+	grant.Confirm = cnf
+	accessToken, err := h.accessTokenEnc.EncodeGrant(grant)
+	if err != nil {
+		logger.WithError(err).Errorln("Error encoding accesstoken")
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "internal server error")
+		return
+	}
+	w.Header().Set("Pragma", "no-cache")
+	writeJSON(w, http.StatusOK, &tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   tokenType,
+		ExpiresIn:   grant.Lifetime,
+		Scope:       strings.Join(grant.Scopes, " "),
+	})
+	// Auditlog
+	sigIdx := strings.LastIndex(accessToken, ".") + 1
+	fields := log.Fields{
+		"sub":            grant.Subject,
+		"tokensignature": accessToken[sigIdx:],
+		"scopes":         grant.Scopes,
+		"aud":            grant.Audience,
+		"expires_in":     grant.Lifetime,
+		"cert_bound":     cnf != nil && cnf.X5tS256 != "",
+		"dpop_bound":     jkt != "",
+	}
+	if grant.UID != "" {
+		fields["uid"] = grant.UID
+	}
+	logger.WithFields(fields).Info("Access token issued")
+}
+
+// logFields returns the fields of the audit log that identify the user.
+func (a *authentication) logFields() log.Fields {
+	if a.UID != "" {
+		return log.Fields{"sub": a.Subject, "uid": a.UID}
+	}
+	return log.Fields{"sub": a.Subject}
+}
+
+// codeResponse issues an authorization code and redirects the user agent to
+// the client (RFC 6749 section 4.1.2).
+func (h *handler) codeResponse(w http.ResponseWriter, r *http.Request, redirectURI *url.URL, state *authorizationState, authn *authentication, scope []string) error {
+	code, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	data := &codeState{
+		ClientID:            state.ClientID,
+		RedirectURI:         state.RedirectURI,
+		authentication:      *authn,
+		Scope:               scope,
+		DPoPJKT:             state.DPoPJKT,
+		Resources:           state.Resources,
+		CodeChallenge:       state.CodeChallenge,
+		CodeChallengeMethod: state.CodeChallengeMethod,
+	}
+	if err := h.stateStore.persistFor(r.Context(), codeKey(code), data, codeLifetime); err != nil {
+		return err
+	}
+	query := redirectURI.Query()
+	query.Set("code", code)
+	if state.State != "" {
+		query.Set("state", state.State)
+	}
+	redirectURI.RawQuery = query.Encode()
+	w.Header().Set("Location", redirectURI.String())
+	w.WriteHeader(http.StatusSeeOther)
+	return nil
+}
+
+func codeKey(code string) string {
+	return "code:" + code
+}
+
+func writeTokenError(w http.ResponseWriter, status int, code string, desc string) {
+	writeJSON(w, status, &tokenError{code, desc})
+}
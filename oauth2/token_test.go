@@ -0,0 +1,244 @@
+package oauth2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amsterdam/authz/jose"
+)
+
+// testClientKey is the key of the client that uses private_key_jwt.
+const testClientKey = `{ "keys": [
+	{ "kty": "EC", "key_ops": ["sign"], "kid": "client", "crv": "P-256", "x": "g9IULlEyYGp3i2IZ1STiuDQ0rcrt3r3o-01f7_wOM_o=", "y": "8QfpzSUvN4UAI4PliUXpeOv8RwLU8P8qLXqhTCc4w1M=", "d": "dIz2ALAunAxB5ajQVx3fAdbttNX4WazEyvXLyi6BFBc=" }
+]}`
+
+const testClientPublicKey = `{ "keys": [
+	{ "kty": "EC", "kid": "client", "crv": "P-256", "x": "g9IULlEyYGp3i2IZ1STiuDQ0rcrt3r3o-01f7_wOM_o=", "y": "8QfpzSUvN4UAI4PliUXpeOv8RwLU8P8qLXqhTCc4w1M=" }
+]}`
+
+const testTokenJWKS = `{ "keys": [
+	{ "kty": "oct", "key_ops": ["sign", "verify"], "kid": "1", "alg": "HS256", "k": "PTTjIY84aLtaZCxLTrG_d8I0G6YKCV7lg8M4xkKfwQ4=" }
+]}`
+
+func testTokenHandler(t *testing.T) http.Handler {
+	hash, err := HashSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := []*Client{
+		&Client{ID: "secret_client", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}, Secrets: []ClientSecret{{Hash: hash}}},
+		&Client{ID: "jwt_client", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}, Secret: "plain text secret"},
+		&Client{ID: "key_client", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}, JWKS: testClientPublicKey},
+		&Client{ID: "public_client", Redirects: []string{"http://testurl/"}, ResponseTypes: []string{"code"}},
+		&Client{ID: "implicit_client", Redirects: []string{"http://testurl/"}, GrantType: "token"},
+	}
+	return testClientHandler(t, clients)
+}
+
+// testAuthorize runs an authorization request, by default for an
+// authorization code, and returns the redirect to the client.
+func testAuthorize(t *testing.T, handler http.Handler, clientID string, params url.Values) *url.URL {
+	location, err := url.Parse(testAuthorizeResponse(handler, clientID, params).Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+// testAuthorizeResponse runs an authorization request and returns the
+// response to the callback from the IdP.
+func testAuthorizeResponse(handler http.Handler, clientID string, params url.Values) *http.Response {
+	query := url.Values{
+		"client_id": {clientID}, "response_type": {"code"},
+		"scope": {"scope:1"}, "state": {"xyz"}, "idp_id": {"testidp"},
+	}
+	for k, v := range params {
+		query[k] = v
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://test/oauth2/authorize?"+query.Encode(), nil))
+	callbackReq := httptest.NewRequest("GET", w.Result().Header.Get("Location")+"&uid=user:1", nil)
+	for _, cookie := range w.Result().Cookies() {
+		callbackReq.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, callbackReq)
+	return w.Result()
+}
+
+// testCode runs the authorization code flow up to the token request and
+// returns the code.
+func testCode(t *testing.T, handler http.Handler, clientID string) string {
+	return testCodeWithParams(t, handler, clientID, nil)
+}
+
+func testCodeWithParams(t *testing.T, handler http.Handler, clientID string, params url.Values) string {
+	location := testAuthorize(t, handler, clientID, params)
+	if location.Query().Get("state") != "xyz" || location.Query().Get("code") == "" {
+		t.Fatalf("Unexpected redirect: %s", location)
+	}
+	return location.Query().Get("code")
+}
+
+func testTokenRequest(handler http.Handler, form url.Values, basicAuth ...string) (*http.Response, *tokenResponse, *tokenError) {
+	r := testTokenFormRequest(form)
+	if len(basicAuth) == 2 {
+		r.SetBasicAuth(basicAuth[0], basicAuth[1])
+	}
+	return testTokenResponse(handler, r)
+}
+
+func testTokenFormRequest(form url.Values) *http.Request {
+	r := httptest.NewRequest("POST", "http://test/oauth2/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func testTokenResponse(handler http.Handler, r *http.Request) (*http.Response, *tokenResponse, *tokenError) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	resp := w.Result()
+	if resp.StatusCode == http.StatusOK {
+		var token tokenResponse
+		json.NewDecoder(resp.Body).Decode(&token)
+		return resp, &token, nil
+	}
+	var e tokenError
+	json.NewDecoder(resp.Body).Decode(&e)
+	return resp, nil, &e
+}
+
+func testAssertion(t *testing.T, keys *jose.JWKSet, kid string, clientID string, aud string, jti string) string {
+	assertion, err := keys.Encode(kid, map[string]interface{}{
+		"iss": clientID, "sub": clientID, "aud": aud, "jti": jti,
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assertion
+}
+
+func TestTokenCodeGrant(t *testing.T) {
+	handler := testTokenHandler(t)
+	// client_secret_basic
+	code := testCode(t, handler, "secret_client")
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"http://testurl/"}}
+	if resp, _, e := testTokenRequest(handler, form, "secret_client", "wrong"); resp.StatusCode != http.StatusUnauthorized || e.Code != "invalid_client" || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("Authenticated using wrong secret: %s %+v", resp.Status, e)
+	}
+	resp, token, e := testTokenRequest(handler, form, "secret_client", "secret")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Token request failed: %s %+v", resp.Status, e)
+	}
+	if token.TokenType != "bearer" || token.Scope != "scope:1" || token.AccessToken == "" {
+		t.Fatalf("Unexpected token response: %+v", token)
+	}
+	// Codes can only be used once
+	if resp, _, e := testTokenRequest(handler, form, "secret_client", "secret"); e == nil || e.Code != "invalid_grant" {
+		t.Fatalf("Code used twice: %s", resp.Status)
+	}
+	// client_secret_post, and codes are bound to the client
+	code = testCode(t, handler, "secret_client")
+	form = url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"public_client"}}
+	if _, _, e := testTokenRequest(handler, form); e == nil || e.Code != "invalid_grant" {
+		t.Fatalf("Code of other client accepted: %+v", e)
+	}
+	code = testCode(t, handler, "secret_client")
+	form = url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"secret_client"}, "client_secret": {"secret"}}
+	if resp, _, e := testTokenRequest(handler, form); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Token request failed: %s %+v", resp.Status, e)
+	}
+	// Clients with credentials must authenticate
+	code = testCode(t, handler, "secret_client")
+	form = url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_id": {"secret_client"}}
+	if _, _, e := testTokenRequest(handler, form); e == nil || e.Code != "invalid_client" {
+		t.Fatalf("Unauthenticated request accepted: %+v", e)
+	}
+	// Grant type must be allowed
+	form = url.Values{"grant_type": {"authorization_code"}, "code": {"abc"}, "client_id": {"implicit_client"}}
+	if _, _, e := testTokenRequest(handler, form); e == nil || e.Code != "unauthorized_client" {
+		t.Fatalf("Unexpected error: %+v", e)
+	}
+	form = url.Values{"grant_type": {"password"}, "client_id": {"public_client"}}
+	if _, _, e := testTokenRequest(handler, form); e == nil || e.Code != "unsupported_grant_type" {
+		t.Fatalf("Unexpected error: %+v", e)
+	}
+}
+
+func TestTokenClientAssertion(t *testing.T) {
+	handler := testTokenHandler(t)
+	clientKeys, err := jose.LoadJWKSet([]byte(testClientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretKeys := jose.NewJWKSet()
+	secretKeys.AddSymmetricKey("", "HS256", []byte("plain text secret"))
+	tokenURL := "http://test/oauth2/token"
+	for _, test := range []struct {
+		description string
+		clientID    string
+		assertion   string
+		valid       bool
+	}{
+		{"private_key_jwt", "key_client", testAssertion(t, clientKeys, "client", "key_client", tokenURL, "1"), true},
+		{"client_secret_jwt", "jwt_client", testAssertion(t, secretKeys, "", "jwt_client", tokenURL, "1"), true},
+		{"wrong key", "jwt_client", testAssertion(t, clientKeys, "client", "jwt_client", tokenURL, "2"), false},
+		{"wrong audience", "key_client", testAssertion(t, clientKeys, "client", "key_client", "http://other/", "3"), false},
+		{"wrong issuer", "key_client", testAssertion(t, clientKeys, "client", "jwt_client", tokenURL, "4"), false},
+		{"replay", "key_client", testAssertion(t, clientKeys, "client", "key_client", tokenURL, "1"), false},
+	} {
+		code := testCode(t, handler, test.clientID)
+		form := url.Values{
+			"grant_type":            {"authorization_code"},
+			"code":                  {code},
+			"client_assertion_type": {clientAssertionType},
+			"client_assertion":      {test.assertion},
+		}
+		resp, _, e := testTokenRequest(handler, form)
+		if test.valid && resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: token request failed: %s %+v", test.description, resp.Status, e)
+		} else if !test.valid && (e == nil || e.Code != "invalid_client") {
+			t.Errorf("%s: expected invalid_client, got %s %+v", test.description, resp.Status, e)
+		}
+	}
+}
+
+// TestLegacyCodeClient checks that clients that only have grant type "code"
+// still get access tokens in the redirect, as before the token endpoint.
+func TestLegacyCodeClient(t *testing.T) {
+	handler := testClientHandler(t, []*Client{
+		&Client{ID: "legacy", Redirects: []string{"http://testurl/"}, GrantType: "code"},
+	})
+	location := testAuthorize(t, handler, "legacy", nil)
+	fragment, err := url.ParseQuery(location.Fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Query().Get("code") != "" || fragment.Get("access_token") == "" || fragment.Get("state") != "xyz" {
+		t.Fatalf("Unexpected redirect: %s", location)
+	}
+}
+
+func TestTokenSecretFailureLimit(t *testing.T) {
+	handler := testTokenHandler(t)
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {"unknown"}, "redirect_uri": {"http://testurl/"}}
+	for i := 0; i < secretMaxFailures; i++ {
+		if _, _, e := testTokenRequest(handler, form, "secret_client", "wrong"); e == nil || e.Code != "invalid_client" {
+			t.Fatalf("Unexpected error: %+v", e)
+		}
+	}
+	// The right secret is refused too, until the window has passed
+	if _, _, e := testTokenRequest(handler, form, "secret_client", "secret"); e == nil || e.Code != "invalid_client" {
+		t.Fatalf("Unexpected error: %+v", e)
+	}
+	// Other clients can still authenticate
+	if _, _, e := testTokenRequest(handler, form, "jwt_client", "plain text secret"); e == nil || e.Code != "invalid_grant" {
+		t.Fatalf("Unexpected error: %+v", e)
+	}
+}
@@ -1,36 +1,244 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"net"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	defaultRedisMaxIdle     = 3
+	defaultRedisIdleTimeout = 240
+	// Idle time after which the role of a pooled Sentinel connection is
+	// checked
+	redisRoleCheckIdleTime = 10 * time.Second
+)
+
+// restoreScript gets and deletes a key in one atomic command, which unlike
+// MULTI / EXEC can be redirected in a Redis Cluster.
+const restoreScript = `
+local value = redis.call("GET", KEYS[1])
+if value then
+	redis.call("DEL", KEYS[1])
+end
+return value`
+
 type redisStorage struct {
-	pool *redis.Pool
+	prefix  string
+	pool    *redis.Pool
+	cluster *redisCluster
 }
 
-func newRedisStorage(address string, password string) *redisStorage {
-	// Create a Redis connectionpool
-	pool := &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		// Dial creates a connection and authenticates
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", address)
+// newRedisStorage creates a Redis StateKeeper. Depending on the configuration
+// it uses a single server, the master monitored by a set of Sentinels or a
+// Redis Cluster.
+func newRedisStorage(conf *redisConfig) (*redisStorage, error) {
+	dialOptions, err := conf.dialOptions()
+	if err != nil {
+		return nil, err
+	}
+	storage := &redisStorage{prefix: conf.KeyPrefix}
+	switch {
+	case len(conf.SentinelAddresses) > 0 && len(conf.ClusterAddresses) > 0:
+		return nil, errors.New("Can't use Redis Sentinel and Redis Cluster at the same time")
+	case len(conf.SentinelAddresses) > 0:
+		if conf.SentinelMaster == "" {
+			return nil, errors.New("Must set the name of the Redis Sentinel master")
+		}
+		sentinelDialOptions, err := conf.sentinelDialOptions()
+		if err != nil {
+			return nil, err
+		}
+		sentinel := &redisSentinel{
+			addresses:   conf.SentinelAddresses,
+			masterName:  conf.SentinelMaster,
+			password:    conf.SentinelPassword,
+			dialOptions: sentinelDialOptions,
+		}
+		storage.pool = conf.pool(func() (redis.Conn, error) {
+			address, err := sentinel.masterAddress()
 			if err != nil {
 				return nil, err
 			}
-			if password != "" {
-				if _, err := c.Do("AUTH", password); err != nil {
-					c.Close()
-					return nil, err
-				}
+			return conf.dial(address, dialOptions)
+		})
+		// After a failover the old master becomes a replica, so check the
+		// role of pooled connections that have been idle for a while, instead
+		// of sending ROLE on every borrow.
+		storage.pool.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < redisRoleCheckIdleTime {
+				return nil
+			}
+			role, err := redis.Values(c.Do("ROLE"))
+			if err != nil {
+				return err
 			}
-			return c, nil
-		},
+			if len(role) == 0 {
+				return errors.New("Redis ROLE returned nothing")
+			}
+			if r, _ := redis.String(role[0], nil); r != "master" {
+				return fmt.Errorf("Redis server is no longer master but %s", r)
+			}
+			return nil
+		}
+		log.Infof("Using Redis master %s as transient storage", conf.SentinelMaster)
+	case len(conf.ClusterAddresses) > 0:
+		storage.cluster = newRedisCluster(conf.ClusterAddresses, func(address string) *redis.Pool {
+			return conf.pool(func() (redis.Conn, error) {
+				return conf.dial(address, dialOptions)
+			})
+		})
+		log.Infoln("Using Redis Cluster as transient storage")
+	default:
+		storage.pool = conf.pool(func() (redis.Conn, error) {
+			return conf.dial(conf.Address, dialOptions)
+		})
+		log.Infoln("Using Redis as transient storage")
+	}
+	return storage, nil
+}
+
+// Save data in Redis
+func (s *redisStorage) Persist(key string, value string, timeout time.Duration) error {
+	return s.PersistContext(context.Background(), key, value, timeout)
+}
+
+func (s *redisStorage) Restore(key string) (string, error) {
+	return s.RestoreContext(context.Background(), key)
+}
+
+// PersistContext saves data in Redis. Implements oauth2.ContextStateKeeper.
+func (s *redisStorage) PersistContext(ctx context.Context, key string, value string, timeout time.Duration) error {
+	_, err := s.do(ctx, s.prefix+key, "SET", s.prefix+key, value, "EX", int(timeout.Seconds()))
+	return err
+}
+
+// PersistNew saves data in Redis if the key doesn't exist. Implements
+// oauth2.ExclusiveStateKeeper.
+func (s *redisStorage) PersistNew(key string, value string, timeout time.Duration) (bool, error) {
+	return s.PersistNewContext(context.Background(), key, value, timeout)
+}
+
+// PersistNewContext saves data in Redis if the key doesn't exist, using SET
+// NX so concurrent calls can't both succeed. Implements
+// oauth2.ContextExclusiveStateKeeper.
+func (s *redisStorage) PersistNewContext(ctx context.Context, key string, value string, timeout time.Duration) (bool, error) {
+	reply, err := s.do(ctx, s.prefix+key, "SET", s.prefix+key, value, "NX", "EX", int(timeout.Seconds()))
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// RestoreContext gets and deletes data from Redis. Implements
+// oauth2.ContextStateKeeper.
+func (s *redisStorage) RestoreContext(ctx context.Context, key string) (string, error) {
+	value, err := s.do(ctx, s.prefix+key, "EVAL", restoreScript, 1, s.prefix+key)
+	if err != nil {
+		return "", err
+	} else if value == nil {
+		return "", errors.New("key doesnt exist")
+	}
+	return redis.String(value, nil)
+}
+
+// do sends a command that operates on the given key to the server that holds
+// it.
+func (s *redisStorage) do(ctx context.Context, key string, cmd string, args ...interface{}) (interface{}, error) {
+	if s.cluster != nil {
+		return s.cluster.do(ctx, key, cmd, args...)
+	}
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return redisDoContext(ctx, conn, cmd, args...)
+}
+
+// redisDoContext sends a command, giving up when the context's deadline
+// passes.
+func redisDoContext(ctx context.Context, conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		return redis.DoWithTimeout(conn, time.Until(deadline), cmd, args...)
+	}
+	return conn.Do(cmd, args...)
+}
+
+// enabled returns true if Redis is configured.
+func (c *redisConfig) enabled() bool {
+	return c.Address != "" || len(c.SentinelAddresses) > 0 || len(c.ClusterAddresses) > 0
+}
+
+// dialOptions returns the options for connecting to Redis servers.
+func (c *redisConfig) dialOptions() ([]redis.DialOption, error) {
+	return c.tlsDialOptions(c.TLS, c.TLSCAFile, c.TLSServerName)
+}
+
+// sentinelDialOptions returns the options for connecting to Redis Sentinels,
+// which have their own TLS settings.
+func (c *redisConfig) sentinelDialOptions() ([]redis.DialOption, error) {
+	return c.tlsDialOptions(c.SentinelTLS, c.SentinelTLSCAFile, c.SentinelTLSName)
+}
+
+// tlsDialOptions returns the dial options with the configured timeouts, and
+// the given TLS settings.
+func (c *redisConfig) tlsDialOptions(useTLS bool, caFile string, serverName string) ([]redis.DialOption, error) {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(time.Duration(c.ConnectTimeout) * time.Second),
+		redis.DialReadTimeout(time.Duration(c.ReadTimeout) * time.Second),
+		redis.DialWriteTimeout(time.Duration(c.WriteTimeout) * time.Second),
+	}
+	if !useTLS {
+		return options, nil
+	}
+	tlsConfig := &tls.Config{ServerName: serverName}
+	if caFile != "" {
+		roots, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = roots
+	}
+	return append(options, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConfig)), nil
+}
+
+// dial creates a connection to the given server and authenticates.
+func (c *redisConfig) dial(address string, options []redis.DialOption) (redis.Conn, error) {
+	conn, err := redis.Dial("tcp", address, options...)
+	if err != nil {
+		return nil, err
+	}
+	if err := redisAuth(conn, c.Username, c.Password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// pool creates a connection pool that uses the given dial function.
+func (c *redisConfig) pool(dial func() (redis.Conn, error)) *redis.Pool {
+	maxIdle, idleTimeout := c.MaxIdle, c.IdleTimeout
+	if maxIdle == 0 {
+		maxIdle = defaultRedisMaxIdle
+	}
+	if idleTimeout == 0 {
+		idleTimeout = defaultRedisIdleTimeout
+	}
+	return &redis.Pool{
+		MaxIdle:     maxIdle,
+		MaxActive:   c.MaxActive,
+		IdleTimeout: time.Duration(idleTimeout) * time.Second,
+		Dial:        dial,
 		// Ping a connection to see whether it's still alive
 		// TODO: give more thought to semantics
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
@@ -41,35 +249,61 @@ func newRedisStorage(address string, password string) *redisStorage {
 			return err
 		},
 	}
-	log.Println("INFO: Using Redis as transient storage")
-	return &redisStorage{pool}
 }
 
-// Save data in Redis
-func (s *redisStorage) Persist(key string, value string, timeout time.Duration) error {
-	conn := s.pool.Get()
-	defer conn.Close()
-	_, err := conn.Do("SET", key, value, "EX", int(timeout.Seconds()))
+// redisAuth authenticates a connection, using an ACL username if given. An
+// empty password won't AUTH.
+func redisAuth(conn redis.Conn, username string, password string) error {
+	if password == "" {
+		return nil
+	}
+	var err error
+	if username != "" {
+		_, err = conn.Do("AUTH", username, password)
+	} else {
+		_, err = conn.Do("AUTH", password)
+	}
 	return err
 }
 
-func (s *redisStorage) Restore(key string) (string, error) {
-	conn := s.pool.Get()
-	defer conn.Close()
-	if err := conn.Send("MULTI"); err != nil {
-		return "", err
+// redisSentinel discovers the address of a master using Redis Sentinel.
+type redisSentinel struct {
+	addresses   []string
+	masterName  string
+	password    string
+	dialOptions []redis.DialOption
+}
+
+// masterAddress asks the sentinels for the address of the master, returning
+// the first answer.
+func (s *redisSentinel) masterAddress() (string, error) {
+	var lastErr error
+	for _, address := range s.addresses {
+		addr, err := s.askSentinel(address)
+		if err == nil {
+			return addr, nil
+		}
+		log.WithError(err).Warnf("Redis Sentinel %s didn't return master", address)
+		lastErr = err
 	}
-	if err := conn.Send("GET", key); err != nil {
+	return "", fmt.Errorf("No Redis Sentinel knows master %s: %v", s.masterName, lastErr)
+}
+
+func (s *redisSentinel) askSentinel(address string) (string, error) {
+	conn, err := redis.Dial("tcp", address, s.dialOptions...)
+	if err != nil {
 		return "", err
 	}
-	if err := conn.Send("DEL", key); err != nil {
+	defer conn.Close()
+	if err := redisAuth(conn, "", s.password); err != nil {
 		return "", err
 	}
-	if vals, err := redis.Values(conn.Do("EXEC")); err != nil {
+	master, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.masterName))
+	if err != nil {
 		return "", err
-	} else if vals[0] == nil {
-		return "", errors.New("key doesnt exist")
-	} else {
-		return redis.String(vals[0], nil)
 	}
+	if len(master) != 2 {
+		return "", fmt.Errorf("Unexpected reply from Redis Sentinel: %v", master)
+	}
+	return net.JoinHostPort(master[0], master[1]), nil
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// testRedisArray returns the RESP encoded array of the given bulk strings.
+func testRedisArray(values ...string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(values))
+	for _, v := range values {
+		reply += fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	}
+	return reply
+}
+
+// testRedisData returns a reply function for a fake Redis server that stores
+// keys in a map.
+func testRedisData() func(args []string) string {
+	data := make(map[string]string)
+	return func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "SET":
+			if _, ok := data[args[1]]; ok && len(args) > 3 && args[3] == "NX" {
+				return "$-1\r\n"
+			}
+			data[args[1]] = args[2]
+			return "+OK\r\n"
+		case "EVAL":
+			value, ok := data[args[3]]
+			if !ok {
+				return "$-1\r\n"
+			}
+			delete(data, args[3])
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+		case "ROLE":
+			return "*3\r\n$6\r\nmaster\r\n:0\r\n*0\r\n"
+		default:
+			return "+OK\r\n"
+		}
+	}
+}
+
+// testRedisSentinel returns a reply function for a fake Sentinel that knows
+// master mymaster at address.
+func testRedisSentinel(address string) func(args []string) string {
+	host, port, _ := net.SplitHostPort(address)
+	return func(args []string) string {
+		if strings.ToUpper(args[0]) == "SENTINEL" {
+			if args[2] != "mymaster" {
+				return "*-1\r\n"
+			}
+			return testRedisArray(host, port)
+		}
+		return "+OK\r\n"
+	}
+}
+
+// newTestRedisTLSNode starts a fake Redis node that uses TLS with a
+// self-signed certificate for name, and returns the path of a CA file holding
+// the certificate.
+func newTestRedisTLSNode(t *testing.T, name string, reply func(args []string) string) (*testRedisNode, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), name+".pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startTestRedisNode(t, listener, reply), caFile
+}
+
+func TestRedisStorage(t *testing.T) {
+	node := newTestRedisNode(t, testRedisData())
+	storage, err := newRedisStorage(&redisConfig{
+		Address: node.address(), Username: "authz", Password: "secret", KeyPrefix: "authz:",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Persist("key", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := storage.PersistNew("key", "other", time.Minute); err != nil || ok {
+		t.Fatalf("Existing key persisted: %v, %v", ok, err)
+	}
+	if value, err := storage.Restore("key"); err != nil || value != "value" {
+		t.Fatalf("Unexpected value: %q, %v", value, err)
+	}
+	if _, err := storage.Restore("key"); err == nil {
+		t.Fatal("Key restored twice")
+	}
+	// Connections authenticate using the ACL username, and keys are prefixed
+	commands := node.received()
+	if len(commands) != 5 || commands[0] != "AUTH authz secret" ||
+		commands[1] != "SET authz:key value EX 60" ||
+		commands[2] != "SET authz:key other NX EX 60" ||
+		!strings.HasSuffix(commands[3], " 1 authz:key") {
+		t.Fatalf("Unexpected commands: %q", commands)
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	node := newTestRedisNode(t, testRedisData())
+	for _, test := range []struct {
+		username, password, command string
+	}{
+		{"", "", ""},
+		{"authz", "", ""},
+		{"", "secret", "AUTH secret"},
+		{"authz", "secret", "AUTH authz secret"},
+	} {
+		conn, err := redis.Dial("tcp", node.address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := len(node.received())
+		if err := redisAuth(conn, test.username, test.password); err != nil {
+			t.Fatal(err)
+		}
+		conn.Do("PING")
+		conn.Close()
+		commands := node.received()[before:]
+		if test.command == "" && (len(commands) != 1 || commands[0] != "PING") ||
+			test.command != "" && (len(commands) != 2 || commands[0] != test.command) {
+			t.Fatalf("Unexpected commands for %q, %q: %q", test.username, test.password, commands)
+		}
+	}
+	// Failed AUTH fails the dial
+	refusing := newTestRedisNode(t, func(args []string) string {
+		return "-WRONGPASS invalid username-password pair\r\n"
+	})
+	conf := &redisConfig{Address: refusing.address(), Password: "wrong"}
+	if _, err := conf.dial(conf.Address, nil); err == nil {
+		t.Fatal("Dial should fail")
+	}
+}
+
+func TestRedisSentinel(t *testing.T) {
+	master := newTestRedisNode(t, testRedisData())
+	// The first sentinel is down
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+	sentinel := newTestRedisNode(t, testRedisSentinel(master.address()))
+	storage, err := newRedisStorage(&redisConfig{
+		Password:          "secret",
+		SentinelAddresses: []string{down.Addr().String(), sentinel.address()},
+		SentinelMaster:    "mymaster",
+		SentinelPassword:  "sentinel",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Persist("key", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	commands := sentinel.received()
+	if len(commands) != 2 || commands[0] != "AUTH sentinel" || commands[1] != "SENTINEL get-master-addr-by-name mymaster" {
+		t.Fatalf("Unexpected commands sent to sentinel: %q", commands)
+	}
+	if commands := master.received(); len(commands) != 2 || commands[0] != "AUTH secret" {
+		t.Fatalf("Unexpected commands sent to master: %q", commands)
+	}
+	// Unknown masters
+	s := &redisSentinel{addresses: []string{sentinel.address()}, masterName: "other"}
+	if _, err := s.masterAddress(); err == nil {
+		t.Fatal("Found unknown master")
+	}
+}
+
+func TestRedisSentinelRoleCheck(t *testing.T) {
+	role := "master"
+	node := newTestRedisNode(t, func(args []string) string {
+		if args[0] == "ROLE" {
+			return fmt.Sprintf("*3\r\n$%d\r\n%s\r\n:0\r\n*0\r\n", len(role), role)
+		}
+		return "+OK\r\n"
+	})
+	sentinel := newTestRedisNode(t, testRedisSentinel(node.address()))
+	storage, err := newRedisStorage(&redisConfig{
+		SentinelAddresses: []string{sentinel.address()},
+		SentinelMaster:    "mymaster",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := redis.Dial("tcp", node.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Recently used connections aren't checked
+	if err := storage.pool.TestOnBorrow(conn, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if commands := node.received(); len(commands) != 0 {
+		t.Fatalf("Unexpected commands: %q", commands)
+	}
+	idle := time.Now().Add(-2 * redisRoleCheckIdleTime)
+	if err := storage.pool.TestOnBorrow(conn, idle); err != nil {
+		t.Fatal(err)
+	}
+	// After a failover the old master is a replica
+	role = "slave"
+	if err := storage.pool.TestOnBorrow(conn, idle); err == nil {
+		t.Fatal("Replica connection not discarded")
+	}
+	if commands := node.received(); len(commands) != 2 || commands[0] != "ROLE" {
+		t.Fatalf("Unexpected commands: %q", commands)
+	}
+}
+
+func TestRedisTLS(t *testing.T) {
+	master, masterCA := newTestRedisTLSNode(t, "redis.test", testRedisData())
+	sentinel, sentinelCA := newTestRedisTLSNode(t, "sentinel.test", testRedisSentinel(master.address()))
+	conf := &redisConfig{
+		SentinelAddresses: []string{sentinel.address()},
+		SentinelMaster:    "mymaster",
+		SentinelTLS:       true,
+		SentinelTLSCAFile: sentinelCA,
+		SentinelTLSName:   "sentinel.test",
+		TLS:               true,
+		TLSCAFile:         masterCA,
+		TLSServerName:     "redis.test",
+	}
+	storage, err := newRedisStorage(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PersistContext(context.Background(), "key", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentinel.received()) != 1 || len(master.received()) != 1 {
+		t.Fatalf("Unexpected commands: %q, %q", sentinel.received(), master.received())
+	}
+	// Sentinels don't use the TLS settings of the Redis servers
+	conf.SentinelTLSName = "redis.test"
+	if storage, err = newRedisStorage(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Persist("key", "value", time.Minute); err == nil {
+		t.Fatal("Sentinel certificate not verified")
+	}
+	// Missing CA files
+	conf.TLSCAFile = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := newRedisStorage(conf); err == nil {
+		t.Fatal("Missing CA file accepted")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	redisClusterSlots        = 16384
+	redisClusterMaxRedirects = 5
+)
+
+// redisCluster sends commands to the nodes of a Redis Cluster. It learns which
+// node serves the hash slot of a key from MOVED redirections, and follows ASK
+// redirections while a slot is being migrated. Each node has its own
+// connection pool.
+type redisCluster struct {
+	seeds   []string
+	newPool func(address string) *redis.Pool
+	mutex   sync.Mutex
+	pools   map[string]*redis.Pool
+	slots   [redisClusterSlots]string
+	next    int
+}
+
+func newRedisCluster(seeds []string, newPool func(address string) *redis.Pool) *redisCluster {
+	return &redisCluster{
+		seeds:   seeds,
+		newPool: newPool,
+		pools:   make(map[string]*redis.Pool),
+	}
+}
+
+// do sends a command that operates on the given key to the node that serves
+// the key's hash slot.
+func (c *redisCluster) do(ctx context.Context, key string, cmd string, args ...interface{}) (interface{}, error) {
+	slot := redisClusterSlot(key)
+	address, known := c.slotAddress(slot)
+	asking := false
+	for i := 0; i < redisClusterMaxRedirects; i++ {
+		reply, err := c.doAt(ctx, address, asking, cmd, args...)
+		redisErr, ok := err.(redis.Error)
+		if err != nil && !ok {
+			// Connection error: forget the node so the slot is looked up again
+			if known {
+				c.setSlotAddress(slot, "")
+			}
+			return nil, err
+		}
+		redirect := strings.Fields(string(redisErr))
+		if !ok || len(redirect) != 3 || (redirect[0] != "MOVED" && redirect[0] != "ASK") {
+			return reply, err
+		}
+		address, asking = redirect[2], redirect[0] == "ASK"
+		if !asking {
+			c.setSlotAddress(slot, address)
+		}
+	}
+	return nil, errors.New("Too many Redis Cluster redirections")
+}
+
+// doAt sends a command to the node at the given address.
+func (c *redisCluster) doAt(ctx context.Context, address string, asking bool, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := c.pool(address).GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if asking {
+		if _, err := redisDoContext(ctx, conn, "ASKING"); err != nil {
+			return nil, err
+		}
+	}
+	return redisDoContext(ctx, conn, cmd, args...)
+}
+
+// slotAddress returns the address of the node serving the given slot, or of
+// one of the seed nodes if it isn't known yet.
+func (c *redisCluster) slotAddress(slot int) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if address := c.slots[slot]; address != "" {
+		return address, true
+	}
+	c.next = (c.next + 1) % len(c.seeds)
+	return c.seeds[c.next], false
+}
+
+func (c *redisCluster) setSlotAddress(slot int, address string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.slots[slot] = address
+}
+
+// pool returns the connection pool for the node at the given address.
+func (c *redisCluster) pool(address string) *redis.Pool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pool, ok := c.pools[address]
+	if !ok {
+		pool = c.newPool(address)
+		c.pools[address] = pool
+	}
+	return pool
+}
+
+// redisClusterSlot returns the hash slot of a key. Only the part between the
+// first { and the next } is hashed if it's not empty, so keys can be forced
+// into the same slot.
+func redisClusterSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % redisClusterSlots
+}
+
+// crc16 implements CRC-16/XMODEM, as used by Redis Cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// testRedisNode is a fake Redis node that answers commands using reply, which
+// returns a RESP encoded reply. The commands it received are recorded.
+type testRedisNode struct {
+	listener net.Listener
+	reply    func(args []string) string
+	mutex    sync.Mutex
+	commands []string
+}
+
+func newTestRedisNode(t *testing.T, reply func(args []string) string) *testRedisNode {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startTestRedisNode(t, listener, reply)
+}
+
+// startTestRedisNode serves connections accepted by listener.
+func startTestRedisNode(t *testing.T, listener net.Listener, reply func(args []string) string) *testRedisNode {
+	node := &testRedisNode{listener: listener, reply: reply}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go node.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return node
+}
+
+func (n *testRedisNode) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readTestRedisCommand(r)
+		if err != nil {
+			return
+		}
+		n.mutex.Lock()
+		n.commands = append(n.commands, strings.Join(args, " "))
+		n.mutex.Unlock()
+		if _, err := io.WriteString(conn, n.reply(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (n *testRedisNode) address() string {
+	return n.listener.Addr().String()
+}
+
+func (n *testRedisNode) received() []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return append([]string(nil), n.commands...)
+}
+
+// readTestRedisCommand reads a command sent as RESP array of bulk strings.
+func readTestRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		l, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, l+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:l])
+	}
+	return args, nil
+}
+
+func testRedisCluster(seeds ...string) *redisCluster {
+	return newRedisCluster(seeds, func(address string) *redis.Pool {
+		return &redis.Pool{Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", address)
+		}}
+	})
+}
+
+func TestCRC16(t *testing.T) {
+	if crc := crc16("123456789"); crc != 0x31C3 {
+		t.Fatalf("Unexpected CRC16: %#x", crc)
+	}
+}
+
+func TestRedisClusterSlot(t *testing.T) {
+	if a, b := redisClusterSlot("{user}a"), redisClusterSlot("{user}b"); a != b || a != redisClusterSlot("user") {
+		t.Fatalf("Keys with the same hash tag are in different slots: %d, %d", a, b)
+	}
+	// Empty hash tags are ignored
+	if redisClusterSlot("{}a") == redisClusterSlot("{}b") {
+		t.Fatal("Empty hash tag used")
+	}
+	if slot := redisClusterSlot("123456789"); slot != 0x31C3 {
+		t.Fatalf("Unexpected slot: %d", slot)
+	}
+}
+
+func TestRedisClusterMoved(t *testing.T) {
+	target := newTestRedisNode(t, func(args []string) string {
+		return "$5\r\nvalue\r\n"
+	})
+	seed := newTestRedisNode(t, func(args []string) string {
+		return fmt.Sprintf("-MOVED %d %s\r\n", redisClusterSlot(args[1]), target.address())
+	})
+	c := testRedisCluster(seed.address())
+	for i := 0; i < 2; i++ {
+		reply, err := redis.String(c.do(context.Background(), "key", "GET", "key"))
+		if err != nil || reply != "value" {
+			t.Fatalf("Unexpected reply: %q, %v", reply, err)
+		}
+	}
+	// The slot's node is remembered after MOVED
+	if commands := seed.received(); len(commands) != 1 {
+		t.Fatalf("Unexpected commands sent to seed: %q", commands)
+	}
+	if commands := target.received(); len(commands) != 2 || commands[0] != "GET key" {
+		t.Fatalf("Unexpected commands sent to node: %q", commands)
+	}
+}
+
+func TestRedisClusterAsk(t *testing.T) {
+	target := newTestRedisNode(t, func(args []string) string {
+		return "+OK\r\n"
+	})
+	seed := newTestRedisNode(t, func(args []string) string {
+		return fmt.Sprintf("-ASK %d %s\r\n", redisClusterSlot(args[1]), target.address())
+	})
+	c := testRedisCluster(seed.address())
+	for i := 0; i < 2; i++ {
+		if _, err := c.do(context.Background(), "key", "SET", "key", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// ASK redirects only the current command, so the seed is asked again
+	if commands := seed.received(); len(commands) != 2 {
+		t.Fatalf("Unexpected commands sent to seed: %q", commands)
+	}
+	commands := target.received()
+	if len(commands) != 4 || commands[0] != "ASKING" || commands[1] != "SET key value" {
+		t.Fatalf("Unexpected commands sent to node: %q", commands)
+	}
+}
+
+func TestRedisClusterTooManyRedirects(t *testing.T) {
+	var seed *testRedisNode
+	seed = newTestRedisNode(t, func(args []string) string {
+		return fmt.Sprintf("-MOVED %d %s\r\n", redisClusterSlot(args[1]), seed.address())
+	})
+	c := testRedisCluster(seed.address())
+	if _, err := c.do(context.Background(), "key", "GET", "key"); err == nil {
+		t.Fatal("Should not succeed")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/amsterdam/authz/oauth2"
+)
+
+// sqlClients is an oauth2.ClientRegistry that stores dynamically registered
+// clients in a SQL database. Redirects, hashed secrets, grant types, response
+// types, scopes and IdPs are stored as JSON.
+type sqlClients struct {
+	db      *sql.DB
+	dialect *sqlDialect
+}
+
+// sqlClientColumns holds the JSON encoded columns of a client.
+type sqlClientColumns struct {
+	redirects     string
+	secrets       string
+	grantTypes    string
+	responseTypes string
+	scopes        string
+	idps          string
+}
+
+// sqlClientSecret is the JSON encoding of a hashed client secret.
+type sqlClientSecret struct {
+	Hash    string `json:"hash"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+func newSQLClients(db *sql.DB, dialect *sqlDialect) *sqlClients {
+	return &sqlClients{db: db, dialect: dialect}
+}
+
+// Get implements oauth2.ClientMap.
+func (s *sqlClients) Get(id string) (*oauth2.Client, error) {
+	var (
+		c        = &oauth2.Client{ID: id}
+		columns  sqlClientColumns
+		issuedAt int64
+	)
+	err := s.db.QueryRow(s.dialect.query(`
+		SELECT name, redirects, secret, secrets, grant_type, grant_types, response_types, scopes, idps,
+			token_lifetime, require_pkce, require_consent, registration_hash, issued_at
+		FROM authz_client WHERE id = $1`,
+	), id).Scan(
+		&c.Name, &columns.redirects, &c.Secret, &columns.secrets, &c.GrantType,
+		&columns.grantTypes, &columns.responseTypes, &columns.scopes, &columns.idps,
+		&c.TokenLifetime, &c.RequirePKCE, &c.RequireConsent, &c.RegistrationHash, &issuedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Unknown client id")
+	} else if err != nil {
+		return nil, err
+	}
+	var hashes []sqlClientSecret
+	for _, column := range []struct {
+		data string
+		v    interface{}
+	}{
+		{columns.redirects, &c.Redirects},
+		{columns.secrets, &hashes},
+		{columns.grantTypes, &c.GrantTypes},
+		{columns.responseTypes, &c.ResponseTypes},
+		{columns.scopes, &c.Scopes},
+		{columns.idps, &c.IDPs},
+	} {
+		if err := json.Unmarshal([]byte(column.data), column.v); err != nil {
+			return nil, err
+		}
+	}
+	for _, secret := range hashes {
+		clientSecret := oauth2.ClientSecret{Hash: secret.Hash}
+		if secret.Expires != 0 {
+			clientSecret.Expires = time.Unix(secret.Expires, 0)
+		}
+		c.Secrets = append(c.Secrets, clientSecret)
+	}
+	c.IssuedAt = time.Unix(issuedAt, 0)
+	return c, nil
+}
+
+// Register implements oauth2.ClientRegistry.
+func (s *sqlClients) Register(ctx context.Context, c *oauth2.Client) error {
+	columns, err := encodeSQLClient(c)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.dialect.query(`
+		INSERT INTO authz_client (id, name, redirects, secret, secrets, grant_type, grant_types, response_types, scopes, idps,
+			token_lifetime, require_pkce, require_consent, registration_hash, issued_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+	), c.ID, c.Name, columns.redirects, c.Secret, columns.secrets, c.GrantType,
+		columns.grantTypes, columns.responseTypes, columns.scopes, columns.idps,
+		c.TokenLifetime, c.RequirePKCE, c.RequireConsent, c.RegistrationHash, c.IssuedAt.Unix())
+	return err
+}
+
+// Update implements oauth2.ClientRegistry.
+func (s *sqlClients) Update(ctx context.Context, c *oauth2.Client) error {
+	columns, err := encodeSQLClient(c)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, s.dialect.query(`
+		UPDATE authz_client SET name = $1, redirects = $2, secret = $3, secrets = $4, grant_type = $5,
+			grant_types = $6, response_types = $7, scopes = $8, idps = $9, token_lifetime = $10,
+			require_pkce = $11, require_consent = $12, registration_hash = $13
+		WHERE id = $14`,
+	), c.Name, columns.redirects, c.Secret, columns.secrets, c.GrantType,
+		columns.grantTypes, columns.responseTypes, columns.scopes, columns.idps, c.TokenLifetime,
+		c.RequirePKCE, c.RequireConsent, c.RegistrationHash, c.ID)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// Delete implements oauth2.ClientRegistry.
+func (s *sqlClients) Delete(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, s.dialect.query(
+		"DELETE FROM authz_client WHERE id = $1",
+	), id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// encodeSQLClient returns the JSON encoded columns of a client.
+func encodeSQLClient(c *oauth2.Client) (*sqlClientColumns, error) {
+	hashes := []sqlClientSecret{}
+	for _, secret := range c.Secrets {
+		hash := sqlClientSecret{Hash: secret.Hash}
+		if !secret.Expires.IsZero() {
+			hash.Expires = secret.Expires.Unix()
+		}
+		hashes = append(hashes, hash)
+	}
+	var (
+		columns sqlClientColumns
+		err     error
+	)
+	if columns.redirects, err = encodeJSON(c.Redirects); err != nil {
+		return nil, err
+	}
+	if columns.secrets, err = encodeJSON(hashes); err != nil {
+		return nil, err
+	}
+	if columns.grantTypes, err = encodeJSON(c.GrantTypes); err != nil {
+		return nil, err
+	}
+	if columns.responseTypes, err = encodeJSON(c.ResponseTypes); err != nil {
+		return nil, err
+	}
+	if columns.scopes, err = encodeJSON(c.Scopes); err != nil {
+		return nil, err
+	}
+	if columns.idps, err = encodeJSON(c.IDPs); err != nil {
+		return nil, err
+	}
+	return &columns, nil
+}
+
+func encodeJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// expectRow returns an error if a statement didn't affect a row.
+func expectRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("Unknown client id")
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amsterdam/authz/oauth2"
+)
+
+func TestSQLClients(t *testing.T) {
+	storage := testSQLStorage(t)
+	s := newSQLClients(storage.db, storage.dialect)
+	ctx := context.Background()
+	client := &oauth2.Client{
+		ID:               "client",
+		Name:             "App",
+		Redirects:        []string{"https://app/callback", "https://app/other"},
+		GrantType:        "token",
+		RegistrationHash: []byte{1, 2, 3},
+		IssuedAt:         time.Unix(1500000000, 0),
+	}
+	if err := s.Register(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := s.Get("client"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(c, client) {
+		t.Fatalf("Unexpected client: %+v != %+v", c, client)
+	}
+	client.GrantType = ""
+	client.GrantTypes = []string{"authorization_code", "implicit"}
+	client.ResponseTypes = []string{"code", "token"}
+	client.Scopes = []string{"scope:1", "scope:2"}
+	client.IDPs = []string{"idp"}
+	client.TokenLifetime = 600
+	client.RequirePKCE = true
+	client.RequireConsent = true
+	client.Secrets = []oauth2.ClientSecret{
+		{Hash: "$argon2id$1"}, {Hash: "$argon2id$2", Expires: time.Unix(1600000000, 0)},
+	}
+	if err := s.Update(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := s.Get("client"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(c, client) {
+		t.Fatalf("Client not updated: %+v != %+v", c, client)
+	}
+	if err := s.Delete(ctx, "client"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("client"); err == nil {
+		t.Fatal("Client not deleted")
+	}
+	if err := s.Update(ctx, client); err == nil {
+		t.Fatal("Updated unknown client")
+	}
+}
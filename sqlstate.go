@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultReapInterval = 60
+
+// sqlStorage is a StateKeeper that stores state in a SQL database. Restoring
+// deletes the row in the same statement, so state is only restored once.
+// Expired rows of state that was never restored are removed by a reaper.
+type sqlStorage struct {
+	db      *sql.DB
+	dialect *sqlDialect
+	stop    chan struct{}
+}
+
+// newSQLStorage creates a SQL StateKeeper and starts its reaper, which runs
+// every reapInterval.
+func newSQLStorage(db *sql.DB, dialect *sqlDialect, reapInterval time.Duration) *sqlStorage {
+	s := &sqlStorage{db: db, dialect: dialect, stop: make(chan struct{})}
+	go s.reaper(reapInterval)
+	log.Infof("Using %s as transient storage", dialect.driver)
+	return s
+}
+
+// Persist saves data in the database.
+func (s *sqlStorage) Persist(key string, value string, lifetime time.Duration) error {
+	return s.PersistContext(context.Background(), key, value, lifetime)
+}
+
+// Restore removes data from the database and returns it.
+func (s *sqlStorage) Restore(key string) (string, error) {
+	return s.RestoreContext(context.Background(), key)
+}
+
+// PersistContext saves data in the database. Implements
+// oauth2.ContextStateKeeper.
+func (s *sqlStorage) PersistContext(ctx context.Context, key string, value string, lifetime time.Duration) error {
+	expires := time.Now().Add(lifetime).UnixNano() / int64(time.Millisecond)
+	_, err := s.db.ExecContext(ctx, s.dialect.query(`
+		INSERT INTO authz_state (key, value, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`,
+	), key, []byte(value), expires)
+	return err
+}
+
+// PersistNew saves data in the database if the key doesn't exist or has
+// expired. Implements oauth2.ExclusiveStateKeeper.
+func (s *sqlStorage) PersistNew(key string, value string, lifetime time.Duration) (bool, error) {
+	return s.PersistNewContext(context.Background(), key, value, lifetime)
+}
+
+// PersistNewContext saves data in the database if the key doesn't exist or
+// has expired, in a single statement so concurrent calls can't both succeed.
+// Implements oauth2.ContextExclusiveStateKeeper.
+func (s *sqlStorage) PersistNewContext(ctx context.Context, key string, value string, lifetime time.Duration) (bool, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	expires := time.Now().Add(lifetime).UnixNano() / int64(time.Millisecond)
+	res, err := s.db.ExecContext(ctx, s.dialect.query(`
+		INSERT INTO authz_state (key, value, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at
+		WHERE authz_state.expires_at < $4`,
+	), key, []byte(value), expires, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// RestoreContext removes data from the database and returns it. Implements
+// oauth2.ContextStateKeeper.
+func (s *sqlStorage) RestoreContext(ctx context.Context, key string) (string, error) {
+	var (
+		value   []byte
+		expires int64
+	)
+	err := s.db.QueryRowContext(ctx, s.dialect.query(
+		"DELETE FROM authz_state WHERE key = $1 RETURNING value, expires_at",
+	), key).Scan(&value, &expires)
+	if err == sql.ErrNoRows {
+		return "", errors.New("key doesnt exist")
+	} else if err != nil {
+		return "", err
+	}
+	if time.Now().UnixNano()/int64(time.Millisecond) > expires {
+		return "", errors.New("key expired")
+	}
+	return string(value), nil
+}
+
+// Close stops the reaper.
+func (s *sqlStorage) Close() {
+	close(s.stop)
+}
+
+// reaper removes expired rows until the storage is closed.
+func (s *sqlStorage) reaper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if n, err := s.reap(); err != nil {
+				log.WithError(err).Warnln("Error removing expired state")
+			} else if n > 0 {
+				log.Debugf("Removed %d expired state entries", n)
+			}
+		}
+	}
+}
+
+// reap removes expired rows and returns how many were removed.
+func (s *sqlStorage) reap() (int64, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	res, err := s.db.Exec(s.dialect.query(
+		"DELETE FROM authz_state WHERE expires_at < $1",
+	), now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
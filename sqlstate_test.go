@@ -0,0 +1,110 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testSQLStorage(t *testing.T) *sqlStorage {
+	conf := &databaseConfig{
+		Driver: "sqlite3",
+		DSN:    filepath.Join(t.TempDir(), "authz.db"),
+	}
+	db, dialect, err := openDatabase(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Migrations are only applied once
+	if err := migrate(db, dialect); err != nil {
+		t.Fatal(err)
+	}
+	s := newSQLStorage(db, dialect, time.Hour)
+	t.Cleanup(func() {
+		s.Close()
+		db.Close()
+	})
+	return s
+}
+
+func TestSQLStorage(t *testing.T) {
+	s := testSQLStorage(t)
+	value := "binary\x00value"
+	if err := s.Persist("key", value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if restored, err := s.Restore("key"); err != nil {
+		t.Fatal(err)
+	} else if restored != value {
+		t.Fatalf("Unexpected result: %q != %q", restored, value)
+	}
+	if _, err := s.Restore("key"); err == nil {
+		t.Fatal("Key wasn't deleted on restore")
+	}
+	// Expired keys can't be restored
+	if err := s.Persist("expired", value, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Restore("expired"); err == nil {
+		t.Fatal("Expired key was restored")
+	}
+}
+
+func TestSQLStorageReap(t *testing.T) {
+	s := testSQLStorage(t)
+	for key, lifetime := range map[string]time.Duration{
+		"expired1": -time.Second, "expired2": -time.Second, "valid": time.Minute,
+	} {
+		if err := s.Persist(key, "value", lifetime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := s.reap(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("Expected 2 expired rows to be removed, got %d", n)
+	}
+	if _, err := s.Restore("valid"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLStoragePersistNew(t *testing.T) {
+	s := testSQLStorage(t)
+	const n = 20
+	var wg sync.WaitGroup
+	results := make(chan bool, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := s.PersistNew("jti", "1", time.Minute)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- ok
+		}()
+	}
+	wg.Wait()
+	close(results)
+	persisted := 0
+	for ok := range results {
+		if ok {
+			persisted++
+		}
+	}
+	if persisted != 1 {
+		t.Fatalf("Key was persisted %d times", persisted)
+	}
+	// Expired keys are replaced
+	if err := s.Persist("expired", "old", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.PersistNew("expired", "new", time.Minute); err != nil || !ok {
+		t.Fatalf("Expired key wasn't replaced: %v", err)
+	}
+	if value, err := s.Restore("expired"); err != nil || value != "new" {
+		t.Fatalf("Unexpected result: %q, %v", value, err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// enabled returns true if the service is served over TLS.
+func (c *tlsConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// serverConfig returns the TLS configuration of the server. Client
+// certificates are requested but not verified, so clients can authenticate
+// using self-signed certificates; the OAuth 2.0 handler verifies them.
+func (c *tlsConfig) serverConfig() *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.ClientCerts {
+		config.ClientAuth = tls.RequestClientCert
+	}
+	return config
+}
+
+// clientCAs returns the CAs that issue client certificates, or nil if none
+// are configured.
+func (c *tlsConfig) clientCAs() (*x509.CertPool, error) {
+	if c.ClientCAFile == "" {
+		return nil, nil
+	}
+	return loadCertPool(c.ClientCAFile)
+}
+
+// loadCertPool reads PEM encoded certificates from a file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", path)
+	}
+	return pool, nil
+}
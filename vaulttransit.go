@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type vaultTransitKeyResponse struct {
+	Data struct {
+		Type          string `json:"type"`
+		LatestVersion int    `json:"latest_version"`
+		Keys          map[string]struct {
+			PublicKey string `json:"public_key"`
+		} `json:"keys"`
+	} `json:"data"`
+}
+
+type vaultTransitSignResponse struct {
+	Data struct {
+		Signature string `json:"signature"`
+	} `json:"data"`
+}
+
+// vaultTransitSigner signs access tokens using a key in the HashiCorp Vault
+// transit secrets engine, so the private key never leaves Vault. Implements
+// jose.Signer.
+type vaultTransitSigner struct {
+	keyURL     string
+	signURL    string
+	token      string
+	alg        string
+	hash       string
+	keyVersion int
+	publicKey  *ecdsa.PublicKey
+	client     *http.Client
+}
+
+// newVaultTransitSigner creates a signer for the named transit key. It reads
+// the key's public part, and signs using the key version that was current at
+// creation, so signatures keep matching the published verification key when
+// the key is rotated in Vault.
+func newVaultTransitSigner(conf *vaultTransitConfig) (*vaultTransitSigner, error) {
+	baseURL, err := url.Parse(conf.Address)
+	if err != nil {
+		return nil, err
+	}
+	mount := conf.Mount
+	if mount == "" {
+		mount = "transit"
+	}
+	keyURL, err := baseURL.Parse(fmt.Sprintf("/v1/%s/keys/%s", mount, conf.Key))
+	if err != nil {
+		return nil, err
+	}
+	signURL, err := baseURL.Parse(fmt.Sprintf("/v1/%s/sign/%s", mount, conf.Key))
+	if err != nil {
+		return nil, err
+	}
+	signer := &vaultTransitSigner{
+		keyURL:  keyURL.String(),
+		signURL: signURL.String(),
+		token:   conf.Token,
+		client:  &http.Client{Timeout: 2 * time.Second},
+	}
+	if err := signer.readKey(); err != nil {
+		return nil, err
+	}
+	log.Infof("Signing access tokens using Vault transit key %s (version %d)", conf.Key, signer.keyVersion)
+	return signer, nil
+}
+
+// readKey reads the public key of the latest version of the transit key.
+func (v *vaultTransitSigner) readKey() error {
+	var keyResp vaultTransitKeyResponse
+	if err := v.do("GET", v.keyURL, nil, &keyResp); err != nil {
+		return err
+	}
+	switch keyResp.Data.Type {
+	case "ecdsa-p256":
+		v.alg, v.hash = "ES256", "sha2-256"
+	case "ecdsa-p384":
+		v.alg, v.hash = "ES384", "sha2-384"
+	case "ecdsa-p521":
+		v.alg, v.hash = "ES512", "sha2-512"
+	default:
+		return fmt.Errorf("Unsupported Vault transit key type: %s", keyResp.Data.Type)
+	}
+	v.keyVersion = keyResp.Data.LatestVersion
+	version, ok := keyResp.Data.Keys[strconv.Itoa(v.keyVersion)]
+	if !ok {
+		return fmt.Errorf("Vault transit key version %d not found", v.keyVersion)
+	}
+	block, _ := pem.Decode([]byte(version.PublicKey))
+	if block == nil {
+		return errors.New("Vault transit key has no PEM encoded public key")
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	ecKey, ok := pubKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("Unexpected Vault transit public key type: %T", pubKey)
+	}
+	v.publicKey = ecKey
+	return nil
+}
+
+// Algorithm returns the JWS algorithm of the transit key.
+func (v *vaultTransitSigner) Algorithm() string {
+	return v.alg
+}
+
+// Public returns the public key of the transit key version used for signing.
+func (v *vaultTransitSigner) Public() crypto.PublicKey {
+	return v.publicKey
+}
+
+// Sign asks Vault to hash and sign msg. Vault returns an ASN.1 DER encoded
+// ECDSA signature, which is converted to the fixed size R || S that JWS
+// requires.
+func (v *vaultTransitSigner) Sign(msg []byte) ([]byte, error) {
+	reqBody := map[string]interface{}{
+		"input":                base64.StdEncoding.EncodeToString(msg),
+		"hash_algorithm":       v.hash,
+		"prehashed":            false,
+		"marshaling_algorithm": "asn1",
+		"key_version":          v.keyVersion,
+	}
+	var signResp vaultTransitSignResponse
+	if err := v.do("POST", v.signURL, reqBody, &signResp); err != nil {
+		return nil, err
+	}
+	// Signature has the format vault:v<version>:<signature>
+	parts := strings.SplitN(signResp.Data.Signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" || !strings.HasPrefix(parts[1], "v") {
+		return nil, fmt.Errorf("Unexpected signature format from Vault: %s", signResp.Data.Signature)
+	}
+	if version, err := strconv.Atoi(parts[1][1:]); err != nil || version != v.keyVersion {
+		return nil, fmt.Errorf("Unexpected signature key version from Vault: %s", parts[1])
+	}
+	der, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	var sig struct {
+		R, S *big.Int
+	}
+	if rest, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("Trailing data after Vault signature")
+	}
+	size := (v.publicKey.Curve.Params().BitSize + 7) / 8
+	if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 || sig.R.BitLen() > size*8 || sig.S.BitLen() > size*8 {
+		return nil, errors.New("Invalid ECDSA signature from Vault")
+	}
+	jws := make([]byte, 2*size)
+	sig.R.FillBytes(jws[:size])
+	sig.S.FillBytes(jws[size:])
+	return jws, nil
+}
+
+// do sends a request to Vault and decodes the JSON response into v.
+func (v *vaultTransitSigner) do(method string, url string, body interface{}, data interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, url, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Unexpected response from Vault: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(data)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amsterdam/authz/jose"
+)
+
+// testVaultTransit is a fake Vault transit secrets engine holding one ECDSA
+// key. The bodies of sign requests it received are recorded.
+type testVaultTransit struct {
+	keyType  string
+	key      *ecdsa.PrivateKey
+	version  int
+	requests []map[string]interface{}
+	// publicKey overrides the PEM encoded public key of the latest version
+	publicKey string
+	// signature overrides the signature returned by sign requests if set
+	signature string
+	// status overrides the status of sign requests if set
+	status int
+}
+
+func newTestVaultTransit(t *testing.T, keyType string, curve elliptic.Curve) (*testVaultTransit, *httptest.Server) {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault := &testVaultTransit{keyType: keyType, key: key, version: 2}
+	server := httptest.NewServer(vault)
+	t.Cleanup(server.Close)
+	return vault, server
+}
+
+func (v *testVaultTransit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != "token" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v1/transit/keys/signing":
+		der, err := x509.MarshalPKIXPublicKey(&v.key.PublicKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		pubKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		if v.publicKey != "" {
+			pubKey = v.publicKey
+		}
+		var resp vaultTransitKeyResponse
+		resp.Data.Type = v.keyType
+		resp.Data.LatestVersion = v.version
+		resp.Data.Keys = map[string]struct {
+			PublicKey string `json:"public_key"`
+		}{
+			"1":                   {PublicKey: "old"},
+			fmt.Sprint(v.version): {PublicKey: pubKey},
+		}
+		json.NewEncoder(w).Encode(resp)
+	case r.Method == "POST" && r.URL.Path == "/v1/transit/sign/signing":
+		var req map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		v.requests = append(v.requests, req)
+		if v.status != 0 {
+			w.WriteHeader(v.status)
+			return
+		}
+		var resp vaultTransitSignResponse
+		resp.Data.Signature = v.signature
+		if resp.Data.Signature == "" {
+			input, _ := req["input"].(string)
+			sig, err := v.sign(input, req["hash_algorithm"])
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			resp.Data.Signature = fmt.Sprintf("vault:v%d:%s", v.version, sig)
+		}
+		json.NewEncoder(w).Encode(resp)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// sign returns the base64 encoded ASN.1 DER signature of input, like Vault's
+// default asn1 marshaling.
+func (v *testVaultTransit) sign(input string, hashAlgorithm interface{}) (string, error) {
+	msg, err := base64.StdEncoding.DecodeString(input)
+	if err != nil {
+		return "", err
+	}
+	var h hash.Hash
+	switch hashAlgorithm {
+	case "sha2-256":
+		h = sha256.New()
+	case "sha2-384":
+		h = sha512.New384()
+	case "sha2-512":
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("unsupported hash algorithm: %v", hashAlgorithm)
+	}
+	h.Write(msg)
+	sig, err := ecdsa.SignASN1(rand.Reader, v.key, h.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+func testVaultTransitConfig(server *httptest.Server) *vaultTransitConfig {
+	return &vaultTransitConfig{Address: server.URL, Token: "token", Key: "signing"}
+}
+
+func TestVaultTransitSigner(t *testing.T) {
+	for _, test := range []struct {
+		keyType, alg, hash string
+		curve              elliptic.Curve
+	}{
+		{"ecdsa-p256", "ES256", "sha2-256", elliptic.P256()},
+		{"ecdsa-p384", "ES384", "sha2-384", elliptic.P384()},
+		{"ecdsa-p521", "ES512", "sha2-512", elliptic.P521()},
+	} {
+		vault, server := newTestVaultTransit(t, test.keyType, test.curve)
+		signer, err := newVaultTransitSigner(testVaultTransitConfig(server))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signer.Algorithm() != test.alg || !signer.publicKey.Equal(&vault.key.PublicKey) {
+			t.Fatalf("Unexpected key for %s: %s", test.keyType, signer.Algorithm())
+		}
+		// The public key is published as JWK
+		jwks := jose.NewJWKSet()
+		if err := jwks.AddSigner("vault", signer); err != nil {
+			t.Fatal(err)
+		}
+		published, err := jose.LoadJWKSet(jwks.VerifiersJSON())
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := jwks.Encode("vault", map[string]string{"sub": "user:1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Signatures are converted to R || S for the JWS
+		parts := strings.Split(token, ".")
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := (test.curve.Params().BitSize + 7) / 8; len(sig) != 2*size {
+			t.Fatalf("Unexpected signature length for %s: %d", test.alg, len(sig))
+		}
+		var claims map[string]string
+		if err := published.Decode(token, &claims); err != nil {
+			t.Fatal(err)
+		}
+		if claims["sub"] != "user:1" {
+			t.Fatalf("Unexpected claims: %v", claims)
+		}
+		// Vault hashes the signing input, using the key version of the JWK
+		req := vault.requests[0]
+		input := base64.StdEncoding.EncodeToString([]byte(parts[0] + "." + parts[1]))
+		if req["input"] != input || req["hash_algorithm"] != test.hash ||
+			req["prehashed"] != false || req["marshaling_algorithm"] != "asn1" ||
+			req["key_version"] != float64(2) {
+			t.Fatalf("Unexpected sign request: %v", req)
+		}
+	}
+}
+
+func TestVaultTransitSignerMount(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	conf := testVaultTransitConfig(server)
+	conf.Mount = "signing-transit"
+	if _, err := newVaultTransitSigner(conf); err == nil {
+		t.Fatal("Should not succeed")
+	}
+	if len(paths) != 1 || paths[0] != "/v1/signing-transit/keys/signing" {
+		t.Fatalf("Unexpected requests: %q", paths)
+	}
+}
+
+func TestVaultTransitSignerKeyErrors(t *testing.T) {
+	// Wrong token
+	_, server := newTestVaultTransit(t, "ecdsa-p256", elliptic.P256())
+	conf := testVaultTransitConfig(server)
+	conf.Token = "wrong"
+	if _, err := newVaultTransitSigner(conf); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Key types that can't sign JWTs
+	_, server = newTestVaultTransit(t, "rsa-2048", elliptic.P256())
+	if _, err := newVaultTransitSigner(testVaultTransitConfig(server)); err == nil {
+		t.Fatal("Unsupported key type accepted")
+	}
+	// Public keys that aren't PEM encoded ECDSA keys
+	vault, server := newTestVaultTransit(t, "ecdsa-p256", elliptic.P256())
+	for _, pubKey := range []string{
+		"not PEM",
+		"-----BEGIN PUBLIC KEY-----\nbm90IERFUg==\n-----END PUBLIC KEY-----\n",
+	} {
+		vault.publicKey = pubKey
+		if _, err := newVaultTransitSigner(testVaultTransitConfig(server)); err == nil {
+			t.Fatalf("Invalid public key accepted: %q", pubKey)
+		}
+	}
+}
+
+func TestVaultTransitSignerSignErrors(t *testing.T) {
+	vault, server := newTestVaultTransit(t, "ecdsa-p256", elliptic.P256())
+	signer, err := newVaultTransitSigner(testVaultTransitConfig(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.Sign([]byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	vault.status = http.StatusInternalServerError
+	if _, err := signer.Sign([]byte("msg")); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	vault.status = 0
+	for _, sig := range []string{
+		"MEUCIQ==",
+		"vault:MEUCIQ==",
+		"transit:v2:MEUCIQ==",
+		"vault:v1:" + base64.StdEncoding.EncodeToString([]byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x01}),
+		"vault:v2:not base64",
+		"vault:v2:" + base64.StdEncoding.EncodeToString([]byte("not DER")),
+		// Zero S
+		"vault:v2:" + base64.StdEncoding.EncodeToString([]byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x00}),
+	} {
+		vault.signature = sig
+		if _, err := signer.Sign([]byte("msg")); err == nil {
+			t.Fatalf("Signature %q accepted", sig)
+		}
+	}
+	// Short R and S are padded
+	vault.signature = "vault:v2:" + base64.StdEncoding.EncodeToString([]byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x02})
+	sig, err := signer.Sign([]byte("msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig) != 64 || sig[31] != 1 || sig[63] != 2 {
+		t.Fatalf("Unexpected signature: %x", sig)
+	}
+}